@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"mylearning/taskapi"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// runCloneAnonymized implements the clone-anonymized command: it copies the
+// task data into another database with all user content replaced.
+func runCloneAnonymized(args []string) error {
+	fs := flag.NewFlagSet("clone-anonymized", flag.ContinueOnError)
+	sourceURI := fs.String("source-uri", "mongodb://localhost:27017", "MongoDB URI of the source deployment")
+	sourceDB := fs.String("source-db", "taskdb", "source database")
+	targetURI := fs.String("target-uri", "", "MongoDB URI of the target deployment (defaults to -source-uri)")
+	targetDB := fs.String("target-db", "", "target database (required)")
+	salt := fs.String("salt", os.Getenv("ANONYMIZE_SALT"), "secret used to derive fake data (or ANONYMIZE_SALT)")
+	drop := fs.Bool("drop", false, "drop existing collections in the target database first")
+	coldDir := fs.String("cold-dir", "", "cold storage directory of the source, to clone archived tasks too")
+	targetColdDir := fs.String("target-cold-dir", "", "empty cold storage directory for the clone's archived tasks")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: mylearning clone-anonymized -target-db NAME [flags]
+
+Archived (cold storage) tasks live in files, not in MongoDB. They are only
+cloned when -cold-dir and -target-cold-dir are given; otherwise the clone
+lacks them, although its time entries and invoices still refer to them.
+
+`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*coldDir == "") != (*targetColdDir == "") {
+		return fmt.Errorf("-cold-dir and -target-cold-dir go together")
+	}
+	if *targetDB == "" {
+		return fmt.Errorf("-target-db is required")
+	}
+	if *salt == "" {
+		return fmt.Errorf("-salt or ANONYMIZE_SALT is required")
+	}
+	if *targetURI == "" {
+		*targetURI = *sourceURI
+	}
+	if *targetURI == *sourceURI && *targetDB == *sourceDB {
+		return fmt.Errorf("target database must differ from the source")
+	}
+
+	ctx := context.Background()
+	srcClient, err := mongo.Connect(ctx, options.Client().ApplyURI(*sourceURI))
+	if err != nil {
+		return fmt.Errorf("connecting to source: %w", err)
+	}
+	defer srcClient.Disconnect(ctx)
+	dstClient, err := mongo.Connect(ctx, options.Client().ApplyURI(*targetURI))
+	if err != nil {
+		return fmt.Errorf("connecting to target: %w", err)
+	}
+	defer dstClient.Disconnect(ctx)
+
+	src, dst := srcClient.Database(*sourceDB), dstClient.Database(*targetDB)
+	existing, err := dst.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		if !*drop {
+			return fmt.Errorf("target database %s is not empty; pass -drop to replace it", *targetDB)
+		}
+		if err := dst.Drop(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := taskapi.CloneAnonymized(ctx, src, dst, *salt, os.Stdout); err != nil {
+		return err
+	}
+	if *coldDir == "" {
+		fmt.Fprintln(os.Stderr, "clone-anonymized: archived tasks were not cloned; pass -cold-dir and -target-cold-dir to include them")
+		return nil
+	}
+	return taskapi.CloneAnonymizedArchive(*coldDir, *targetColdDir, *salt, os.Stdout)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"mylearning/taskapi"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// devAdminToken is the admin bearer token of the dev profile.
+const devAdminToken = "dev-admin-token"
+
+// devAuth accepts the demo users' API keys and, so requests are easy to
+// write by hand, also the X-User-ID header and the dev admin token.
+type devAuth struct {
+	store  taskapi.StoreAuth
+	header taskapi.HeaderAuth
+}
+
+func (a devAuth) User(c echo.Context) string {
+	if u := a.store.User(c); u != "" {
+		return u
+	}
+	return a.header.User(c)
+}
+
+func (a devAuth) IsAdmin(c echo.Context) bool {
+	return a.store.IsAdmin(c) || a.header.IsAdmin(c)
+}
+
+// runDev implements the dev command: it serves the API against a throwaway
+// database seeded with demo data, with verbose logging and the dev routes
+// enabled. It starts its own mongod in a temporary directory, or with -uri
+// uses a database on a running server. That database must be empty, and
+// since the server is not the command's own, nothing on it is ever dropped:
+// /dev/reset is only offered with the command's own mongod.
+func runDev(args []string) error {
+	fs := flag.NewFlagSet("dev", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	mongodPath := fs.String("mongod", "mongod", "mongod binary to start")
+	uri := fs.String("uri", "", "use this running MongoDB instead of starting mongod")
+	dbName := fs.String("db", "taskdb_dev", "database to use; with -uri it must be empty")
+	keep := fs.Bool("keep", false, "keep the temporary directory on exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: mylearning dev [flags]
+
+There is no embedded database: the profile needs a mongod binary, which it
+starts in a temporary directory, or -uri to use an empty database on a
+running MongoDB server.
+
+`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "taskapi-dev-")
+	if err != nil {
+		return err
+	}
+	if !*keep {
+		defer os.RemoveAll(dir)
+	}
+
+	ctx := context.Background()
+	ownServer := *uri == ""
+	if ownServer {
+		path, err := exec.LookPath(*mongodPath)
+		if err != nil {
+			return fmt.Errorf("%s not found; install MongoDB or pass -uri to use a running server", *mongodPath)
+		}
+		var stop func()
+		if *uri, stop, err = startMongod(ctx, path, dir); err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(*uri).SetServerSelectionTimeout(5*time.Second))
+	if err != nil {
+		return fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	defer client.Disconnect(ctx)
+	if err := client.Ping(ctx, nil); err != nil {
+		return fmt.Errorf("MongoDB at %s is not reachable: %w", *uri, err)
+	}
+	db := client.Database(*dbName)
+	if !ownServer {
+		names, err := db.ListCollectionNames(ctx, bson.M{})
+		if err != nil {
+			return fmt.Errorf("listing collections of %s: %w", *dbName, err)
+		}
+		if len(names) > 0 {
+			return fmt.Errorf("database %s on %s is not empty; pick another -db", *dbName, *uri)
+		}
+	}
+
+	e := echo.New()
+	e.Debug = true
+	e.Logger.SetLevel(log.DEBUG)
+	e.Use(middleware.Logger())
+	e.Use(middleware.Recover())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:  []string{"*"},
+		ExposeHeaders: []string{"Preference-Applied", "Deprecation", "Sunset", "Retry-After"},
+	}))
+
+	// Push keys are throwaway too; browsers subscribed in an earlier run
+	// have to subscribe again.
+	vapidPublic, vapidPrivate, err := taskapi.GenerateVAPIDKeys()
+	if err != nil {
+		return err
+	}
+
+	users := taskapi.NewUserStore(db)
+	srv, err := taskapi.New(
+		taskapi.WithDatabase(db),
+		taskapi.WithAuth(devAuth{
+			store:  taskapi.StoreAuth{Users: users},
+			header: taskapi.HeaderAuth{AdminToken: devAdminToken},
+		}),
+		taskapi.WithLogger(e.Logger),
+		taskapi.WithColdStorage(filepath.Join(dir, "cold")),
+		taskapi.WithJobs(filepath.Join(dir, "jobs"), 1),
+		taskapi.WithWebPush(taskapi.WebPushConfig{
+			PublicKey:              vapidPublic,
+			PrivateKey:             vapidPrivate,
+			Subject:                "mailto:dev@example.com",
+			AllowInsecureEndpoints: true,
+		}),
+		taskapi.WithDevMode(ownServer),
+	)
+	if err != nil {
+		return err
+	}
+	demo, err := srv.SeedDemoData(ctx)
+	if err != nil {
+		return fmt.Errorf("seeding demo data: %w", err)
+	}
+	srv.Register(e)
+	srv.Start(ctx)
+	defer srv.Close()
+
+	printDemo(*addr, *uri, *dbName, demo, ownServer)
+
+	errc := make(chan error, 1)
+	go func() { errc <- e.Start(*addr) }()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	case <-sig:
+		fmt.Fprintln(os.Stderr, "dev: shutting down")
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return e.Shutdown(shutdownCtx)
+}
+
+// startMongod runs mongod on a free local port with its data in dir, and
+// returns its URI and a function that stops it.
+func startMongod(ctx context.Context, path, dir string) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	dataDir := filepath.Join(dir, "db")
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return "", nil, err
+	}
+	logPath := filepath.Join(dir, "mongod.log")
+	cmd := exec.Command(path, "--dbpath", dataDir, "--port", strconv.Itoa(port),
+		"--bind_ip", "127.0.0.1", "--logpath", logPath)
+	if err := cmd.Start(); err != nil {
+		return "", nil, fmt.Errorf("starting mongod: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	stop := func() {
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			cmd.Process.Kill()
+			<-exited
+		}
+	}
+
+	uri := fmt.Sprintf("mongodb://127.0.0.1:%d", port)
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+		if err == nil {
+			conn.Close()
+			fmt.Fprintf(os.Stderr, "dev: started mongod on %s (log: %s)\n", uri, logPath)
+			return uri, stop, nil
+		}
+		select {
+		case err := <-exited:
+			return "", nil, fmt.Errorf("mongod exited (%v); see %s", err, logPath)
+		case <-ctx.Done():
+			stop()
+			return "", nil, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			stop()
+			return "", nil, fmt.Errorf("mongod did not start listening; see %s", logPath)
+		}
+	}
+}
+
+func printDemo(addr, uri, dbName string, demo *taskapi.DemoData, reset bool) {
+	base := "http://" + addr
+	fmt.Printf("\nDev server on %s, data in %s/%s\n", base, uri, dbName)
+	fmt.Printf("Seeded %d tasks with %d comments in projects %v.\n\n", demo.Tasks, demo.Comments, demo.Projects)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tPASSWORD\tAPI KEY\tROLES")
+	for _, u := range demo.Users {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", u.Username, u.Password, u.APIKey, u.Roles)
+	}
+	w.Flush()
+
+	fmt.Printf(`
+Requests may also name the user with "X-User-ID: alice"; the admin token is %q.
+Add ?mock_delay=2s or ?mock_status=503 to any request to simulate a slow or
+failing server. Browsers can subscribe to push notifications with the key at
+%s/push/vapid-public-key.
+`, devAdminToken, base)
+	if reset {
+		fmt.Printf("POST %s/dev/reset restores the demo data.\n", base)
+	}
+	fmt.Printf(`
+  curl -H "Authorization: Bearer %s" %s/tasks
+
+`, demo.Users[1].APIKey, base)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listenUnixPrivate creates the socket at path. There is no umask to tighten
+// here, so the socket is open with default permissions until chmod.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
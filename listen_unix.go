@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnixPrivate creates the socket at path readable and writable by its
+// owner only, so nobody can connect before its mode and group are set. The
+// umask is process-wide, which is fine while the server is starting up.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0o177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
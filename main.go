@@ -2,29 +2,45 @@ package main
 
 import (
 	"context"
-	"net/http"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"mylearning/taskapi"
+
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type Task struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Title       string             `bson:"title" json:"title"`
-	Description string             `bson:"description,omitempty" json:"description,omitempty"`
-	Status      string             `bson:"status" json:"status"`
-	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
-}
-
-var taskCollection *mongo.Collection
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "clone-anonymized" {
+		if err := runCloneAnonymized(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "clone-anonymized:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dev" {
+		if err := runDev(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "dev:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		if err := runUsers(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "users:", err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	e := echo.New()
 	e.Use(middleware.Logger())
@@ -34,126 +50,105 @@ func main() {
 	if err != nil {
 		e.Logger.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
-	taskCollection = client.Database("taskdb").Collection("tasks")
 
-	e.POST("/tasks", createTask)
-	e.GET("/tasks", getAllTasks)
-	e.GET("/tasks/:id", getTaskByID)
-	e.PUT("/tasks/:id", updateTask)
-	e.DELETE("/tasks/:id", deleteTask)
-
-	e.Logger.Fatal(e.Start(":8080"))
-}
-
-func createTask(c echo.Context) error {
-	task := new(Task)
-	if err := c.Bind(task); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
-	}
-
-	if task.Title == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Title is required"})
+	db := client.Database("taskdb")
+	var auth taskapi.Auth = taskapi.HeaderAuth{
+		AdminToken:        os.Getenv("ADMIN_TOKEN"),
+		InsecureOpenAdmin: os.Getenv("INSECURE_OPEN_ADMIN") == "true",
 	}
-	if task.Status == "" {
-		task.Status = "Pending"
+	if os.Getenv("AUTH_MODE") == "users" {
+		auth = taskapi.StoreAuth{Users: taskapi.NewUserStore(db)}
 	}
 
-	task.ID = primitive.NewObjectID()
-	task.CreatedAt = time.Now()
-	task.UpdatedAt = time.Now()
-
-	_, err := taskCollection.InsertOne(context.Background(), task)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create task"})
+	opts := []taskapi.Option{
+		taskapi.WithDatabase(db),
+		taskapi.WithAuth(auth),
+		taskapi.WithLogger(e.Logger),
+		taskapi.WithIDStrategy(getEnv("ID_STRATEGY", "objectid")),
+		taskapi.WithColdStorage(getEnv("COLD_STORAGE_DIR", "cold")),
+		taskapi.WithJobs(getEnv("JOB_DIR", "jobs"), 2),
+		taskapi.WithDeprecatedRoutes(strings.Split(os.Getenv("DEPRECATED_ROUTES"), ",")...),
 	}
-
-	return c.JSON(http.StatusCreated, task)
-}
-
-func getAllTasks(c echo.Context) error {
-	cursor, err := taskCollection.Find(context.Background(), bson.M{})
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch tasks"})
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		opts = append(opts, taskapi.WithS3(endpoint, getEnv("S3_BUCKET", "attachments"), getEnv("S3_REGION", "us-east-1"),
+			os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY")))
 	}
-	defer cursor.Close(context.Background())
-
-	tasks := []Task{}
-	for cursor.Next(context.Background()) {
-		var task Task
-		if err := cursor.Decode(&task); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding task data"})
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		opts = append(opts, taskapi.WithSMTP(addr, os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")))
+	}
+	if path := os.Getenv("MQTT_CONFIG"); path != "" {
+		cfg, err := loadMQTTConfig(path)
+		if err != nil {
+			e.Logger.Fatalf("Failed to load MQTT config: %v", err)
 		}
-		tasks = append(tasks, task)
+		opts = append(opts, taskapi.WithMQTT(cfg))
 	}
-
-	return c.JSON(http.StatusOK, tasks)
-}
-
-func getTaskByID(c echo.Context) error {
-	id := c.Param("id")
-	objectID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		opts = append(opts, taskapi.WithWebPush(taskapi.WebPushConfig{
+			PublicKey:  os.Getenv("VAPID_PUBLIC_KEY"),
+			PrivateKey: key,
+			Subject:    os.Getenv("VAPID_SUBJECT"),
+		}))
 	}
-
-	var task Task
-	err = taskCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&task)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
-		}
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	if mb, _ := strconv.Atoi(os.Getenv("IMPORT_MAX_MB")); mb > 0 {
+		opts = append(opts, taskapi.WithImportLimit(int64(mb)<<20))
 	}
-
-	return c.JSON(http.StatusOK, task)
-}
-
-func updateTask(c echo.Context) error {
-	id := c.Param("id")
-	objectID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	if days, _ := strconv.Atoi(os.Getenv("COLD_TIERING_AFTER_DAYS")); days > 0 {
+		opts = append(opts, taskapi.WithTiering(days))
 	}
 
-	update := new(Task)
-	if err := c.Bind(update); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	if os.Getenv("AUTH_MODE") != "users" && os.Getenv("ADMIN_TOKEN") == "" {
+		e.Logger.Warn("ADMIN_TOKEN is not set; the /admin routes are closed")
 	}
 
-	update.UpdatedAt = time.Now()
-	updateData := bson.M{
-		"$set": bson.M{
-			"title":       update.Title,
-			"description": update.Description,
-			"status":      update.Status,
-			"updated_at":  update.UpdatedAt,
-		},
+	srv, err := taskapi.New(opts...)
+	if err != nil {
+		e.Logger.Fatalf("Failed to set up server: %v", err)
 	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv.Register(e)
+	srv.Start(ctx)
 
-	result, err := taskCollection.UpdateOne(context.Background(), bson.M{"_id": objectID}, updateData)
+	ln, err := openListener(getEnv("LISTEN_ADDR", ":8080"))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update task"})
+		e.Logger.Fatalf("Failed to open listener: %v", err)
 	}
-	if result.MatchedCount == 0 {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	if ln != nil {
+		e.Listener = ln
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- e.Start(getEnv("LISTEN_ADDR", ":8080")) }()
+	select {
+	case err := <-errc:
+		e.Logger.Fatal(err)
+	case <-ctx.Done():
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Task updated successfully"})
+	// Finish the requests in flight, then let the background workers wrap
+	// up; running jobs go back to the queue.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		e.Logger.Errorf("Failed to shut down cleanly: %v", err)
+	}
+	srv.Close()
 }
 
-func deleteTask(c echo.Context) error {
-	id := c.Param("id")
-	objectID, err := primitive.ObjectIDFromHex(id)
+// loadMQTTConfig reads the MQTT bridge configuration from a JSON file.
+func loadMQTTConfig(path string) (taskapi.MQTTConfig, error) {
+	var cfg taskapi.MQTTConfig
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+		return cfg, err
 	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
 
-	result, err := taskCollection.DeleteOne(context.Background(), bson.M{"_id": objectID})
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete task"})
-	}
-	if result.DeletedCount == 0 {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
-	return c.JSON(http.StatusOK, map[string]string{"message": "Task deleted successfully"})
+	return fallback
 }
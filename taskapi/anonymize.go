@@ -0,0 +1,319 @@
+package taskapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var fakeWords = strings.Fields(`lorem ipsum dolor sit amet consectetur adipiscing elit sed do
+	eiusmod tempor incididunt ut labore et dolore magna aliqua enim ad minim veniam quis nostrud
+	exercitation ullamco laboris nisi aliquip ex ea commodo consequat duis aute irure in
+	reprehenderit voluptate velit esse cillum fugiat nulla pariatur excepteur sint occaecat
+	cupidatat non proident sunt culpa qui officia deserunt mollit anim id est laborum`)
+
+var fakeFirstNames = strings.Fields(`Alex Blake Casey Dana Eli Frankie Gray Harper Indy Jordan
+	Kai Logan Morgan Noel Oakley Parker Quinn Riley Sage Taylor`)
+
+var fakeLastNames = strings.Fields(`Adams Brooks Carter Diaz Ellis Foster Garcia Hayes Irwin
+	Jensen Kim Lopez Miller Nguyen Owens Patel Reed Shaw Turner Walsh`)
+
+// anonymizer derives fake values from a secret salt, so the same input always
+// maps to the same output within one clone (keeping relationships intact)
+// while the mapping cannot be reversed without the salt.
+type anonymizer struct {
+	salt []byte
+}
+
+func (a *anonymizer) hash(parts ...string) []byte {
+	mac := hmac.New(sha256.New, a.salt)
+	for _, p := range parts {
+		mac.Write([]byte(p))
+		mac.Write([]byte{0})
+	}
+	return mac.Sum(nil)
+}
+
+func (a *anonymizer) rng(parts ...string) *rand.Rand {
+	return rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(a.hash(parts...)))))
+}
+
+// text replaces s with filler words of similar length, seeded by key, so the
+// result has the same shape (word count, line breaks, empty or not) as s.
+func (a *anonymizer) text(key, s string) string {
+	if s == "" {
+		return ""
+	}
+	r := a.rng("text", key)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		words := strings.Fields(line)
+		for j, w := range words {
+			fake := fakeWords[r.Intn(len(fakeWords))]
+			for len(fake) < len(w)-2 {
+				fake += fakeWords[r.Intn(len(fakeWords))]
+			}
+			if j == 0 && unicode.IsUpper([]rune(w)[0]) {
+				fake = strings.ToUpper(fake[:1]) + fake[1:]
+			}
+			words[j] = fake
+		}
+		lines[i] = strings.Join(words, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// identity maps a user name (or email) to a stable fake person.
+func (a *anonymizer) identity(name string) string {
+	if name == "" {
+		return ""
+	}
+	h := a.hash("identity", strings.ToLower(name))
+	first := fakeFirstNames[int(h[0])%len(fakeFirstNames)]
+	last := fakeLastNames[int(h[1])%len(fakeLastNames)]
+	suffix := hex.EncodeToString(h[2:4])
+	if strings.Contains(name, "@") {
+		return strings.ToLower(first+"."+last+"."+suffix) + "@example.com"
+	}
+	return first + " " + last + " " + suffix
+}
+
+// label maps an organisational name (project, team) to a stable pseudonym.
+func (a *anonymizer) label(kind, name string) string {
+	if name == "" {
+		return ""
+	}
+	return kind + "-" + hex.EncodeToString(a.hash(kind, name)[:4])
+}
+
+func (a *anonymizer) filename(key, name string) string {
+	ext := path.Ext(name)
+	return "file-" + hex.EncodeToString(a.hash("file", key, name)[:6]) + ext
+}
+
+func (a *anonymizer) task(t *Task) {
+	t.Title = a.text(string(t.ID)+"/title", t.Title)
+	t.Description = a.text(string(t.ID)+"/description", t.Description)
+	t.Project = a.label("project", t.Project)
+	t.Team = a.label("team", t.Team)
+	t.Assignee = a.identity(t.Assignee)
+	for i, tag := range t.Tags {
+		t.Tags[i] = a.label("tag", tag)
+	}
+	if t.ExternalID != "" {
+		t.ExternalID = a.label("ext", t.ExternalSource+"/"+t.ExternalID)
+	}
+}
+
+func (a *anonymizer) comment(cm *Comment) {
+	cm.Body = a.text(cm.ID.Hex()+"/body", cm.Body)
+	cm.Author = a.identity(cm.Author)
+}
+
+func (a *anonymizer) attachment(att *Attachment) {
+	att.Filename = a.filename(att.ID.Hex(), att.Filename)
+	att.Key = "tasks/" + string(att.TaskID) + "/" + att.ID.Hex() + "/" + att.Filename
+	att.UploadID = ""
+}
+
+func (a *anonymizer) calendar(cal *Calendar) {
+	cal.Name = a.text(cal.ID.Hex()+"/name", cal.Name)
+	cal.Project = a.label("project", cal.Project)
+	cal.Team = a.label("team", cal.Team)
+}
+
+func (a *anonymizer) timeEntry(e *TimeEntry) {
+	e.Project = a.label("project", e.Project)
+	e.User = a.identity(e.User)
+	e.Note = a.text(e.ID.Hex()+"/note", e.Note)
+}
+
+func (a *anonymizer) billingRate(r *BillingRate) {
+	r.Project = a.label("project", r.Project)
+	r.User = a.identity(r.User)
+}
+
+// invoice scrubs line task titles with the same key as the task, so they
+// still match the cloned tasks.
+func (a *anonymizer) invoice(inv *Invoice) {
+	inv.Project = a.label("project", inv.Project)
+	for i := range inv.Lines {
+		l := &inv.Lines[i]
+		l.TaskTitle = a.text(string(l.TaskID)+"/title", l.TaskTitle)
+		l.User = a.identity(l.User)
+		l.Note = a.text(l.EntryID.Hex()+"/note", l.Note)
+	}
+}
+
+func (a *anonymizer) reminder(r *Reminder) {
+	r.User = a.identity(r.User)
+	r.Note = a.text(r.ID.Hex()+"/note", r.Note)
+}
+
+func (a *anonymizer) workflow(wf *Workflow) {
+	wf.Project = a.label("project", wf.Project)
+}
+
+func (a *anonymizer) estimationSession(sess *EstimationSession) {
+	sess.Name = a.text(sess.ID.Hex()+"/name", sess.Name)
+	sess.Facilitator = a.identity(sess.Facilitator)
+	for i := range sess.Items {
+		for j := range sess.Items[i].Votes {
+			sess.Items[i].Votes[j].User = a.identity(sess.Items[i].Votes[j].User)
+		}
+	}
+}
+
+// user keeps accounts and roles but no credentials: cloned users have to
+// get a reset link to sign in.
+func (a *anonymizer) user(u *User) {
+	u.Username = a.identity(u.Username)
+	u.Email = a.identity(u.Email)
+	u.PasswordHash = ""
+	u.APIKeys = nil
+	u.ResetHash, u.ResetExpires = "", nil
+}
+
+// cloneCollection copies every document of name from src to dst, passing
+// each through scrub. IDs and timestamps are left alone.
+func cloneCollection[T any](ctx context.Context, src, dst *mongo.Database, name string, scrub func(*T)) (int, error) {
+	cursor, err := src.Collection(name).Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	const batchSize = 500
+	batch := make([]interface{}, 0, batchSize)
+	n := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := dst.Collection(name).InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+		n += len(batch)
+		batch = batch[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		doc := new(T)
+		if err := cursor.Decode(doc); err != nil {
+			return n, err
+		}
+		scrub(doc)
+		batch = append(batch, doc)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// CloneAnonymized copies the task data from src into dst with all user
+// content replaced by fake data derived from salt, reporting per-collection
+// counts to out. dst should be empty.
+func CloneAnonymized(ctx context.Context, src, dst *mongo.Database, salt string, out io.Writer) error {
+	a := &anonymizer{salt: []byte(salt)}
+	steps := []struct {
+		name  string
+		clone func() (int, error)
+	}{
+		{"tasks", func() (int, error) { return cloneCollection(ctx, src, dst, "tasks", a.task) }},
+		{"comments", func() (int, error) { return cloneCollection(ctx, src, dst, "comments", a.comment) }},
+		{"attachments", func() (int, error) { return cloneCollection(ctx, src, dst, "attachments", a.attachment) }},
+		{"calendars", func() (int, error) { return cloneCollection(ctx, src, dst, "calendars", a.calendar) }},
+		{"time_entries", func() (int, error) { return cloneCollection(ctx, src, dst, "time_entries", a.timeEntry) }},
+		{"billing_rates", func() (int, error) { return cloneCollection(ctx, src, dst, "billing_rates", a.billingRate) }},
+		{"invoices", func() (int, error) { return cloneCollection(ctx, src, dst, "invoices", a.invoice) }},
+		{"users", func() (int, error) { return cloneCollection(ctx, src, dst, "users", a.user) }},
+		{"workflows", func() (int, error) { return cloneCollection(ctx, src, dst, "workflows", a.workflow) }},
+		{"reminders", func() (int, error) { return cloneCollection(ctx, src, dst, "reminders", a.reminder) }},
+		{"estimation_sessions", func() (int, error) {
+			return cloneCollection(ctx, src, dst, "estimation_sessions", a.estimationSession)
+		}},
+		// Copied so invoices issued in the clone continue the numbering.
+		{"counters", func() (int, error) { return cloneCollection(ctx, src, dst, "counters", func(*bson.M) {}) }},
+	}
+	for _, step := range steps {
+		n, err := step.clone()
+		if err != nil {
+			return fmt.Errorf("cloning %s: %w", step.name, err)
+		}
+		fmt.Fprintf(out, "%-12s %d documents\n", step.name, n)
+	}
+
+	// The search index is rebuilt from the scrubbed documents rather than
+	// copied, since it holds the original text. Attachment contents are not
+	// copied, so only their filenames are indexed.
+	if _, err := rebuildSearchIndex(ctx, dst, nil); err != nil {
+		return fmt.Errorf("rebuilding search index: %w", err)
+	}
+	return nil
+}
+
+// CloneAnonymizedArchive copies the archived tasks in the cold storage
+// directory srcDir into dstDir, scrubbed the same way CloneAnonymized scrubs
+// live tasks, so time entries and invoice lines of the clone still find
+// them. dstDir should be empty.
+func CloneAnonymizedArchive(srcDir, dstDir, salt string, out io.Writer) error {
+	src, err := openColdStore(srcDir)
+	if err != nil {
+		return err
+	}
+	dst, err := openColdStore(dstDir)
+	if err != nil {
+		return err
+	}
+	if len(dst.index) > 0 {
+		return fmt.Errorf("cold storage directory %s is not empty", dstDir)
+	}
+
+	a := &anonymizer{salt: []byte(salt)}
+	const batchSize = 1000
+	batch := make([]Task, 0, batchSize)
+	n := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := dst.writeSegment(batch, time.Now())
+		n += len(batch)
+		batch = batch[:0]
+		return err
+	}
+	err = src.each(func(t *Task) error {
+		a.task(t)
+		batch = append(batch, *t)
+		if len(batch) == batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return fmt.Errorf("cloning archived tasks: %w", err)
+	}
+	fmt.Fprintf(out, "%-12s %d tasks\n", "archive", n)
+	return nil
+}
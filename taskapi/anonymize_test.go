@@ -0,0 +1,88 @@
+package taskapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnonymizerDeterminism(t *testing.T) {
+	a := &anonymizer{salt: []byte("salt")}
+	again := &anonymizer{salt: []byte("salt")}
+	other := &anonymizer{salt: []byte("pepper")}
+
+	tests := []struct {
+		name string
+		fn   func(*anonymizer) string
+	}{
+		{"text", func(a *anonymizer) string { return a.text("t1/title", "Fix the login page") }},
+		{"identity", func(a *anonymizer) string { return a.identity("ann") }},
+		{"email", func(a *anonymizer) string { return a.identity("ann@corp.example") }},
+		{"label", func(a *anonymizer) string { return a.label("project", "payroll") }},
+		{"filename", func(a *anonymizer) string { return a.filename("att1", "salaries.pdf") }},
+	}
+	for _, tt := range tests {
+		got := tt.fn(a)
+		if got == "" {
+			t.Errorf("%s: empty output", tt.name)
+		}
+		if again := tt.fn(again); again != got {
+			t.Errorf("%s: %q and %q with the same salt", tt.name, got, again)
+		}
+		if salted := tt.fn(other); salted == got {
+			t.Errorf("%s: %q with another salt too", tt.name, got)
+		}
+	}
+}
+
+func TestAnonymizerKeepsShape(t *testing.T) {
+	a := &anonymizer{salt: []byte("salt")}
+	tests := []struct {
+		name, in string
+	}{
+		{"empty", ""},
+		{"one word", "Payroll"},
+		{"lines", "Ask Ann about\n\nthe Q3 salary bands"},
+	}
+	for _, tt := range tests {
+		got := a.text("k", tt.in)
+		inLines, gotLines := strings.Split(tt.in, "\n"), strings.Split(got, "\n")
+		if len(gotLines) != len(inLines) {
+			t.Errorf("%s: %q has %d lines, want %d", tt.name, got, len(gotLines), len(inLines))
+			continue
+		}
+		for i := range inLines {
+			if n, want := len(strings.Fields(gotLines[i])), len(strings.Fields(inLines[i])); n != want {
+				t.Errorf("%s: line %d of %q has %d words, want %d", tt.name, i, got, n, want)
+			}
+		}
+		if tt.in != "" && strings.Contains(got, "Ann") {
+			t.Errorf("%s: %q leaks the original", tt.name, got)
+		}
+	}
+
+	// Case differences name the same person; emails stay emails.
+	if a.identity("Ann") != a.identity("ann") {
+		t.Error("identity depends on case")
+	}
+	if email := a.identity("ann@corp.example"); !strings.HasSuffix(email, "@example.com") {
+		t.Errorf("identity of an email = %q", email)
+	}
+	if a.identity("") != "" || a.label("team", "") != "" {
+		t.Error("empty values were filled in")
+	}
+	if name := a.filename("att1", "salaries.pdf"); !strings.HasSuffix(name, ".pdf") || strings.Contains(name, "salaries") {
+		t.Errorf("filename = %q", name)
+	}
+}
+
+// Invoice lines must keep matching the cloned tasks they bill.
+func TestAnonymizerInvoiceMatchesTask(t *testing.T) {
+	a := &anonymizer{salt: []byte("salt")}
+	task := &Task{ID: "t1", Title: "Fix login", Project: "web", Assignee: "ann"}
+	inv := &Invoice{Project: "web", Lines: []InvoiceLine{{TaskID: "t1", TaskTitle: "Fix login", User: "ann"}}}
+	a.task(task)
+	a.invoice(inv)
+	if inv.Lines[0].TaskTitle != task.Title || inv.Project != task.Project || inv.Lines[0].User != task.Assignee {
+		t.Errorf("invoice %+v does not match task %+v", inv.Lines[0], task)
+	}
+}
@@ -0,0 +1,340 @@
+package taskapi
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	presignExpiry       = 15 * time.Minute
+	multipartPartSize   = 16 << 20
+	maxMultipartParts   = 10000
+	pendingUploadMaxAge = 24 * time.Hour
+)
+
+type Attachment struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TaskID      TaskID             `bson:"task_id" json:"task_id"`
+	Filename    string             `bson:"filename" json:"filename"`
+	ContentType string             `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Size        int64              `bson:"size" json:"size"`
+	Key         string             `bson:"key" json:"-"`
+	Status      string             `bson:"status" json:"status"`
+	UploadID    string             `bson:"upload_id,omitempty" json:"-"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UploadedAt  *time.Time         `bson:"uploaded_at,omitempty" json:"uploaded_at,omitempty"`
+}
+
+const (
+	attachmentPending  = "Pending"
+	attachmentUploaded = "Uploaded"
+)
+
+type uploadPart struct {
+	PartNumber int    `json:"part_number"`
+	URL        string `json:"url"`
+}
+
+func (s *Server) requireBlobStore(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.blobStore == nil {
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Attachment storage is not configured"})
+		}
+		return next(c)
+	}
+}
+
+// createAttachment registers an attachment and hands back presigned URLs so
+// the client uploads the bytes straight to the object store. Large files, or
+// any file when "multipart" is set, get one presigned URL per part.
+func (s *Server) createAttachment(c echo.Context) error {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	var req struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Size        int64  `json:"size"`
+		Multipart   bool   `json:"multipart"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	req.Filename = path.Base(req.Filename)
+	if req.Filename == "" || req.Filename == "." || req.Filename == "/" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Filename is required"})
+	}
+	if req.Size < 0 || req.Size > multipartPartSize*maxMultipartParts {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid size"})
+	}
+
+	count, err := s.taskCollection.CountDocuments(context.Background(), bson.M{"_id": taskID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if count == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+
+	att := &Attachment{
+		ID:          primitive.NewObjectID(),
+		TaskID:      taskID,
+		Filename:    req.Filename,
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		Status:      attachmentPending,
+		CreatedAt:   time.Now(),
+	}
+	att.Key = "tasks/" + string(taskID) + "/" + att.ID.Hex() + "/" + att.Filename
+	// Starting a multipart upload writes to the bucket and a presigned URL
+	// would let the client upload for real, so a dry run returns neither.
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, map[string]interface{}{"attachment": att})
+	}
+
+	resp := map[string]interface{}{
+		"attachment": att,
+		"expires_at": time.Now().Add(presignExpiry),
+	}
+	if req.Multipart || req.Size > multipartPartSize {
+		uploadID, err := s.blobStore.createMultipartUpload(context.Background(), att.Key, att.ContentType)
+		if err != nil {
+			return c.JSON(http.StatusBadGateway, map[string]string{"error": "Failed to start upload"})
+		}
+		att.UploadID = uploadID
+
+		partCount := int((req.Size + multipartPartSize - 1) / multipartPartSize)
+		if partCount == 0 {
+			partCount = 1
+		}
+		parts := make([]uploadPart, partCount)
+		for i := range parts {
+			parts[i] = uploadPart{PartNumber: i + 1, URL: s.blobStore.presignPart(att.Key, uploadID, i+1, presignExpiry)}
+		}
+		resp["part_size"] = multipartPartSize
+		resp["parts"] = parts
+	} else {
+		resp["upload_url"] = s.blobStore.presign(http.MethodPut, att.Key, nil, presignExpiry)
+	}
+
+	if _, err := s.attachmentCollection.InsertOne(context.Background(), att); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create attachment"})
+	}
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (s *Server) findAttachment(c echo.Context) (*Attachment, error) {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	attID, err := primitive.ObjectIDFromHex(c.Param("attachmentId"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid attachment ID"})
+	}
+
+	var att Attachment
+	err = s.attachmentCollection.FindOne(context.Background(), bson.M{"_id": attID, "task_id": taskID}).Decode(&att)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Attachment not found"})
+		}
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch attachment"})
+	}
+	return &att, nil
+}
+
+// completeAttachment is called by the client once the bytes are uploaded. For
+// multipart uploads it assembles the parts; either way it confirms the object
+// exists before marking the attachment as uploaded.
+func (s *Server) completeAttachment(c echo.Context) error {
+	att, err := s.findAttachment(c)
+	if att == nil {
+		return err
+	}
+	if att.Status == attachmentUploaded {
+		return c.JSON(http.StatusOK, att)
+	}
+
+	var req struct {
+		Parts []completedPart `json:"parts"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+
+	ctx := context.Background()
+	if att.UploadID != "" && len(req.Parts) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Parts are required for multipart uploads"})
+	}
+	// Multipart parts can only be checked by assembling them, which is a
+	// write, so a dry run only confirms single-request uploads exist.
+	if isDryRun(c) {
+		if att.UploadID == "" {
+			if att.Size, err = s.blobStore.objectSize(ctx, att.Key); err != nil {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Upload not found in storage"})
+			}
+		}
+		now := time.Now()
+		att.Status, att.UploadedAt, att.UploadID = attachmentUploaded, &now, ""
+		return c.JSON(http.StatusOK, att)
+	}
+	if att.UploadID != "" {
+		if err := s.blobStore.completeMultipartUpload(ctx, att.Key, att.UploadID, req.Parts); err != nil {
+			return c.JSON(http.StatusBadGateway, map[string]string{"error": "Failed to complete upload"})
+		}
+	}
+	size, err := s.blobStore.objectSize(ctx, att.Key)
+	if err != nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Upload not found in storage"})
+	}
+
+	now := time.Now()
+	att.Size = size
+	att.Status = attachmentUploaded
+	att.UploadedAt = &now
+	att.UploadID = ""
+	_, err = s.attachmentCollection.UpdateOne(ctx, bson.M{"_id": att.ID}, bson.M{
+		"$set":   bson.M{"size": size, "status": att.Status, "uploaded_at": now},
+		"$unset": bson.M{"upload_id": ""},
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update attachment"})
+	}
+
+	// Extraction downloads the object, so it runs after the response.
+	indexed, logger, workerCtx := *att, c.Logger(), s.workerContext()
+	s.goWorker(func() {
+		if err := s.indexAttachmentText(workerCtx, &indexed); err != nil {
+			logger.Errorf("Failed to index attachment %s: %v", indexed.ID.Hex(), err)
+		}
+	})
+	return c.JSON(http.StatusOK, att)
+}
+
+func (s *Server) getTaskAttachments(c echo.Context) error {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	cursor, err := s.attachmentCollection.Find(context.Background(), bson.M{"task_id": taskID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch attachments"})
+	}
+	attachments := []Attachment{}
+	if err := cursor.All(context.Background(), &attachments); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding attachment data"})
+	}
+	return c.JSON(http.StatusOK, attachments)
+}
+
+// downloadAttachment redirects to a short-lived presigned URL, so the file
+// bytes never pass through the API server.
+func (s *Server) downloadAttachment(c echo.Context) error {
+	att, err := s.findAttachment(c)
+	if att == nil {
+		return err
+	}
+	if att.Status != attachmentUploaded {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Attachment upload is not complete"})
+	}
+
+	q := url.Values{"response-content-disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename})}}
+	if att.ContentType != "" {
+		q.Set("response-content-type", att.ContentType)
+	}
+	return c.Redirect(http.StatusFound, s.blobStore.presign(http.MethodGet, att.Key, q, presignExpiry))
+}
+
+func (s *Server) deleteAttachment(c echo.Context) error {
+	att, err := s.findAttachment(c)
+	if att == nil {
+		return err
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Attachment deleted successfully"})
+	}
+	if err := s.removeAttachment(context.Background(), att); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete attachment"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Attachment deleted successfully"})
+}
+
+// removeAttachment deletes the stored object (or aborts its unfinished
+// multipart upload) and then the attachment record.
+func (s *Server) removeAttachment(ctx context.Context, att *Attachment) error {
+	if s.blobStore != nil {
+		var err error
+		if att.UploadID != "" {
+			err = s.blobStore.abortMultipartUpload(ctx, att.Key, att.UploadID)
+		} else {
+			err = s.blobStore.deleteObject(ctx, att.Key)
+		}
+		// The bucket's own lifecycle rules may have removed it already.
+		if err != nil && !isS3NotFound(err) {
+			return err
+		}
+	}
+	if _, err := s.attachmentCollection.DeleteOne(ctx, bson.M{"_id": att.ID}); err != nil {
+		return err
+	}
+	return s.removeSearchEntry(ctx, sourceAttachment, att.ID.Hex())
+}
+
+// deleteTaskAttachments removes every attachment of a deleted task.
+func (s *Server) deleteTaskAttachments(ctx context.Context, taskID TaskID) error {
+	return s.removeAttachments(ctx, bson.M{"task_id": taskID})
+}
+
+func (s *Server) removeAttachments(ctx context.Context, filter bson.M) error {
+	cursor, err := s.attachmentCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var attachments []Attachment
+	if err := cursor.All(ctx, &attachments); err != nil {
+		return err
+	}
+	// One attachment failing does not stop the others from being removed.
+	var errs []error
+	for i := range attachments {
+		if err := s.removeAttachment(ctx, &attachments[i]); err != nil {
+			s.logger.Errorf("Failed to remove attachment %s: %v", attachments[i].ID.Hex(), err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// startAttachmentCleanupLoop periodically drops uploads that were started
+// but never completed.
+func (s *Server) startAttachmentCleanupLoop(ctx context.Context) {
+	s.goWorker(func() {
+		for {
+			cutoff := time.Now().Add(-pendingUploadMaxAge)
+			err := s.removeAttachments(ctx, bson.M{
+				"status":     attachmentPending,
+				"created_at": bson.M{"$lt": cutoff},
+			})
+			if err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Failed to clean up abandoned uploads: %v", err)
+			}
+			if !sleep(ctx, time.Hour) {
+				return
+			}
+		}
+	})
+}
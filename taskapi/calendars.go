@@ -0,0 +1,577 @@
+package taskapi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const dateLayout = "2006-01-02"
+
+// Calendar describes when a project or team works. Due dates, lags and
+// durations computed against a calendar skip non-working days and holidays.
+type Calendar struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Project   string             `bson:"project,omitempty" json:"project,omitempty"`
+	Team      string             `bson:"team,omitempty" json:"team,omitempty"`
+	Timezone  string             `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Weekdays  []time.Weekday     `bson:"weekdays" json:"weekdays"`
+	WorkStart string             `bson:"work_start" json:"work_start"`
+	WorkEnd   string             `bson:"work_end" json:"work_end"`
+	Holidays  []Holiday          `bson:"holidays,omitempty" json:"holidays,omitempty"`
+	// SLAHours is the working time tasks of the project or team have to be
+	// closed in. Zero means no SLA.
+	SLAHours  float64   `bson:"sla_hours,omitempty" json:"sla_hours,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type Holiday struct {
+	Date string `bson:"date" json:"date"`
+	Name string `bson:"name,omitempty" json:"name,omitempty"`
+}
+
+// defaultCalendar is used when neither the task's project nor its team has a
+// calendar of its own.
+var defaultCalendar = Calendar{
+	Name:      "default",
+	Weekdays:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	WorkStart: "09:00",
+	WorkEnd:   "17:00",
+}
+
+func (cal *Calendar) validate() error {
+	if cal.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if cal.Timezone != "" {
+		if _, err := time.LoadLocation(cal.Timezone); err != nil {
+			return fmt.Errorf("Invalid timezone")
+		}
+	}
+	if len(cal.Weekdays) == 0 {
+		cal.Weekdays = defaultCalendar.Weekdays
+	}
+	for _, d := range cal.Weekdays {
+		if d < time.Sunday || d > time.Saturday {
+			return fmt.Errorf("Invalid weekday")
+		}
+	}
+	if cal.WorkStart == "" {
+		cal.WorkStart = defaultCalendar.WorkStart
+	}
+	if cal.WorkEnd == "" {
+		cal.WorkEnd = defaultCalendar.WorkEnd
+	}
+	start, err1 := parseClock(cal.WorkStart)
+	end, err2 := parseClock(cal.WorkEnd)
+	if err1 != nil || err2 != nil || end <= start {
+		return fmt.Errorf("Invalid working hours")
+	}
+	for _, h := range cal.Holidays {
+		if _, err := time.Parse(dateLayout, h.Date); err != nil {
+			return fmt.Errorf("Invalid holiday date %q", h.Date)
+		}
+	}
+	if cal.SLAHours < 0 {
+		return fmt.Errorf("sla_hours must not be negative")
+	}
+	return nil
+}
+
+// ensureCalendarIndexes makes sure a project, and a team, has at most one
+// calendar, so calendarFor is unambiguous.
+func (s *Server) ensureCalendarIndexes(ctx context.Context) error {
+	_, err := s.calendarCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "project", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"project": bson.M{"$type": "string"}}),
+		},
+		{
+			Keys: bson.D{{Key: "team", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"team": bson.M{"$type": "string"}}),
+		},
+	})
+	return err
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (cal *Calendar) location() *time.Location {
+	if cal.Timezone != "" {
+		if loc, err := time.LoadLocation(cal.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+func (cal *Calendar) isWorkingDay(t time.Time) bool {
+	t = t.In(cal.location())
+	working := false
+	for _, d := range cal.Weekdays {
+		if t.Weekday() == d {
+			working = true
+			break
+		}
+	}
+	if !working {
+		return false
+	}
+	date := t.Format(dateLayout)
+	for _, h := range cal.Holidays {
+		if h.Date == date {
+			return false
+		}
+	}
+	return true
+}
+
+// AddWorkingDays moves t forward by n working days, keeping the time of day.
+// With n == 0 a non-working t is moved to the next working day.
+func (cal *Calendar) AddWorkingDays(t time.Time, n int) time.Time {
+	t = t.In(cal.location())
+	for !cal.isWorkingDay(t) {
+		t = t.AddDate(0, 0, 1)
+	}
+	for n > 0 {
+		t = t.AddDate(0, 0, 1)
+		if cal.isWorkingDay(t) {
+			n--
+		}
+	}
+	return t
+}
+
+// EndOfWorkingDay returns the end of working hours on t's date.
+func (cal *Calendar) EndOfWorkingDay(t time.Time) time.Time {
+	t = t.In(cal.location())
+	end, _ := parseClock(cal.WorkEnd)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return midnight.Add(end)
+}
+
+// WorkingDuration returns the working time between from and to, counting
+// only working hours on working days.
+func (cal *Calendar) WorkingDuration(from, to time.Time) time.Duration {
+	if !to.After(from) {
+		return 0
+	}
+	loc := cal.location()
+	from, to = from.In(loc), to.In(loc)
+	start, _ := parseClock(cal.WorkStart)
+	end, _ := parseClock(cal.WorkEnd)
+
+	var total time.Duration
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	for day.Before(to) {
+		if cal.isWorkingDay(day) {
+			winStart, winEnd := day.Add(start), day.Add(end)
+			if from.After(winStart) {
+				winStart = from
+			}
+			if to.Before(winEnd) {
+				winEnd = to
+			}
+			if winEnd.After(winStart) {
+				total += winEnd.Sub(winStart)
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return total
+}
+
+// AddWorkingTime moves t by d of working time, counting only working hours
+// on working days; a negative d moves it back. A t outside working hours
+// first moves to the nearest working time in that direction.
+func (cal *Calendar) AddWorkingTime(t time.Time, d time.Duration) time.Time {
+	loc := cal.location()
+	t = t.In(loc)
+	start, _ := parseClock(cal.WorkStart)
+	end, _ := parseClock(cal.WorkEnd)
+
+	for {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		if cal.isWorkingDay(day) {
+			winStart, winEnd := day.Add(start), day.Add(end)
+			if d >= 0 {
+				if t.Before(winStart) {
+					t = winStart
+				}
+				if t.Before(winEnd) {
+					left := winEnd.Sub(t)
+					if d <= left {
+						return t.Add(d)
+					}
+					d -= left
+				}
+			} else {
+				if t.After(winEnd) {
+					t = winEnd
+				}
+				if t.After(winStart) {
+					left := t.Sub(winStart)
+					if -d <= left {
+						return t.Add(d)
+					}
+					d += left
+				}
+			}
+		}
+		if d >= 0 {
+			t = day.AddDate(0, 0, 1)
+		} else {
+			t = day.Add(-time.Nanosecond)
+		}
+	}
+}
+
+// calendarFor returns the calendar of the project, falling back to the team
+// calendar and then the default one.
+func (s *Server) calendarFor(ctx context.Context, project, team string) (*Calendar, error) {
+	var filters []bson.M
+	if project != "" {
+		filters = append(filters, bson.M{"project": project})
+	}
+	if team != "" {
+		filters = append(filters, bson.M{"team": team})
+	}
+	for _, filter := range filters {
+		var cal Calendar
+		err := s.calendarCollection.FindOne(ctx, filter).Decode(&cal)
+		if err == nil {
+			return &cal, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+	}
+	cal := defaultCalendar
+	return &cal, nil
+}
+
+// parseICSHolidays reads all-day and timed VEVENTs from an iCalendar feed
+// and returns one holiday per covered date.
+func parseICSHolidays(r io.Reader) ([]Holiday, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var holidays []Holiday
+	var inEvent bool
+	var summary string
+	var start, end time.Time
+	var endTime string
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		prop, _, _ := strings.Cut(name, ";")
+		switch strings.ToUpper(prop) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				inEvent, summary, start, end, endTime = true, "", time.Time{}, time.Time{}, ""
+			}
+		case "SUMMARY":
+			summary = strings.ReplaceAll(value, `\,`, ",")
+		case "DTSTART":
+			start = parseICSDate(value)
+		case "DTEND":
+			end = parseICSDate(value)
+			_, endTime, _ = strings.Cut(value, "T")
+		case "END":
+			if !inEvent || !strings.EqualFold(value, "VEVENT") {
+				continue
+			}
+			inEvent = false
+			if start.IsZero() {
+				return nil, fmt.Errorf("event %q has no valid DTSTART", summary)
+			}
+			// DTEND is exclusive for all-day events. A timed event that ends
+			// after midnight also takes up its last day.
+			if !end.IsZero() && strings.Trim(strings.TrimSuffix(endTime, "Z"), "0") != "" {
+				end = end.AddDate(0, 0, 1)
+			}
+			if !end.After(start) {
+				end = start.AddDate(0, 0, 1)
+			}
+			for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+				holidays = append(holidays, Holiday{Date: d.Format(dateLayout), Name: summary})
+			}
+		}
+	}
+	return holidays, nil
+}
+
+func parseICSDate(v string) time.Time {
+	if len(v) < 8 {
+		return time.Time{}
+	}
+	t, err := time.Parse("20060102", v[:8])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func mergeHolidays(existing, added []Holiday) []Holiday {
+	byDate := map[string]Holiday{}
+	for _, h := range existing {
+		byDate[h.Date] = h
+	}
+	for _, h := range added {
+		if _, ok := byDate[h.Date]; !ok {
+			byDate[h.Date] = h
+		}
+	}
+	out := make([]Holiday, 0, len(byDate))
+	for _, h := range byDate {
+		out = append(out, h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Date < out[j].Date })
+	return out
+}
+
+func (s *Server) createCalendar(c echo.Context) error {
+	cal := new(Calendar)
+	if err := c.Bind(cal); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if err := cal.validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	cal.ID = primitive.NewObjectID()
+	cal.Holidays = mergeHolidays(nil, cal.Holidays)
+	cal.CreatedAt = time.Now()
+	cal.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, cal)
+	}
+
+	if _, err := s.calendarCollection.InsertOne(context.Background(), cal); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "The project or team already has a calendar"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create calendar"})
+	}
+	return c.JSON(http.StatusCreated, cal)
+}
+
+func (s *Server) getAllCalendars(c echo.Context) error {
+	cursor, err := s.calendarCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch calendars"})
+	}
+	calendars := []Calendar{}
+	if err := cursor.All(context.Background(), &calendars); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding calendar data"})
+	}
+	return c.JSON(http.StatusOK, calendars)
+}
+
+func (s *Server) findCalendar(c echo.Context) (*Calendar, error) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var cal Calendar
+	err = s.calendarCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&cal)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Calendar not found"})
+		}
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch calendar"})
+	}
+	return &cal, nil
+}
+
+func (s *Server) getCalendarByID(c echo.Context) error {
+	cal, err := s.findCalendar(c)
+	if cal == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, cal)
+}
+
+func (s *Server) updateCalendar(c echo.Context) error {
+	cal, err := s.findCalendar(c)
+	if cal == nil {
+		return err
+	}
+
+	update := new(Calendar)
+	if err := c.Bind(update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if err := update.validate(); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	update.ID = cal.ID
+	update.Holidays = mergeHolidays(nil, update.Holidays)
+	update.CreatedAt = cal.CreatedAt
+	update.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, update)
+	}
+	if _, err := s.calendarCollection.ReplaceOne(context.Background(), bson.M{"_id": cal.ID}, update); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "The project or team already has a calendar"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update calendar"})
+	}
+	return c.JSON(http.StatusOK, update)
+}
+
+func (s *Server) deleteCalendar(c echo.Context) error {
+	cal, err := s.findCalendar(c)
+	if cal == nil {
+		return err
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Calendar deleted successfully"})
+	}
+	if _, err := s.calendarCollection.DeleteOne(context.Background(), bson.M{"_id": cal.ID}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete calendar"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Calendar deleted successfully"})
+}
+
+// importCalendarHolidays merges the events of an ICS feed posted as the
+// request body into the calendar's holidays.
+func (s *Server) importCalendarHolidays(c echo.Context) error {
+	cal, err := s.findCalendar(c)
+	if cal == nil {
+		return err
+	}
+
+	holidays, err := parseICSHolidays(io.LimitReader(c.Request().Body, 1<<20))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ICS data"})
+	}
+	cal.Holidays = mergeHolidays(cal.Holidays, holidays)
+	cal.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, cal)
+	}
+
+	_, err = s.calendarCollection.UpdateOne(context.Background(), bson.M{"_id": cal.ID}, bson.M{
+		"$set": bson.M{"holidays": cal.Holidays, "updated_at": cal.UpdatedAt},
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update calendar"})
+	}
+	return c.JSON(http.StatusOK, cal)
+}
+
+// getCalendarDuration reports the working time between two instants.
+func (s *Server) getCalendarDuration(c echo.Context) error {
+	cal, err := s.findCalendar(c)
+	if cal == nil {
+		return err
+	}
+
+	from, err1 := time.Parse(time.RFC3339, c.QueryParam("from"))
+	to, err2 := time.Parse(time.RFC3339, c.QueryParam("to"))
+	if err1 != nil || err2 != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "from and to must be RFC3339 timestamps"})
+	}
+
+	d := cal.WorkingDuration(from, to)
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"working_seconds": int64(d.Seconds()),
+		"working_hours":   d.Hours(),
+	})
+}
+
+// getTaskSLA reports the SLA timer of a task: the working time it has used
+// of its calendar's SLA, and when the SLA runs out. The timer stops when the
+// task is closed.
+func (s *Server) getTaskSLA(c echo.Context) error {
+	id, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	ctx := context.Background()
+
+	var task Task
+	err = s.taskCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&task)
+	if err == mongo.ErrNoDocuments {
+		archived, aerr := s.archivedTask(id)
+		if aerr != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read archived task"})
+		}
+		if archived == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+		}
+		task, err = *archived, nil
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+
+	cal, err := s.calendarFor(ctx, task.Project, task.Team)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load working calendar"})
+	}
+	if cal.SLAHours == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No SLA applies to this task"})
+	}
+	ws, err := s.loadWorkflows(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflows"})
+	}
+
+	sla := time.Duration(cal.SLAHours * float64(time.Hour))
+	stop := time.Now()
+	closed := ws.isClosed(&task)
+	if closed {
+		periods := task.statusPeriods()
+		stop = periods[len(periods)-1].EnteredAt
+	}
+	elapsed := cal.WorkingDuration(task.CreatedAt, stop)
+	remaining := sla - elapsed
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"task_id":                 task.ID,
+		"calendar":                cal.Name,
+		"sla_hours":               cal.SLAHours,
+		"due_at":                  cal.AddWorkingTime(task.CreatedAt, sla),
+		"elapsed_working_hours":   elapsed.Hours(),
+		"remaining_working_hours": remaining.Hours(),
+		"breached":                remaining < 0,
+		"stopped":                 closed,
+	})
+}
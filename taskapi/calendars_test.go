@@ -0,0 +1,231 @@
+package taskapi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCalendar works Monday to Friday, 09:00 to 17:00 in Berlin, with
+// Wednesday 2024-05-01 off.
+func testCalendar(t *testing.T) *Calendar {
+	t.Helper()
+	cal := &Calendar{
+		Name:     "test",
+		Timezone: "Europe/Berlin",
+		Holidays: []Holiday{{Date: "2024-05-01", Name: "Labour Day"}},
+	}
+	if err := cal.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cal
+}
+
+func berlin(t *testing.T, value string) time.Time {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+	v, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCalendarValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cal     Calendar
+		wantErr string
+	}{
+		{"defaults", Calendar{Name: "c"}, ""},
+		{"no name", Calendar{}, "Name is required"},
+		{"bad zone", Calendar{Name: "c", Timezone: "Mars/Olympus"}, "Invalid timezone"},
+		{"bad weekday", Calendar{Name: "c", Weekdays: []time.Weekday{7}}, "Invalid weekday"},
+		{"end before start", Calendar{Name: "c", WorkStart: "17:00", WorkEnd: "09:00"}, "Invalid working hours"},
+		{"bad holiday", Calendar{Name: "c", Holidays: []Holiday{{Date: "1 May"}}}, "Invalid holiday date"},
+		{"negative sla", Calendar{Name: "c", SLAHours: -1}, "sla_hours must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cal.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v", err)
+				}
+				if len(tt.cal.Weekdays) != 5 || tt.cal.WorkStart != "09:00" || tt.cal.WorkEnd != "17:00" {
+					t.Errorf("defaults not applied: %+v", tt.cal)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddWorkingDays(t *testing.T) {
+	cal := testCalendar(t)
+	tests := []struct {
+		from string
+		n    int
+		want string
+	}{
+		{"2024-04-29 10:00", 0, "2024-04-29 10:00"},
+		{"2024-04-29 10:00", 1, "2024-04-30 10:00"},
+		// The holiday is skipped.
+		{"2024-04-30 10:00", 1, "2024-05-02 10:00"},
+		{"2024-05-01 10:00", 0, "2024-05-02 10:00"},
+		// Weekends are skipped.
+		{"2024-05-03 10:00", 1, "2024-05-06 10:00"},
+		{"2024-05-04 10:00", 0, "2024-05-06 10:00"},
+		{"2024-04-29 10:00", 5, "2024-05-07 10:00"},
+	}
+	for _, tt := range tests {
+		if got := cal.AddWorkingDays(berlin(t, tt.from), tt.n); !got.Equal(berlin(t, tt.want)) {
+			t.Errorf("AddWorkingDays(%s, %d) = %s, want %s", tt.from, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestEndOfWorkingDay(t *testing.T) {
+	cal := testCalendar(t)
+	// 23:30 UTC is already the next day in Berlin.
+	from := time.Date(2024, 4, 29, 23, 30, 0, 0, time.UTC)
+	if got, want := cal.EndOfWorkingDay(from), berlin(t, "2024-04-30 17:00"); !got.Equal(want) {
+		t.Errorf("EndOfWorkingDay = %s, want %s", got, want)
+	}
+}
+
+func TestWorkingDuration(t *testing.T) {
+	cal := testCalendar(t)
+	tests := []struct {
+		from, to string
+		want     time.Duration
+	}{
+		{"2024-04-29 10:00", "2024-04-29 12:30", 150 * time.Minute},
+		{"2024-04-29 07:00", "2024-04-29 20:00", 8 * time.Hour},
+		{"2024-04-29 16:00", "2024-04-30 10:00", 2 * time.Hour},
+		// Over the holiday and a weekend.
+		{"2024-04-30 12:00", "2024-05-06 12:00", 5*time.Hour + 8*time.Hour + 8*time.Hour + 3*time.Hour},
+		{"2024-05-04 09:00", "2024-05-05 17:00", 0},
+		{"2024-04-29 12:00", "2024-04-29 10:00", 0},
+	}
+	for _, tt := range tests {
+		if got := cal.WorkingDuration(berlin(t, tt.from), berlin(t, tt.to)); got != tt.want {
+			t.Errorf("WorkingDuration(%s, %s) = %s, want %s", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestAddWorkingTime(t *testing.T) {
+	cal := testCalendar(t)
+	tests := []struct {
+		from string
+		d    time.Duration
+		want string
+	}{
+		{"2024-04-29 10:00", 2 * time.Hour, "2024-04-29 12:00"},
+		{"2024-04-29 10:00", 7 * time.Hour, "2024-04-29 17:00"},
+		{"2024-04-29 10:00", 8 * time.Hour, "2024-04-30 10:00"},
+		// Before and after hours start from the next working time.
+		{"2024-04-29 06:00", time.Hour, "2024-04-29 10:00"},
+		{"2024-04-29 18:00", time.Hour, "2024-04-30 10:00"},
+		// Over the holiday and the weekend.
+		{"2024-04-30 16:00", 2 * time.Hour, "2024-05-02 10:00"},
+		{"2024-05-03 16:00", 2 * time.Hour, "2024-05-06 10:00"},
+		{"2024-05-04 12:00", 0, "2024-05-06 09:00"},
+		// Backwards.
+		{"2024-04-29 12:00", -2 * time.Hour, "2024-04-29 10:00"},
+		{"2024-05-02 10:00", -2 * time.Hour, "2024-04-30 16:00"},
+		{"2024-05-06 10:00", -2 * time.Hour, "2024-05-03 16:00"},
+		{"2024-05-06 08:00", -time.Hour, "2024-05-03 16:00"},
+		{"2024-04-29 20:00", -8 * time.Hour, "2024-04-29 09:00"},
+	}
+	for _, tt := range tests {
+		if got := cal.AddWorkingTime(berlin(t, tt.from), tt.d); !got.Equal(berlin(t, tt.want)) {
+			t.Errorf("AddWorkingTime(%s, %s) = %s, want %s", tt.from, tt.d, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+
+	// Adding working time and measuring it again agree.
+	from := berlin(t, "2024-04-26 15:20")
+	for _, d := range []time.Duration{0, time.Minute, 3 * time.Hour, 17 * time.Hour, 40 * time.Hour} {
+		if got := cal.WorkingDuration(from, cal.AddWorkingTime(from, d)); got != d {
+			t.Errorf("WorkingDuration after AddWorkingTime(%s) = %s", d, got)
+		}
+	}
+}
+
+func TestParseICSHolidays(t *testing.T) {
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"SUMMARY:New Year",
+		"DTSTART;VALUE=DATE:20240101",
+		"DTEND;VALUE=DATE:20240102",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:Christmas\\, long",
+		"DTSTART;VALUE=DATE:20241224",
+		"DTEND;VALUE=DATE:20241227",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:Offsite",
+		"DTSTART:20240610T090000",
+		"DTEND:20240610T170000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:Migration",
+		"DTSTART:20240614T220000Z",
+		"DTEND:20240615T020000Z",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:Night shift",
+		"DTSTART:20240620T200000",
+		"DTEND:20240621T000000",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:Folded",
+		" line",
+		"DTSTART;VALUE=DATE:20240701",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	got, err := parseICSHolidays(strings.NewReader(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Holiday{
+		{Date: "2024-01-01", Name: "New Year"},
+		{Date: "2024-12-24", Name: "Christmas, long"},
+		{Date: "2024-12-25", Name: "Christmas, long"},
+		{Date: "2024-12-26", Name: "Christmas, long"},
+		{Date: "2024-06-10", Name: "Offsite"},
+		{Date: "2024-06-14", Name: "Migration"},
+		{Date: "2024-06-15", Name: "Migration"},
+		{Date: "2024-06-20", Name: "Night shift"},
+		{Date: "2024-07-01", Name: "Foldedline"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseICSHolidays =\n%v\nwant\n%v", got, want)
+	}
+
+	if _, err := parseICSHolidays(strings.NewReader("BEGIN:VEVENT\nSUMMARY:x\nEND:VEVENT\n")); err == nil {
+		t.Error("event without DTSTART accepted")
+	}
+}
+
+func TestMergeHolidays(t *testing.T) {
+	existing := []Holiday{{Date: "2024-05-01", Name: "Ours"}}
+	added := []Holiday{{Date: "2024-01-01", Name: "New Year"}, {Date: "2024-05-01", Name: "Theirs"}}
+	want := []Holiday{{Date: "2024-01-01", Name: "New Year"}, {Date: "2024-05-01", Name: "Ours"}}
+	if got := mergeHolidays(existing, added); !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeHolidays = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,159 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Comment struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TaskID    TaskID             `bson:"task_id" json:"task_id"`
+	Author    string             `bson:"author,omitempty" json:"author,omitempty"`
+	Body      string             `bson:"body" json:"body"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+func (s *Server) createComment(c echo.Context) error {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	comment := new(Comment)
+	if err := c.Bind(comment); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if comment.Body == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Body is required"})
+	}
+
+	count, err := s.taskCollection.CountDocuments(context.Background(), bson.M{"_id": taskID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if count == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+
+	comment.ID = primitive.NewObjectID()
+	comment.TaskID = taskID
+	comment.CreatedAt = time.Now()
+	comment.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, comment)
+	}
+
+	if _, err := s.commentCollection.InsertOne(context.Background(), comment); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create comment"})
+	}
+	if err := s.indexSearchEntry(context.Background(), sourceComment, comment.ID.Hex(), taskID, comment.Body); err != nil {
+		c.Logger().Errorf("Failed to index comment %s: %v", comment.ID.Hex(), err)
+	}
+	return c.JSON(http.StatusCreated, comment)
+}
+
+func (s *Server) getTaskComments(c echo.Context) error {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	cursor, err := s.commentCollection.Find(context.Background(), bson.M{"task_id": taskID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch comments"})
+	}
+	comments := []Comment{}
+	if err := cursor.All(context.Background(), &comments); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding comment data"})
+	}
+	return c.JSON(http.StatusOK, comments)
+}
+
+func (s *Server) commentFilter(c echo.Context) (bson.M, error) {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	commentID, err := primitive.ObjectIDFromHex(c.Param("commentId"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid comment ID"})
+	}
+	return bson.M{"_id": commentID, "task_id": taskID}, nil
+}
+
+func (s *Server) updateComment(c echo.Context) error {
+	filter, err := s.commentFilter(c)
+	if filter == nil {
+		return err
+	}
+
+	update := new(Comment)
+	if err := c.Bind(update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if update.Body == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Body is required"})
+	}
+	if isDryRun(c) {
+		return s.dryRunComment(c, filter, "Comment updated successfully")
+	}
+
+	result, err := s.commentCollection.UpdateOne(context.Background(), filter, bson.M{
+		"$set": bson.M{"body": update.Body, "updated_at": time.Now()},
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update comment"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Comment not found"})
+	}
+
+	commentID, taskID := filter["_id"].(primitive.ObjectID), filter["task_id"].(TaskID)
+	if err := s.indexSearchEntry(context.Background(), sourceComment, commentID.Hex(), taskID, update.Body); err != nil {
+		c.Logger().Errorf("Failed to index comment %s: %v", commentID.Hex(), err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Comment updated successfully"})
+}
+
+func (s *Server) deleteComment(c echo.Context) error {
+	filter, err := s.commentFilter(c)
+	if filter == nil {
+		return err
+	}
+	if isDryRun(c) {
+		return s.dryRunComment(c, filter, "Comment deleted successfully")
+	}
+
+	result, err := s.commentCollection.DeleteOne(context.Background(), filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete comment"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Comment not found"})
+	}
+
+	commentID := filter["_id"].(primitive.ObjectID)
+	if err := s.removeSearchEntry(context.Background(), sourceComment, commentID.Hex()); err != nil {
+		c.Logger().Errorf("Failed to unindex comment %s: %v", commentID.Hex(), err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Comment deleted successfully"})
+}
+
+// dryRunComment answers a dry-run update or delete of the comment matching
+// filter with the message the real request would return.
+func (s *Server) dryRunComment(c echo.Context, filter bson.M, message string) error {
+	count, err := s.commentCollection.CountDocuments(context.Background(), filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch comment"})
+	}
+	if count == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Comment not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": message})
+}
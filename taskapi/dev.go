@@ -0,0 +1,364 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// demoPassword is the password of every seeded user.
+const demoPassword = "demo-password"
+
+// maxMockDelay caps the latency a request can ask for in dev mode.
+const maxMockDelay = 30 * time.Second
+
+// DemoUser is a seeded account with its credentials in the clear.
+type DemoUser struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	APIKey   string   `json:"api_key"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+// DemoData describes what SeedDemoData created.
+type DemoData struct {
+	Users    []DemoUser `json:"users"`
+	Projects []string   `json:"projects"`
+	Tasks    int        `json:"tasks"`
+	Comments int        `json:"comments"`
+}
+
+type devState struct {
+	reset bool
+
+	mu   sync.Mutex
+	demo *DemoData
+}
+
+// WithDevMode enables the /dev routes, which list the demo credentials and,
+// with reset, reset the database to the demo data by dropping it, and lets
+// requests ask for a delay or a canned error status with ?mock_delay= (or
+// X-Mock-Delay) and ?mock_status= (or X-Mock-Status). Never use it against
+// real data.
+func WithDevMode(reset bool) Option {
+	return func(s *Server) error {
+		s.dev = &devState{reset: reset}
+		return nil
+	}
+}
+
+type demoComment struct {
+	author, body string
+}
+
+type demoTask struct {
+	project, title, description string
+	assignee, priority          string
+	tags                        []string
+	// path is the statuses the task went through, ending with the current
+	// one, spread evenly over its age.
+	path     []string
+	age      time.Duration
+	due      time.Duration
+	comments []demoComment
+}
+
+var demoUsers = []DemoUser{
+	{Username: "admin", Roles: []string{RoleAdmin}},
+	{Username: "alice"},
+	{Username: "bob"},
+	{Username: "carol"},
+}
+
+var demoWorkflows = []Workflow{
+	{
+		Project: "web",
+		Statuses: []WorkflowStatus{
+			{Name: "Triage", Category: categoryTodo},
+			{Name: "Confirmed", Category: categoryTodo},
+			{Name: "Fixing", Category: categoryInProgress},
+			{Name: "In Review", Category: categoryInProgress},
+			{Name: "Verified", Category: categoryDone},
+			{Name: "Won't Fix", Category: categoryDone},
+		},
+		Transitions: []WorkflowTransition{
+			{From: "Triage", To: []string{"Confirmed", "Won't Fix"}},
+			{From: "Confirmed", To: []string{"Fixing", "Won't Fix"}},
+			{From: "Fixing", To: []string{"In Review", "Confirmed"}},
+			{From: "In Review", To: []string{"Verified", "Fixing"}},
+			{From: "Verified", To: []string{"Fixing"}},
+			{From: "Won't Fix", To: []string{"Triage"}},
+		},
+	},
+	{
+		Project: "ops",
+		Statuses: []WorkflowStatus{
+			{Name: "Backlog", Category: categoryTodo},
+			{Name: "In Progress", Category: categoryInProgress},
+			{Name: "Blocked", Category: categoryInProgress},
+			{Name: "Done", Category: categoryDone},
+		},
+	},
+}
+
+const demoDay = 24 * time.Hour
+
+var demoTasks = []demoTask{
+	{
+		project: "web", title: "Checkout button unresponsive on Safari",
+		description: "Clicking \"Pay now\" does nothing on Safari 17. No console errors.",
+		assignee:    "alice", priority: "high", tags: []string{"bug", "checkout"},
+		path: []string{"Triage", "Confirmed", "Fixing"}, age: 6 * demoDay, due: 2 * demoDay,
+		comments: []demoComment{
+			{"bob", "Reproduced on macOS 14 with Safari 17.2."},
+			{"alice", "The click handler is attached before the button is rendered. Fix incoming."},
+		},
+	},
+	{
+		project: "web", title: "Password reset email has broken link",
+		description: "The link in the reset email points to the staging host.",
+		assignee:    "bob", priority: "urgent", tags: []string{"bug", "auth"},
+		path: []string{"Triage", "Confirmed", "Fixing", "In Review"}, age: 4 * demoDay, due: demoDay,
+		comments: []demoComment{{"carol", "Customers are writing in about this, please prioritise."}},
+	},
+	{
+		project: "web", title: "Dark mode colours unreadable in tables",
+		assignee: "alice", priority: "low", tags: []string{"ui"},
+		path: []string{"Triage"}, age: 2 * demoDay,
+	},
+	{
+		project: "web", title: "Search results paginate twice",
+		description: "Page 2 repeats the last five results of page 1.",
+		assignee:    "bob", priority: "medium", tags: []string{"bug", "search"},
+		path: []string{"Triage", "Confirmed", "Fixing", "In Review", "Verified"}, age: 12 * demoDay,
+		comments: []demoComment{
+			{"bob", "Off-by-one in the offset calculation."},
+			{"alice", "Verified on production."},
+		},
+	},
+	{
+		project: "web", title: "Support IE 11",
+		assignee: "carol", priority: "low",
+		path: []string{"Triage", "Won't Fix"}, age: 20 * demoDay,
+		comments: []demoComment{{"admin", "IE 11 is out of support; closing."}},
+	},
+	{
+		project: "ops", title: "Rotate database credentials",
+		description: "Quarterly rotation of the production MongoDB users.",
+		assignee:    "carol", priority: "high", tags: []string{"security"},
+		path: []string{"Backlog", "In Progress"}, age: 3 * demoDay, due: 4 * demoDay,
+	},
+	{
+		project: "ops", title: "Upgrade load balancer certificates",
+		assignee: "carol", priority: "urgent", tags: []string{"security", "tls"},
+		path: []string{"Backlog", "In Progress", "Blocked"}, age: 8 * demoDay, due: -demoDay,
+		comments: []demoComment{{"carol", "Waiting for the CA to approve the new CSR."}},
+	},
+	{
+		project: "ops", title: "Set up log retention policy",
+		assignee: "bob", priority: "medium", tags: []string{"logging"},
+		path: []string{"Backlog"}, age: 10 * demoDay, due: 14 * demoDay,
+	},
+	{
+		project: "ops", title: "Migrate CI runners to new cluster",
+		assignee: "alice", priority: "medium", tags: []string{"ci"},
+		path: []string{"Backlog", "In Progress", "Done"}, age: 15 * demoDay,
+		comments: []demoComment{{"alice", "All pipelines green on the new runners."}},
+	},
+	{
+		project: "mobile", title: "Push notifications arrive twice",
+		description: "Android devices receive every reminder notification twice.",
+		assignee:    "bob", priority: "high", tags: []string{"bug", "android"},
+		path: []string{"Pending", "In Progress"}, age: 5 * demoDay, due: 3 * demoDay,
+	},
+	{
+		project: "mobile", title: "Add biometric login",
+		assignee: "alice", priority: "medium", tags: []string{"feature"},
+		path: []string{"Pending"}, age: demoDay, due: 21 * demoDay,
+	},
+	{
+		project: "mobile", title: "Release 2.3 to the app stores",
+		assignee: "carol", priority: "medium", tags: []string{"release"},
+		path: []string{"Pending", "In Progress", "Completed"}, age: 9 * demoDay,
+		comments: []demoComment{{"carol", "Approved by both stores."}},
+	},
+}
+
+// SeedDemoData fills the database with demo users, workflows, tasks and
+// comments, and returns the users' credentials. It expects an empty
+// database.
+func (s *Server) SeedDemoData(ctx context.Context) (*DemoData, error) {
+	demo := &DemoData{}
+	for _, du := range demoUsers {
+		if _, err := s.users.Create(ctx, du.Username, du.Username+"@example.com", demoPassword, du.Roles); err != nil {
+			return nil, err
+		}
+		key, _, err := s.users.CreateAPIKey(ctx, du.Username, "demo")
+		if err != nil {
+			return nil, err
+		}
+		du.Password, du.APIKey = demoPassword, key
+		demo.Users = append(demo.Users, du)
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	for _, wf := range demoWorkflows {
+		wf.ID = primitive.NewObjectID()
+		wf.InitialStatus = wf.Statuses[0].Name
+		wf.CreatedAt, wf.UpdatedAt = now, now
+		if _, err := s.workflowCollection.InsertOne(ctx, wf); err != nil {
+			return nil, err
+		}
+	}
+
+	projects := map[string]bool{}
+	for _, dt := range demoTasks {
+		task := dt.task(s.newTaskID(), now)
+		if _, err := s.taskCollection.InsertOne(ctx, task); err != nil {
+			return nil, err
+		}
+		if err := s.indexTask(ctx, task); err != nil {
+			return nil, err
+		}
+		for i, dc := range dt.comments {
+			at := task.CreatedAt.Add(time.Duration(i+1) * now.Sub(task.CreatedAt) / time.Duration(len(dt.comments)+1))
+			comment := Comment{
+				ID:        primitive.NewObjectID(),
+				TaskID:    task.ID,
+				Author:    dc.author,
+				Body:      dc.body,
+				CreatedAt: at,
+				UpdatedAt: at,
+			}
+			if _, err := s.commentCollection.InsertOne(ctx, comment); err != nil {
+				return nil, err
+			}
+			demo.Comments++
+		}
+		if !projects[dt.project] {
+			projects[dt.project] = true
+			demo.Projects = append(demo.Projects, dt.project)
+		}
+		demo.Tasks++
+	}
+
+	if s.dev != nil {
+		s.dev.mu.Lock()
+		s.dev.demo = demo
+		s.dev.mu.Unlock()
+	}
+	return demo, nil
+}
+
+// task builds the seeded task, with its status history spread over its age.
+func (dt *demoTask) task(id TaskID, now time.Time) *Task {
+	created := now.Add(-dt.age)
+	step := dt.age / time.Duration(len(dt.path))
+	task := &Task{
+		ID:          id,
+		Title:       dt.title,
+		Description: dt.description,
+		Status:      dt.path[len(dt.path)-1],
+		Project:     dt.project,
+		Assignee:    dt.assignee,
+		Priority:    dt.priority,
+		Tags:        dt.tags,
+		CreatedAt:   created,
+	}
+	for i, status := range dt.path {
+		entered := created.Add(time.Duration(i) * step)
+		if i > 0 {
+			task.StatusHistory[i-1].ExitedAt = &entered
+		}
+		task.StatusHistory = append(task.StatusHistory, StatusPeriod{Status: status, EnteredAt: entered})
+		task.StatusSince = &task.StatusHistory[i].EnteredAt
+		task.UpdatedAt = entered
+	}
+	if dt.due != 0 {
+		due := now.Add(dt.due)
+		task.DueDate = &due
+	}
+	return task
+}
+
+// resetDemoData drops the database and the archived tasks and seeds them
+// again.
+func (s *Server) resetDemoData(c echo.Context) error {
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Demo data reset successfully"})
+	}
+	ctx := context.Background()
+	if err := s.db.Drop(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to drop database"})
+	}
+	if err := s.cold.reset(); err != nil {
+		c.Logger().Errorf("Failed to clear cold storage: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to clear cold storage"})
+	}
+	if err := s.ensureIndexes(ctx); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create indexes"})
+	}
+	demo, err := s.SeedDemoData(ctx)
+	if err != nil {
+		c.Logger().Errorf("Failed to seed demo data: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to seed demo data"})
+	}
+	return c.JSON(http.StatusOK, demo)
+}
+
+// getDemoData lists the seeded credentials.
+func (s *Server) getDemoData(c echo.Context) error {
+	s.dev.mu.Lock()
+	demo := s.dev.demo
+	s.dev.mu.Unlock()
+	if demo == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No demo data seeded"})
+	}
+	return c.JSON(http.StatusOK, demo)
+}
+
+// mockMiddleware delays requests and answers them with a canned status
+// when asked to, so clients can be tried against slow or failing responses.
+func (s *Server) mockMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if v := mockParam(c, "mock_delay", "X-Mock-Delay"); v != "" {
+			delay, err := time.ParseDuration(v)
+			if err != nil || delay < 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "mock_delay must be a duration like 500ms"})
+			}
+			if delay > maxMockDelay {
+				delay = maxMockDelay
+			}
+			s.logger.Debugf("Delaying %s %s by %s", c.Request().Method, c.Request().URL.Path, delay)
+			select {
+			case <-time.After(delay):
+			case <-c.Request().Context().Done():
+				return c.Request().Context().Err()
+			}
+		}
+		if v := mockParam(c, "mock_status", "X-Mock-Status"); v != "" {
+			status, err := strconv.Atoi(v)
+			if err != nil || status < 200 || status > 599 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "mock_status must be an HTTP status code"})
+			}
+			s.logger.Debugf("Answering %s %s with mock status %d", c.Request().Method, c.Request().URL.Path, status)
+			if status < 400 {
+				return c.NoContent(status)
+			}
+			return c.JSON(status, map[string]string{"error": http.StatusText(status)})
+		}
+		return next(c)
+	}
+}
+
+func mockParam(c echo.Context, query, header string) string {
+	if v := c.QueryParam(query); v != "" {
+		return v
+	}
+	return c.Request().Header.Get(header)
+}
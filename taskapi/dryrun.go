@@ -0,0 +1,51 @@
+package taskapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A mutating request sent with "Prefer: dry-run" (or ?dry_run=true) goes
+// through the same validation, authorization and limit checks as a real one
+// and gets the response it would have got, but nothing is written. Every
+// mutating handler checks isDryRun right before its first write.
+const dryRunKey = "dry_run"
+
+func wantsDryRun(r *http.Request) bool {
+	if r.URL.Query().Get("dry_run") == "true" {
+		return true
+	}
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			token, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "dry-run") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dryRunMiddleware marks dry-run requests and acknowledges the preference
+// with a Preference-Applied header, as RFC 7240 describes.
+func (s *Server) dryRunMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+		if wantsDryRun(c.Request()) {
+			c.Set(dryRunKey, true)
+			c.Response().Header().Set("Preference-Applied", "dry-run")
+		}
+		c.Response().Header().Add("Vary", "Prefer")
+		return next(c)
+	}
+}
+
+func isDryRun(c echo.Context) bool {
+	dry, _ := c.Get(dryRunKey).(bool)
+	return dry
+}
@@ -0,0 +1,622 @@
+package taskapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	sessionOpen   = "open"
+	sessionClosed = "closed"
+)
+
+// sessionRetries is how often a session change is retried when another
+// change to the same session wins the race.
+const sessionRetries = 3
+
+const (
+	streamPingInterval = 25 * time.Second
+	// streamPollInterval is how often a stream checks MongoDB for changes
+	// made through other instances.
+	streamPollInterval = 2 * time.Second
+)
+
+var defaultEstimateScale = []string{"0", "1", "2", "3", "5", "8", "13", "21", "?"}
+
+// EstimationSession is a planning poker session over a list of tasks.
+// Participants vote on each task in secret; the facilitator reveals the votes
+// together, can start a new round, and accepts the agreed estimate, which is
+// written to the task.
+type EstimationSession struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name        string             `bson:"name" json:"name"`
+	Facilitator string             `bson:"facilitator" json:"facilitator"`
+	Scale       []string           `bson:"scale" json:"scale"`
+	Items       []EstimationItem   `bson:"items" json:"items"`
+	Status      string             `bson:"status" json:"status"`
+	// Version guards read-modify-write changes against concurrent votes.
+	Version   int       `bson:"version" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// EstimationItem is one task's voting. Votes are only shown once revealed;
+// until then Voters lists who has voted.
+type EstimationItem struct {
+	TaskID   TaskID         `bson:"task_id" json:"task_id"`
+	Round    int            `bson:"round" json:"round"`
+	Votes    []EstimateVote `bson:"votes,omitempty" json:"votes,omitempty"`
+	Revealed bool           `bson:"revealed" json:"revealed"`
+	Stats    *EstimateStats `bson:"stats,omitempty" json:"stats,omitempty"`
+	Estimate *float64       `bson:"estimate,omitempty" json:"estimate,omitempty"`
+
+	Voters   []string `bson:"-" json:"voters,omitempty"`
+	YourVote string   `bson:"-" json:"your_vote,omitempty"`
+}
+
+type EstimateVote struct {
+	User  string `bson:"user" json:"user"`
+	Value string `bson:"value" json:"value"`
+}
+
+// EstimateStats summarises a revealed round. Only numeric votes count
+// towards the figures; Suggested is the smallest scale value not below the
+// median.
+type EstimateStats struct {
+	Votes     int     `bson:"votes" json:"votes"`
+	Numeric   int     `bson:"numeric" json:"numeric"`
+	Min       float64 `bson:"min" json:"min"`
+	Max       float64 `bson:"max" json:"max"`
+	Mean      float64 `bson:"mean" json:"mean"`
+	Median    float64 `bson:"median" json:"median"`
+	Spread    float64 `bson:"spread" json:"spread"`
+	Consensus bool    `bson:"consensus" json:"consensus"`
+	Suggested string  `bson:"suggested,omitempty" json:"suggested,omitempty"`
+}
+
+func estimateStats(votes []EstimateVote, scale []string) *EstimateStats {
+	st := &EstimateStats{Votes: len(votes), Consensus: len(votes) > 0}
+	var nums []float64
+	for _, v := range votes {
+		if v.Value != votes[0].Value {
+			st.Consensus = false
+		}
+		if n, err := strconv.ParseFloat(v.Value, 64); err == nil {
+			nums = append(nums, n)
+		}
+	}
+	st.Numeric = len(nums)
+	if len(nums) == 0 {
+		return st
+	}
+
+	sort.Float64s(nums)
+	sum := 0.0
+	for _, n := range nums {
+		sum += n
+	}
+	st.Min, st.Max = nums[0], nums[len(nums)-1]
+	st.Mean = sum / float64(len(nums))
+	st.Spread = st.Max - st.Min
+	if mid := len(nums) / 2; len(nums)%2 == 1 {
+		st.Median = nums[mid]
+	} else {
+		st.Median = (nums[mid-1] + nums[mid]) / 2
+	}
+	best := 0.0
+	for _, v := range scale {
+		n, err := strconv.ParseFloat(v, 64)
+		if err == nil && n >= st.Median && (st.Suggested == "" || n < best) {
+			st.Suggested, best = v, n
+		}
+	}
+	return st
+}
+
+func (sess *EstimationSession) item(id TaskID) *EstimationItem {
+	for i := range sess.Items {
+		if sess.Items[i].TaskID == id {
+			return &sess.Items[i]
+		}
+	}
+	return nil
+}
+
+// view returns the session as user may see it: votes of unrevealed items
+// are replaced by the list of voters and the user's own vote.
+func (sess *EstimationSession) view(user string) *EstimationSession {
+	v := *sess
+	v.Items = make([]EstimationItem, len(sess.Items))
+	for i, item := range sess.Items {
+		if !item.Revealed {
+			item.Voters = []string{}
+			for _, vote := range item.Votes {
+				item.Voters = append(item.Voters, vote.User)
+				if vote.User == user {
+					item.YourVote = vote.Value
+				}
+			}
+			item.Votes = nil
+		}
+		v.Items[i] = item
+	}
+	return &v
+}
+
+// sessionHub fans session changes out to the event streams connected to
+// this instance at once. Changes made through other instances reach a stream
+// when it next polls the session's version (see streamEstimationSession).
+type sessionHub struct {
+	mu   sync.Mutex
+	subs map[primitive.ObjectID]map[chan sessionEvent]struct{}
+}
+
+// sessionEvent is a change to a session: what happened, to which task and
+// by whom, and the session after it. Each stream renders the session as its
+// own user may see it.
+type sessionEvent struct {
+	kind    string
+	taskID  TaskID
+	user    string
+	session *EstimationSession
+}
+
+// encode renders the event for a stream of viewer.
+func (e sessionEvent) encode(viewer string) ([]byte, error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":    e.kind,
+		"task_id": e.taskID,
+		"user":    e.user,
+		"session": e.session.view(viewer),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte("event: " + e.kind + "\ndata: " + string(data) + "\n\n"), nil
+}
+
+func (h *sessionHub) subscribe(id primitive.ObjectID) chan sessionEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan sessionEvent, 16)
+	if h.subs[id] == nil {
+		h.subs[id] = map[chan sessionEvent]struct{}{}
+	}
+	h.subs[id][ch] = struct{}{}
+	return ch
+}
+
+func (h *sessionHub) unsubscribe(id primitive.ObjectID, ch chan sessionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[id], ch)
+	if len(h.subs[id]) == 0 {
+		delete(h.subs, id)
+	}
+}
+
+// publish sends an event to every stream of the session. Events carry the
+// whole session, so a slow stream that misses one loses nothing.
+func (h *sessionHub) publish(id primitive.ObjectID, event sessionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[id] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// publishSession announces a change to the session's streams. The session
+// must not be modified afterwards, since the streams read it.
+func (s *Server) publishSession(sess *EstimationSession, kind string, taskID TaskID, user string) {
+	s.estimationHub.publish(sess.ID, sessionEvent{kind: kind, taskID: taskID, user: user, session: sess})
+}
+
+func (s *Server) createEstimationSession(c echo.Context) error {
+	user := s.currentUser(c)
+	if user == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "X-User-ID header is required"})
+	}
+	var req struct {
+		Name    string   `json:"name"`
+		TaskIDs []string `json:"task_ids"`
+		Scale   []string `json:"scale"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if len(req.TaskIDs) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "task_ids is required"})
+	}
+	if len(req.Scale) == 0 {
+		req.Scale = defaultEstimateScale
+	}
+
+	sess := &EstimationSession{
+		ID:          primitive.NewObjectID(),
+		Name:        req.Name,
+		Facilitator: user,
+		Scale:       req.Scale,
+		Status:      sessionOpen,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+	ids := make([]TaskID, 0, len(req.TaskIDs))
+	for _, raw := range req.TaskIDs {
+		id, err := s.parseTaskID(raw)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid task ID " + raw})
+		}
+		if sess.item(id) != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "task_ids must not repeat a task"})
+		}
+		sess.Items = append(sess.Items, EstimationItem{TaskID: id, Round: 1})
+		ids = append(ids, id)
+	}
+	count, err := s.taskCollection.CountDocuments(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch tasks"})
+	}
+	if int(count) != len(ids) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Some tasks do not exist"})
+	}
+
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, sess.view(user))
+	}
+	if _, err := s.estimationCollection.InsertOne(context.Background(), sess); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create estimation session"})
+	}
+	return c.JSON(http.StatusCreated, sess.view(user))
+}
+
+func (s *Server) findEstimationSession(c echo.Context) (*EstimationSession, error) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var sess EstimationSession
+	err = s.estimationCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&sess)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Estimation session not found"})
+		}
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch estimation session"})
+	}
+	return &sess, nil
+}
+
+func (s *Server) getEstimationSession(c echo.Context) error {
+	sess, err := s.findEstimationSession(c)
+	if sess == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, sess.view(s.currentUser(c)))
+}
+
+// changeSession loads the session, lets apply change it and saves it if
+// nobody else changed it meanwhile, retrying otherwise. apply returns a
+// status and message to stop with a client error. On success the session is
+// published as a kind event and returned to the caller.
+func (s *Server) changeSession(c echo.Context, kind string, taskID TaskID, apply func(sess *EstimationSession) (int, string)) (*EstimationSession, error) {
+	user := s.currentUser(c)
+	ctx := context.Background()
+	for attempt := 0; attempt < sessionRetries; attempt++ {
+		sess, err := s.findEstimationSession(c)
+		if sess == nil {
+			return nil, err
+		}
+		if sess.Status != sessionOpen {
+			return nil, c.JSON(http.StatusConflict, map[string]string{"error": "Estimation session is closed"})
+		}
+		if status, msg := apply(sess); status != 0 {
+			return nil, c.JSON(status, map[string]string{"error": msg})
+		}
+		sess.UpdatedAt = time.Now()
+		if isDryRun(c) {
+			return sess, nil
+		}
+
+		result, err := s.estimationCollection.UpdateOne(ctx,
+			bson.M{"_id": sess.ID, "version": sess.Version},
+			bson.M{"$set": bson.M{"items": sess.Items, "status": sess.Status, "updated_at": sess.UpdatedAt},
+				"$inc": bson.M{"version": 1}})
+		if err != nil {
+			return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update estimation session"})
+		}
+		if result.MatchedCount == 1 {
+			sess.Version++
+			s.publishSession(sess, kind, taskID, user)
+			return sess, nil
+		}
+	}
+	return nil, c.JSON(http.StatusConflict, map[string]string{"error": "Estimation session is busy, retry"})
+}
+
+// sessionItem resolves the :taskId of an item route.
+func (s *Server) sessionItem(c echo.Context, sess *EstimationSession) (*EstimationItem, int, string) {
+	id, err := s.parseTaskID(c.Param("taskId"))
+	if err != nil {
+		return nil, http.StatusBadRequest, "Invalid task ID"
+	}
+	item := sess.item(id)
+	if item == nil {
+		return nil, http.StatusNotFound, "Task is not part of this session"
+	}
+	return item, 0, ""
+}
+
+func (s *Server) requireFacilitator(c echo.Context, sess *EstimationSession) (int, string) {
+	if s.currentUser(c) != sess.Facilitator && !s.isAdminRequest(c) {
+		return http.StatusForbidden, "Only the facilitator can do this"
+	}
+	return 0, ""
+}
+
+// voteEstimate records or replaces the caller's secret vote in the current
+// round of a task.
+func (s *Server) voteEstimate(c echo.Context) error {
+	user := s.currentUser(c)
+	if user == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "X-User-ID header is required"})
+	}
+	var req struct {
+		Value string `json:"value"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+
+	sess, err := s.changeSession(c, "vote", TaskID(c.Param("taskId")), func(sess *EstimationSession) (int, string) {
+		item, status, msg := s.sessionItem(c, sess)
+		if item == nil {
+			return status, msg
+		}
+		if !containsString(sess.Scale, req.Value) {
+			return http.StatusBadRequest, "Value must be one of the session's scale"
+		}
+		if item.Revealed {
+			return http.StatusConflict, "Votes are revealed, start a new round to vote again"
+		}
+		for i, v := range item.Votes {
+			if v.User == user {
+				item.Votes[i].Value = req.Value
+				return 0, ""
+			}
+		}
+		item.Votes = append(item.Votes, EstimateVote{User: user, Value: req.Value})
+		return 0, ""
+	})
+	if sess == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, sess.view(user))
+}
+
+// revealEstimates shows every vote of a task's round at once, with the
+// spread statistics.
+func (s *Server) revealEstimates(c echo.Context) error {
+	sess, err := s.changeSession(c, "reveal", TaskID(c.Param("taskId")), func(sess *EstimationSession) (int, string) {
+		if status, msg := s.requireFacilitator(c, sess); status != 0 {
+			return status, msg
+		}
+		item, status, msg := s.sessionItem(c, sess)
+		if item == nil {
+			return status, msg
+		}
+		if len(item.Votes) == 0 {
+			return http.StatusConflict, "Nobody has voted yet"
+		}
+		item.Revealed = true
+		item.Stats = estimateStats(item.Votes, sess.Scale)
+		return 0, ""
+	})
+	if sess == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, sess.view(s.currentUser(c)))
+}
+
+// resetEstimates starts a new round for a task, discarding its votes.
+func (s *Server) resetEstimates(c echo.Context) error {
+	sess, err := s.changeSession(c, "reset", TaskID(c.Param("taskId")), func(sess *EstimationSession) (int, string) {
+		if status, msg := s.requireFacilitator(c, sess); status != 0 {
+			return status, msg
+		}
+		item, status, msg := s.sessionItem(c, sess)
+		if item == nil {
+			return status, msg
+		}
+		item.Round++
+		item.Votes, item.Revealed, item.Stats = nil, false, nil
+		return 0, ""
+	})
+	if sess == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, sess.view(s.currentUser(c)))
+}
+
+// acceptEstimate records the agreed estimate for a revealed task and writes
+// it onto the task.
+func (s *Server) acceptEstimate(c echo.Context) error {
+	var req struct {
+		Estimate *float64 `json:"estimate"`
+	}
+	if err := c.Bind(&req); err != nil || req.Estimate == nil || *req.Estimate < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "estimate must be a non-negative number"})
+	}
+	taskID, err := s.parseTaskID(c.Param("taskId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid task ID"})
+	}
+	count, err := s.taskCollection.CountDocuments(context.Background(), bson.M{"_id": taskID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if count == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+
+	sess, err := s.changeSession(c, "accept", taskID, func(sess *EstimationSession) (int, string) {
+		if status, msg := s.requireFacilitator(c, sess); status != 0 {
+			return status, msg
+		}
+		item, status, msg := s.sessionItem(c, sess)
+		if item == nil {
+			return status, msg
+		}
+		if !item.Revealed {
+			return http.StatusConflict, "Reveal the votes before accepting an estimate"
+		}
+		item.Estimate = req.Estimate
+		return 0, ""
+	})
+	if sess == nil {
+		return err
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, sess.view(s.currentUser(c)))
+	}
+
+	var previous Task
+	err = s.taskCollection.FindOneAndUpdate(context.Background(), bson.M{"_id": taskID},
+		bson.M{"$set": bson.M{"estimate": *req.Estimate, "updated_at": time.Now()}}).Decode(&previous)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Estimate recorded but updating the task failed"})
+	}
+	task := previous
+	task.Estimate, task.UpdatedAt = req.Estimate, time.Now()
+	s.emit(taskEvent{Type: eventUpdated, Task: task, Previous: &previous})
+	return c.JSON(http.StatusOK, sess.view(s.currentUser(c)))
+}
+
+func (s *Server) closeEstimationSession(c echo.Context) error {
+	sess, err := s.changeSession(c, "close", "", func(sess *EstimationSession) (int, string) {
+		if status, msg := s.requireFacilitator(c, sess); status != 0 {
+			return status, msg
+		}
+		sess.Status = sessionClosed
+		return 0, ""
+	})
+	if sess == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, sess.view(s.currentUser(c)))
+}
+
+// streamEstimationSession sends the session as a server-sent event stream:
+// a "session" event with the current state, then one event per change
+// (vote, reveal, reset, accept, close) carrying the new state. Changes made
+// through another instance arrive as a "session" event within
+// streamPollInterval.
+func (s *Server) streamEstimationSession(c echo.Context) error {
+	sess, err := s.findEstimationSession(c)
+	if sess == nil {
+		return err
+	}
+	ch := s.estimationHub.subscribe(sess.ID)
+	defer s.estimationHub.unsubscribe(sess.ID, ch)
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	user := s.currentUser(c)
+	sendState := func(sess *EstimationSession) error {
+		data, err := json.Marshal(map[string]interface{}{"type": "session", "session": sess.view(user)})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: session\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	}
+	if err := sendState(sess); err != nil {
+		return err
+	}
+	version := sess.Version
+
+	ctx := c.Request().Context()
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event := <-ch:
+			if event.session.Version <= version {
+				continue
+			}
+			version = event.session.Version
+			data, err := event.encode(user)
+			if err != nil {
+				s.logger.Errorf("Failed to encode session event: %v", err)
+				continue
+			}
+			if _, err := w.Write(data); err != nil {
+				return nil
+			}
+			w.Flush()
+		case <-poll.C:
+			var latest EstimationSession
+			err := s.estimationCollection.FindOne(ctx, bson.M{"_id": sess.ID, "version": bson.M{"$gt": version}}).Decode(&latest)
+			if err != nil {
+				// Unchanged, deleted or unreachable: keep the stream and
+				// look again on the next tick.
+				continue
+			}
+			version = latest.Version
+			if sendState(&latest) != nil {
+				return nil
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		}
+	}
+}
+
+func (s *Server) getEstimationSessions(c echo.Context) error {
+	filter := bson.M{}
+	if status := c.QueryParam("status"); status != "" {
+		filter["status"] = status
+	}
+	cursor, err := s.estimationCollection.Find(context.Background(), filter,
+		options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch estimation sessions"})
+	}
+	var sessions []EstimationSession
+	if err := cursor.All(context.Background(), &sessions); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding estimation session data"})
+	}
+	user := s.currentUser(c)
+	views := make([]*EstimationSession, len(sessions))
+	for i := range sessions {
+		views[i] = sessions[i].view(user)
+	}
+	return c.JSON(http.StatusOK, views)
+}
@@ -0,0 +1,88 @@
+package taskapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEstimateStats(t *testing.T) {
+	votes := func(values ...string) []EstimateVote {
+		out := make([]EstimateVote, len(values))
+		for i, v := range values {
+			out[i] = EstimateVote{User: string(rune('a' + i)), Value: v}
+		}
+		return out
+	}
+	tests := []struct {
+		name  string
+		votes []EstimateVote
+		scale []string
+		want  EstimateStats
+	}{
+		{"no votes", nil, defaultEstimateScale, EstimateStats{}},
+		{"consensus", votes("5", "5", "5"), defaultEstimateScale, EstimateStats{
+			Votes: 3, Numeric: 3, Min: 5, Max: 5, Mean: 5, Median: 5, Consensus: true, Suggested: "5",
+		}},
+		{"odd count", votes("1", "8", "3"), defaultEstimateScale, EstimateStats{
+			Votes: 3, Numeric: 3, Min: 1, Max: 8, Mean: 4, Median: 3, Spread: 7, Suggested: "3",
+		}},
+		// The median of 3 and 5 is 4, which rounds up to the next scale value.
+		{"even count", votes("2", "3", "5", "13"), defaultEstimateScale, EstimateStats{
+			Votes: 4, Numeric: 4, Min: 2, Max: 13, Mean: 5.75, Median: 4, Spread: 11, Suggested: "5",
+		}},
+		{"non-numeric votes", votes("?", "3", "?"), defaultEstimateScale, EstimateStats{
+			Votes: 3, Numeric: 1, Min: 3, Max: 3, Mean: 3, Median: 3, Suggested: "3",
+		}},
+		{"only non-numeric", votes("?", "?"), defaultEstimateScale, EstimateStats{Votes: 2, Consensus: true}},
+		{"median above scale", votes("40", "100"), defaultEstimateScale, EstimateStats{
+			Votes: 2, Numeric: 2, Min: 40, Max: 100, Mean: 70, Median: 70, Spread: 60,
+		}},
+		{"unordered scale", votes("2", "2"), []string{"8", "3", "5", "1"}, EstimateStats{
+			Votes: 2, Numeric: 2, Min: 2, Max: 2, Mean: 2, Median: 2, Consensus: true, Suggested: "3",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateStats(tt.votes, tt.scale); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("estimateStats = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionEventPerViewer(t *testing.T) {
+	hub := &sessionHub{subs: map[primitive.ObjectID]map[chan sessionEvent]struct{}{}}
+	sess := &EstimationSession{ID: primitive.NewObjectID(), Version: 2, Items: []EstimationItem{{
+		TaskID: "t1",
+		Votes:  []EstimateVote{{User: "ann", Value: "3"}, {User: "bob", Value: "5"}},
+	}}}
+	ann, bob := hub.subscribe(sess.ID), hub.subscribe(sess.ID)
+	hub.publish(sess.ID, sessionEvent{kind: "vote", taskID: "t1", user: "bob", session: sess})
+
+	for viewer, ch := range map[string]chan sessionEvent{"ann": ann, "bob": bob} {
+		data, err := (<-ch).encode(viewer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, ok := strings.CutPrefix(string(data), "event: vote\ndata: ")
+		if !ok {
+			t.Fatalf("event %q", data)
+		}
+		var event struct {
+			User    string            `json:"user"`
+			Session EstimationSession `json:"session"`
+		}
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			t.Fatal(err)
+		}
+		item := event.Session.Items[0]
+		want := map[string]string{"ann": "3", "bob": "5"}[viewer]
+		if item.YourVote != want || len(item.Votes) != 0 || len(item.Voters) != 2 || event.User != "bob" {
+			t.Errorf("%s sees %+v from %s, want only their own vote %s", viewer, item, event.User, want)
+		}
+	}
+}
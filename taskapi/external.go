@@ -0,0 +1,58 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ensureExternalRefIndex enforces that an external reference points at one
+// task at most. Tasks without a reference are left out of the index.
+func (s *Server) ensureExternalRefIndex(ctx context.Context) error {
+	_, err := s.taskCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "external_source", Value: 1}, {Key: "external_id", Value: 1}},
+		Options: options.Index().
+			SetName("external_ref").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"external_id": bson.M{"$exists": true}}),
+	})
+	return err
+}
+
+func (s *Server) getExternalTask(c echo.Context) error {
+	task, err := s.externalTask(context.Background(), c.Param("source"), c.Param("externalId"), true)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if task == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+// upsertExternalTask creates or updates the task with the given external
+// reference, so integrations can sync without tracking our IDs. An archived
+// task is restored and updated rather than created again. If two upserts of
+// a new reference race, the unique index makes the loser fail with 409 and a
+// retry updates the winner's task.
+func (s *Server) upsertExternalTask(c echo.Context) error {
+	task := new(Task)
+	if err := c.Bind(task); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	task.ExternalSource, task.ExternalID = c.Param("source"), c.Param("externalId")
+
+	existing, err := s.externalTask(context.Background(), task.ExternalSource, task.ExternalID, !isDryRun(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if existing == nil {
+		task.ID = s.newTaskID()
+		return s.insertTask(c, task)
+	}
+	return s.replaceTask(c, existing, task)
+}
@@ -0,0 +1,156 @@
+package taskapi
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TaskID identifies a task. IDs in ObjectID form are stored as BSON
+// ObjectIDs, so tasks created before ID strategies existed (and references
+// to them) keep matching; every other ID is stored as a string.
+type TaskID string
+
+func (id TaskID) String() string { return string(id) }
+
+func (id TaskID) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	if oid, err := primitive.ObjectIDFromHex(string(id)); err == nil {
+		return bson.MarshalValue(oid)
+	}
+	return bson.MarshalValue(string(id))
+}
+
+func (id *TaskID) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bson.TypeObjectID:
+		*id = TaskID(raw.ObjectID().Hex())
+	case bson.TypeString:
+		*id = TaskID(raw.StringValue())
+	case bson.TypeNull, bson.TypeUndefined:
+		*id = ""
+	default:
+		return fmt.Errorf("cannot decode %s into a TaskID", t)
+	}
+	return nil
+}
+
+// ID strategies, selected with WithIDStrategy.
+const (
+	idStrategyObjectID = "objectid"
+	idStrategyULID     = "ulid"
+	idStrategyUUIDv7   = "uuidv7"
+)
+
+func (s *Server) setIDStrategy(name string) error {
+	switch name = strings.ToLower(name); name {
+	case idStrategyObjectID, idStrategyULID, idStrategyUUIDv7:
+		s.idStrategy = name
+		return nil
+	}
+	return fmt.Errorf("unknown ID strategy %q", name)
+}
+
+func (s *Server) newTaskID() TaskID {
+	switch s.idStrategy {
+	case idStrategyULID:
+		return TaskID(newULID(time.Now()))
+	case idStrategyUUIDv7:
+		return TaskID(newUUIDv7(time.Now()))
+	}
+	return TaskID(primitive.NewObjectID().Hex())
+}
+
+// parseTaskID validates a task ID from a request and returns it in canonical
+// form. Every known format is accepted whatever the current strategy, since
+// tasks keep the IDs they were created with when the strategy changes.
+func (s *Server) parseTaskID(raw string) (TaskID, error) {
+	switch {
+	case isObjectID(raw):
+		return TaskID(strings.ToLower(raw)), nil
+	case isULID(raw):
+		return TaskID(strings.ToUpper(raw)), nil
+	case isUUIDv7(raw):
+		return TaskID(strings.ToLower(raw)), nil
+	}
+	return "", fmt.Errorf("invalid task ID %q", raw)
+}
+
+func isObjectID(s string) bool {
+	_, err := primitive.ObjectIDFromHex(s)
+	return err == nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48-bit millisecond timestamp followed by 80
+// random bits, in Crockford base32.
+func newULID(t time.Time) string {
+	var b [16]byte
+	ms := uint64(t.UnixMilli())
+	b[0], b[1], b[2] = byte(ms>>40), byte(ms>>32), byte(ms>>24)
+	b[3], b[4], b[5] = byte(ms>>16), byte(ms>>8), byte(ms)
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+func isULID(s string) bool {
+	if len(s) != 26 {
+		return false
+	}
+	s = strings.ToUpper(s)
+	// 26 base32 digits hold 130 bits, so the first may only carry 3.
+	if s[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune(crockford, rune(s[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUIDv7 returns an RFC 9562 version 7 UUID.
+func newUUIDv7(t time.Time) string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	ms := uint64(t.UnixMilli())
+	b[0], b[1], b[2] = byte(ms>>40), byte(ms>>32), byte(ms>>24)
+	b[3], b[4], b[5] = byte(ms>>16), byte(ms>>8), byte(ms)
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+func isUUIDv7(s string) bool {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return false
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	return b[6]>>4 == 7 && b[8]>>6 == 2
+}
@@ -0,0 +1,53 @@
+package taskapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTaskID(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want TaskID
+	}{
+		{"65F1A2B3C4D5E6F708192A3B", "65f1a2b3c4d5e6f708192a3b"},
+		{"01hrz3ngqj7kd2x4v5w6y8z9ab", "01HRZ3NGQJ7KD2X4V5W6Y8Z9AB"},
+		{"018E4C5A-1B2C-7D3E-8F40-123456789ABC", "018e4c5a-1b2c-7d3e-8f40-123456789abc"},
+		{"", ""},
+		{"not-an-id", ""},
+		// 26 characters, but more than 128 bits.
+		{"81HRZ3NGQJ7KD2X4V5W6Y8Z9AB", ""},
+		// A version 4 UUID.
+		{"018e4c5a-1b2c-4d3e-8f40-123456789abc", ""},
+	}
+	// Existing tasks keep their IDs when the strategy changes, so every
+	// strategy accepts every format.
+	for _, strategy := range []string{idStrategyObjectID, idStrategyULID, idStrategyUUIDv7} {
+		s := &Server{idStrategy: strategy}
+		for _, tt := range tests {
+			got, err := s.parseTaskID(tt.raw)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("%s: parseTaskID(%q) = %q, want an error", strategy, tt.raw, got)
+				}
+				continue
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("%s: parseTaskID(%q) = %q, %v; want %q", strategy, tt.raw, got, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestNewTaskIDRoundTrips(t *testing.T) {
+	for _, strategy := range []string{idStrategyObjectID, idStrategyULID, idStrategyUUIDv7} {
+		s := &Server{idStrategy: strategy}
+		id := s.newTaskID()
+		if got, err := s.parseTaskID(string(id)); err != nil || got != id {
+			t.Errorf("%s: parseTaskID(%q) = %q, %v", strategy, id, got, err)
+		}
+	}
+	if a, b := newULID(time.UnixMilli(1)), newULID(time.UnixMilli(2)); a >= b {
+		t.Errorf("ULIDs do not sort by time: %s >= %s", a, b)
+	}
+}
@@ -0,0 +1,631 @@
+package taskapi
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BillingRate is an hourly rate in minor currency units (cents). A rate can
+// be set for a project, a user, or a user on a project; the most specific one
+// matching a time entry applies, and a rate with neither is the default.
+type BillingRate struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Project    string             `bson:"project,omitempty" json:"project,omitempty"`
+	User       string             `bson:"user,omitempty" json:"user,omitempty"`
+	HourlyRate int64              `bson:"hourly_rate" json:"hourly_rate"`
+	Currency   string             `bson:"currency" json:"currency"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+const (
+	invoiceDraft  = "draft"
+	invoiceIssued = "issued"
+)
+
+// Invoice bills a project's unbilled time in a period. A draft holds a claim
+// on its time entries, so no other invoice can include them; issuing it marks
+// them billed, and deleting the draft releases them.
+type Invoice struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Number       string             `bson:"number,omitempty" json:"number,omitempty"`
+	Project      string             `bson:"project" json:"project"`
+	From         string             `bson:"from" json:"from"`
+	To           string             `bson:"to" json:"to"`
+	Status       string             `bson:"status" json:"status"`
+	Currency     string             `bson:"currency" json:"currency"`
+	Lines        []InvoiceLine      `bson:"lines" json:"lines"`
+	TotalMinutes int                `bson:"total_minutes" json:"total_minutes"`
+	Total        int64              `bson:"total" json:"total"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	IssuedAt     *time.Time         `bson:"issued_at,omitempty" json:"issued_at,omitempty"`
+}
+
+// InvoiceLine is one time entry as billed, with the task title and rate
+// captured when the invoice was drafted.
+type InvoiceLine struct {
+	EntryID    primitive.ObjectID `bson:"entry_id" json:"entry_id"`
+	TaskID     TaskID             `bson:"task_id" json:"task_id"`
+	TaskTitle  string             `bson:"task_title" json:"task_title"`
+	User       string             `bson:"user" json:"user"`
+	Date       string             `bson:"date" json:"date"`
+	Minutes    int                `bson:"minutes" json:"minutes"`
+	Note       string             `bson:"note,omitempty" json:"note,omitempty"`
+	HourlyRate int64              `bson:"hourly_rate" json:"hourly_rate"`
+	Amount     int64              `bson:"amount" json:"amount"`
+}
+
+func (s *Server) ensureBillingRateIndex(ctx context.Context) error {
+	_, err := s.billingRateCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "project", Value: 1}, {Key: "user", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (r *BillingRate) validate() string {
+	if r.HourlyRate < 0 {
+		return "hourly_rate must not be negative"
+	}
+	if r.Currency == "" {
+		r.Currency = "USD"
+	}
+	r.Currency = strings.ToUpper(r.Currency)
+	if len(r.Currency) != 3 {
+		return "currency must be a 3-letter ISO 4217 code"
+	}
+	return ""
+}
+
+func (s *Server) createBillingRate(c echo.Context) error {
+	rate := new(BillingRate)
+	if err := c.Bind(rate); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if msg := rate.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	rate.ID = primitive.NewObjectID()
+	rate.CreatedAt = time.Now()
+	rate.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		count, err := s.billingRateCollection.CountDocuments(context.Background(), rateScopeFilter(rate))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch billing rates"})
+		}
+		if count > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A rate for this project and user already exists"})
+		}
+		return c.JSON(http.StatusCreated, rate)
+	}
+	if _, err := s.billingRateCollection.InsertOne(context.Background(), rate); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A rate for this project and user already exists"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create billing rate"})
+	}
+	return c.JSON(http.StatusCreated, rate)
+}
+
+// rateScopeFilter matches the rate with the same project and user as r,
+// treating empty values as absent like the unique index does.
+func rateScopeFilter(r *BillingRate) bson.M {
+	filter := bson.M{"project": nil, "user": nil}
+	if r.Project != "" {
+		filter["project"] = r.Project
+	}
+	if r.User != "" {
+		filter["user"] = r.User
+	}
+	return filter
+}
+
+func (s *Server) getAllBillingRates(c echo.Context) error {
+	cursor, err := s.billingRateCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch billing rates"})
+	}
+	rates := []BillingRate{}
+	if err := cursor.All(context.Background(), &rates); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding billing rate data"})
+	}
+	return c.JSON(http.StatusOK, rates)
+}
+
+// updateBillingRate changes a rate's amount and currency. Invoices already
+// drafted keep the rate they were drafted with.
+func (s *Server) updateBillingRate(c echo.Context) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	update := new(BillingRate)
+	if err := c.Bind(update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if msg := update.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	filter := bson.M{"_id": objectID}
+	if isDryRun(c) {
+		return s.dryRunBillingRate(c, objectID, "Billing rate updated successfully")
+	}
+	result, err := s.billingRateCollection.UpdateOne(context.Background(), filter, bson.M{
+		"$set": bson.M{"hourly_rate": update.HourlyRate, "currency": update.Currency, "updated_at": time.Now()},
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update billing rate"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Billing rate not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Billing rate updated successfully"})
+}
+
+func (s *Server) deleteBillingRate(c echo.Context) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	filter := bson.M{"_id": objectID}
+	if isDryRun(c) {
+		return s.dryRunBillingRate(c, objectID, "Billing rate deleted successfully")
+	}
+	result, err := s.billingRateCollection.DeleteOne(context.Background(), filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete billing rate"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Billing rate not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Billing rate deleted successfully"})
+}
+
+func (s *Server) dryRunBillingRate(c echo.Context, id primitive.ObjectID, message string) error {
+	count, err := s.billingRateCollection.CountDocuments(context.Background(), bson.M{"_id": id})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch billing rate"})
+	}
+	if count == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Billing rate not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": message})
+}
+
+// rateTable resolves the billing rate for a project and user.
+type rateTable map[[2]string]BillingRate
+
+func (s *Server) loadRates(ctx context.Context) (rateTable, error) {
+	cursor, err := s.billingRateCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var rates []BillingRate
+	if err := cursor.All(ctx, &rates); err != nil {
+		return nil, err
+	}
+	table := rateTable{}
+	for _, r := range rates {
+		table[[2]string{r.Project, r.User}] = r
+	}
+	return table, nil
+}
+
+func (t rateTable) lookup(project, user string) (BillingRate, bool) {
+	for _, key := range [][2]string{{project, user}, {project, ""}, {"", user}, {"", ""}} {
+		if r, ok := t[key]; ok {
+			return r, true
+		}
+	}
+	return BillingRate{}, false
+}
+
+// buildInvoice fills in the lines and totals of inv from entries, failing
+// with a message for the client if an entry has no rate or the rates mix
+// currencies.
+func (s *Server) buildInvoice(ctx context.Context, inv *Invoice, entries []TimeEntry, rates rateTable) (string, error) {
+	ids := make([]TaskID, len(entries))
+	for i, e := range entries {
+		ids[i] = e.TaskID
+	}
+	cursor, err := s.taskCollection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetProjection(bson.M{"title": 1}))
+	if err != nil {
+		return "", err
+	}
+	var tasks []Task
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return "", err
+	}
+	titles := map[TaskID]string{}
+	for _, t := range tasks {
+		titles[t.ID] = t.Title
+	}
+	return fillInvoice(inv, entries, rates, titles), nil
+}
+
+// fillInvoice bills entries on inv at their rates, returning a message for
+// the client if one cannot be billed.
+func fillInvoice(inv *Invoice, entries []TimeEntry, rates rateTable, titles map[TaskID]string) string {
+	inv.Lines = make([]InvoiceLine, 0, len(entries))
+	inv.TotalMinutes, inv.Total = 0, 0
+	for _, e := range entries {
+		rate, ok := rates.lookup(e.Project, e.User)
+		if !ok {
+			return fmt.Sprintf("No billing rate for %s on project %s", e.User, e.Project)
+		}
+		if inv.Currency == "" {
+			inv.Currency = rate.Currency
+		} else if rate.Currency != inv.Currency {
+			return "Billing rates for this period use different currencies"
+		}
+		// Round half up to the nearest minor unit.
+		amount := (int64(e.Minutes)*rate.HourlyRate + 30) / 60
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			EntryID:    e.ID,
+			TaskID:     e.TaskID,
+			TaskTitle:  titles[e.TaskID],
+			User:       e.User,
+			Date:       e.Date,
+			Minutes:    e.Minutes,
+			Note:       e.Note,
+			HourlyRate: rate.HourlyRate,
+			Amount:     amount,
+		})
+		inv.TotalMinutes += e.Minutes
+		inv.Total += amount
+	}
+	return ""
+}
+
+// createInvoice drafts an invoice for a project's unbilled, billable time
+// between from and to (inclusive). The entries are claimed with a single
+// conditional update, so concurrent drafts can never bill an entry twice.
+func (s *Server) createInvoice(c echo.Context) error {
+	var req struct {
+		Project string `json:"project"`
+		From    string `json:"from"`
+		To      string `json:"to"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if req.Project == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Project is required"})
+	}
+	from, err1 := time.Parse(dateLayout, req.From)
+	to, err2 := time.Parse(dateLayout, req.To)
+	if err1 != nil || err2 != nil || to.Before(from) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "from and to must be dates (YYYY-MM-DD), from not after to"})
+	}
+
+	ctx := context.Background()
+	rates, err := s.loadRates(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch billing rates"})
+	}
+	unbilled := bson.M{
+		"project":    req.Project,
+		"billable":   true,
+		"invoice_id": bson.M{"$exists": false},
+		"date":       bson.M{"$gte": req.From, "$lte": req.To},
+	}
+	sort := options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := s.timeEntryCollection.Find(ctx, unbilled, sort)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch time entries"})
+	}
+	var entries []TimeEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding time entry data"})
+	}
+	if len(entries) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No unbilled time in this period"})
+	}
+
+	inv := &Invoice{
+		ID:        primitive.NewObjectID(),
+		Project:   req.Project,
+		From:      req.From,
+		To:        req.To,
+		Status:    invoiceDraft,
+		CreatedAt: time.Now(),
+	}
+	// Check every entry has a rate before claiming anything.
+	msg, err := s.buildInvoice(ctx, inv, entries, rates)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to build invoice"})
+	}
+	if msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, inv)
+	}
+
+	ids := make([]primitive.ObjectID, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+	unbilled["_id"] = bson.M{"$in": ids}
+	if _, err := s.timeEntryCollection.UpdateMany(ctx, unbilled, bson.M{"$set": bson.M{"invoice_id": inv.ID}}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to claim time entries"})
+	}
+
+	// Another draft may have claimed some of the entries first; bill only
+	// what this one got.
+	cursor, err = s.timeEntryCollection.Find(ctx, bson.M{"invoice_id": inv.ID}, sort)
+	if err == nil {
+		entries = nil
+		err = cursor.All(ctx, &entries)
+	}
+	if err == nil && len(entries) == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "The time in this period was invoiced concurrently"})
+	}
+	if err == nil {
+		inv.Currency = ""
+		_, err = s.buildInvoice(ctx, inv, entries, rates)
+	}
+	if err == nil {
+		_, err = s.invoiceCollection.InsertOne(ctx, inv)
+	}
+	if err != nil {
+		if rerr := s.releaseTimeEntries(ctx, inv.ID); rerr != nil {
+			c.Logger().Errorf("Failed to release time entries of invoice %s: %v", inv.ID.Hex(), rerr)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create invoice"})
+	}
+	return c.JSON(http.StatusCreated, inv)
+}
+
+func (s *Server) releaseTimeEntries(ctx context.Context, invoiceID primitive.ObjectID) error {
+	_, err := s.timeEntryCollection.UpdateMany(ctx, bson.M{"invoice_id": invoiceID}, bson.M{
+		"$unset": bson.M{"invoice_id": ""},
+	})
+	return err
+}
+
+func (s *Server) getAllInvoices(c echo.Context) error {
+	filter := bson.M{}
+	if v := c.QueryParam("project"); v != "" {
+		filter["project"] = v
+	}
+	if v := c.QueryParam("status"); v != "" {
+		filter["status"] = v
+	}
+	cursor, err := s.invoiceCollection.Find(context.Background(), filter,
+		options.Find().SetSort(bson.M{"created_at": -1}).SetProjection(bson.M{"lines": 0}))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch invoices"})
+	}
+	invoices := []Invoice{}
+	if err := cursor.All(context.Background(), &invoices); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding invoice data"})
+	}
+	return c.JSON(http.StatusOK, invoices)
+}
+
+func (s *Server) findInvoice(c echo.Context) (*Invoice, error) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var inv Invoice
+	err = s.invoiceCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&inv)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Invoice not found"})
+		}
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch invoice"})
+	}
+	return &inv, nil
+}
+
+func (s *Server) getInvoice(c echo.Context) error {
+	inv, err := s.findInvoice(c)
+	if inv == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, inv)
+}
+
+// issueInvoice issues a draft in three steps: it claims the draft, numbers
+// it and marks its time entries billed. Claiming first means only the one
+// request that wins the draft draws a number. An invoice left issued with a
+// step missing can be issued again to finish it.
+func (s *Server) issueInvoice(c echo.Context) error {
+	inv, err := s.findInvoice(c)
+	if inv == nil {
+		return err
+	}
+	ctx := context.Background()
+	if inv.Status != invoiceDraft {
+		unbilled, err := s.timeEntryCollection.CountDocuments(ctx, bson.M{
+			"invoice_id": inv.ID, "billed_at": bson.M{"$exists": false},
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch time entries"})
+		}
+		if inv.Number != "" && unbilled == 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Invoice is already issued"})
+		}
+	}
+	now := time.Now()
+	if isDryRun(c) {
+		if inv.IssuedAt == nil {
+			inv.IssuedAt = &now
+		}
+		inv.Status = invoiceIssued
+		return c.JSON(http.StatusOK, inv)
+	}
+
+	if inv.Status == invoiceDraft {
+		result, err := s.invoiceCollection.UpdateOne(ctx, bson.M{"_id": inv.ID, "status": invoiceDraft}, bson.M{
+			"$set": bson.M{"status": invoiceIssued, "issued_at": now},
+		})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to issue invoice"})
+		}
+		if result.MatchedCount == 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Invoice is already issued"})
+		}
+		inv.Status, inv.IssuedAt = invoiceIssued, &now
+	}
+
+	if inv.Number == "" {
+		var counter struct {
+			Seq int64 `bson:"seq"`
+		}
+		err = s.counterCollection.FindOneAndUpdate(ctx, bson.M{"_id": "invoice"}, bson.M{"$inc": bson.M{"seq": 1}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&counter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invoice issued but numbering failed; issue it again to retry"})
+		}
+		number := fmt.Sprintf("INV-%06d", counter.Seq)
+		result, err := s.invoiceCollection.UpdateOne(ctx, bson.M{"_id": inv.ID, "number": bson.M{"$exists": false}}, bson.M{
+			"$set": bson.M{"number": number},
+		})
+		if err == nil && result.MatchedCount == 0 {
+			// A concurrent retry numbered it first.
+			err = s.invoiceCollection.FindOne(ctx, bson.M{"_id": inv.ID}).Decode(inv)
+		} else {
+			inv.Number = number
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invoice issued but numbering failed; issue it again to retry"})
+		}
+	}
+
+	if _, err := s.timeEntryCollection.UpdateMany(ctx, bson.M{"invoice_id": inv.ID, "billed_at": bson.M{"$exists": false}}, bson.M{
+		"$set": bson.M{"billed_at": *inv.IssuedAt},
+	}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invoice issued but marking its time entries billed failed; issue it again to retry"})
+	}
+	return c.JSON(http.StatusOK, inv)
+}
+
+// deleteInvoice discards a draft and releases its time entries. The draft
+// goes first: if releasing then fails the entries stay unbillable, which is
+// safer than a surviving draft whose entries could be billed again.
+func (s *Server) deleteInvoice(c echo.Context) error {
+	inv, err := s.findInvoice(c)
+	if inv == nil {
+		return err
+	}
+	if inv.Status != invoiceDraft {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Issued invoices cannot be deleted"})
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Invoice deleted successfully"})
+	}
+
+	ctx := context.Background()
+	result, err := s.invoiceCollection.DeleteOne(ctx, bson.M{"_id": inv.ID, "status": invoiceDraft})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete invoice"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Issued invoices cannot be deleted"})
+	}
+	if err := s.releaseTimeEntries(ctx, inv.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Invoice deleted but releasing its time entries failed"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Invoice deleted successfully"})
+}
+
+// formatMoney renders minor units as a decimal amount with two places.
+func formatMoney(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+func formatHours(minutes int) string {
+	return strconv.FormatFloat(float64(minutes)/60, 'f', 2, 64)
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Funcs(template.FuncMap{
+	"money": formatMoney,
+	"hours": formatHours,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Invoice {{if .Number}}{{.Number}}{{else}}draft{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: left; }
+td.num, th.num { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Invoice {{if .Number}}{{.Number}}{{else}}(draft){{end}}</h1>
+<p>Project: {{.Project}}<br>Period: {{.From}} to {{.To}}{{if .IssuedAt}}<br>Issued: {{.IssuedAt.Format "2006-01-02"}}{{end}}</p>
+<table>
+<tr><th>Date</th><th>User</th><th>Task</th><th>Note</th><th class="num">Hours</th><th class="num">Rate</th><th class="num">Amount</th></tr>
+{{- range .Lines}}
+<tr><td>{{.Date}}</td><td>{{.User}}</td><td>{{.TaskTitle}}</td><td>{{.Note}}</td><td class="num">{{hours .Minutes}}</td><td class="num">{{money .HourlyRate}}</td><td class="num">{{money .Amount}}</td></tr>
+{{- end}}
+<tr><th colspan="4">Total</th><th class="num">{{hours .TotalMinutes}}</th><th></th><th class="num">{{money .Total}} {{.Currency}}</th></tr>
+</table>
+</body>
+</html>
+`))
+
+// csvText keeps a text cell from being read as a formula by spreadsheets,
+// by quoting values that start like one.
+func csvText(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// exportInvoice downloads an invoice as CSV (?format=csv) or HTML.
+func (s *Server) exportInvoice(c echo.Context) error {
+	inv, err := s.findInvoice(c)
+	if inv == nil {
+		return err
+	}
+	name := "invoice-" + inv.ID.Hex()
+	if inv.Number != "" {
+		name = "invoice-" + inv.Number
+	}
+
+	switch c.QueryParam("format") {
+	case "csv":
+		c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+name+`.csv"`)
+		w := csv.NewWriter(c.Response())
+		w.Write([]string{"date", "user", "task_id", "task", "note", "hours", "hourly_rate", "amount", "currency"})
+		for _, l := range inv.Lines {
+			w.Write([]string{csvText(l.Date), csvText(l.User), csvText(string(l.TaskID)), csvText(l.TaskTitle),
+				csvText(l.Note), formatHours(l.Minutes), formatMoney(l.HourlyRate), formatMoney(l.Amount), csvText(inv.Currency)})
+		}
+		w.Write([]string{"", "", "", "Total", "", formatHours(inv.TotalMinutes), "", formatMoney(inv.Total), inv.Currency})
+		w.Flush()
+		return w.Error()
+	case "", "html":
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+		c.Response().Header().Set(echo.HeaderContentDisposition, `inline; filename="`+name+`.html"`)
+		return invoiceTemplate.Execute(c.Response(), inv)
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": "format must be csv or html"})
+}
@@ -0,0 +1,121 @@
+package taskapi
+
+import "testing"
+
+func TestCSVText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"Fix login", "Fix login"},
+		{"=HYPERLINK(\"http://evil\")", "'=HYPERLINK(\"http://evil\")"},
+		{"+1+2", "'+1+2"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"a=1", "a=1"},
+	}
+	for _, tt := range tests {
+		if got := csvText(tt.in); got != tt.want {
+			t.Errorf("csvText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func testRates() rateTable {
+	return rateTable{
+		{"", ""}:         {HourlyRate: 10000, Currency: "EUR"},
+		{"web", ""}:      {HourlyRate: 12000, Currency: "EUR"},
+		{"", "ann"}:      {HourlyRate: 9000, Currency: "EUR"},
+		{"web", "ann"}:   {HourlyRate: 15000, Currency: "EUR"},
+		{"mobile", "bo"}: {HourlyRate: 20000, Currency: "USD"},
+	}
+}
+
+func TestRateLookup(t *testing.T) {
+	tests := []struct {
+		project, user string
+		want          int64
+	}{
+		// The most specific rate wins: user on project, project, user,
+		// then the default.
+		{"web", "ann", 15000},
+		{"web", "bo", 12000},
+		{"ops", "ann", 9000},
+		{"ops", "bo", 10000},
+		{"mobile", "bo", 20000},
+	}
+	for _, tt := range tests {
+		r, ok := testRates().lookup(tt.project, tt.user)
+		if !ok || r.HourlyRate != tt.want {
+			t.Errorf("lookup(%q, %q) = %d, %v; want %d", tt.project, tt.user, r.HourlyRate, ok, tt.want)
+		}
+	}
+	if _, ok := (rateTable{{"web", ""}: {HourlyRate: 1}}).lookup("ops", "ann"); ok {
+		t.Error("lookup found a rate without a default")
+	}
+}
+
+func TestFillInvoice(t *testing.T) {
+	entries := []TimeEntry{
+		{TaskID: "t1", Project: "web", User: "ann", Date: "2024-05-06", Minutes: 90, Note: "Login"},
+		{TaskID: "t2", Project: "web", User: "bo", Date: "2024-05-07", Minutes: 20},
+		// 7 minutes at 100.00 is 11.666…, which rounds up.
+		{TaskID: "t2", Project: "ops", User: "bo", Date: "2024-05-07", Minutes: 7},
+	}
+	inv := &Invoice{}
+	if msg := fillInvoice(inv, entries, testRates(), map[TaskID]string{"t1": "Fix login"}); msg != "" {
+		t.Fatal(msg)
+	}
+	wantAmounts := []int64{22500, 4000, 1167}
+	if len(inv.Lines) != len(wantAmounts) {
+		t.Fatalf("%d lines, want %d", len(inv.Lines), len(wantAmounts))
+	}
+	for i, want := range wantAmounts {
+		if got := inv.Lines[i].Amount; got != want {
+			t.Errorf("line %d amount = %d, want %d", i, got, want)
+		}
+	}
+	if l := inv.Lines[0]; l.TaskTitle != "Fix login" || l.HourlyRate != 15000 || l.Note != "Login" || l.Date != "2024-05-06" {
+		t.Errorf("line 0 = %+v", l)
+	}
+	if inv.Lines[1].TaskTitle != "" {
+		t.Errorf("line 1 title %q, want none for an unknown task", inv.Lines[1].TaskTitle)
+	}
+	if inv.TotalMinutes != 117 || inv.Total != 27667 || inv.Currency != "EUR" {
+		t.Errorf("totals %d min, %d %s; want 117 min, 27667 EUR", inv.TotalMinutes, inv.Total, inv.Currency)
+	}
+
+	// Filling again starts over.
+	if msg := fillInvoice(inv, entries[:1], testRates(), nil); msg != "" || inv.Total != 22500 || len(inv.Lines) != 1 {
+		t.Errorf("refilled invoice: %q, total %d, %d lines", msg, inv.Total, len(inv.Lines))
+	}
+
+	mixed := append(entries[:1:1], TimeEntry{Project: "mobile", User: "bo", Minutes: 60})
+	if msg := fillInvoice(&Invoice{}, mixed, testRates(), nil); msg != "Billing rates for this period use different currencies" {
+		t.Errorf("mixed currencies: %q", msg)
+	}
+	noRate := []TimeEntry{{Project: "web", User: "ann", Minutes: 60}}
+	if msg := fillInvoice(&Invoice{}, noRate, rateTable{}, nil); msg != "No billing rate for ann on project web" {
+		t.Errorf("missing rate: %q", msg)
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{27667, "276.67"},
+		{-1050, "-10.50"},
+	}
+	for _, tt := range tests {
+		if got := formatMoney(tt.in); got != tt.want {
+			t.Errorf("formatMoney(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := formatHours(117); got != "1.95" {
+		t.Errorf("formatHours(117) = %q, want 1.95", got)
+	}
+}
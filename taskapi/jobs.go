@@ -0,0 +1,1047 @@
+package taskapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// A running job holds a lease that its worker renews on a timer. If the
+// process dies, the lease runs out and any worker picks the job up again, so
+// jobs survive restarts. Job handlers must therefore be safe to re-run. Each
+// claim gets its own lease token, and progress and outcome are only recorded
+// under it, so a worker that lost its lease cannot overwrite the new one's.
+const (
+	jobLease        = time.Minute
+	jobLeaseRenewal = jobLease / 3
+	jobPollInterval = 2 * time.Second
+	jobBatchSize    = 500
+	maxJobAttempts  = 3
+
+	// Export files are removed this long after they were written.
+	jobResultRetention = 7 * 24 * time.Hour
+
+	defaultImportLimit = 100 << 20
+)
+
+type JobProgress struct {
+	Done  int64 `bson:"done" json:"done"`
+	Total int64 `bson:"total" json:"total"`
+}
+
+type Job struct {
+	ID              primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Kind            string                 `bson:"kind" json:"kind"`
+	Owner           string                 `bson:"owner,omitempty" json:"owner,omitempty"`
+	Status          string                 `bson:"status" json:"status"`
+	Params          map[string]interface{} `bson:"params,omitempty" json:"params,omitempty"`
+	Progress        JobProgress            `bson:"progress" json:"progress"`
+	Result          map[string]interface{} `bson:"result,omitempty" json:"result,omitempty"`
+	Error           string                 `bson:"error,omitempty" json:"error,omitempty"`
+	CancelRequested bool                   `bson:"cancel_requested,omitempty" json:"cancel_requested,omitempty"`
+	Attempts        int                    `bson:"attempts" json:"attempts"`
+	Lease           string                 `bson:"lease,omitempty" json:"-"`
+	LeaseUntil      *time.Time             `bson:"lease_until,omitempty" json:"-"`
+	CreatedAt       time.Time              `bson:"created_at" json:"created_at"`
+	StartedAt       *time.Time             `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	FinishedAt      *time.Time             `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+// jobFunc runs a job. It reports progress through report, which fails once
+// the job has been cancelled, and returns the job result.
+type jobFunc func(s *Server, ctx context.Context, job *Job, report func(done, total int64) error) (map[string]interface{}, error)
+
+var jobHandlers = map[string]jobFunc{
+	"export":      (*Server).runExportJob,
+	"import":      (*Server).runImportJob,
+	"bulk_update": (*Server).runBulkUpdateJob,
+}
+
+var (
+	errJobCancelled = errors.New("job cancelled")
+	errJobLeaseLost = errors.New("job lease lost")
+)
+
+func newJob(kind, owner string, params map[string]interface{}) *Job {
+	return &Job{
+		ID:        primitive.NewObjectID(),
+		Kind:      kind,
+		Owner:     owner,
+		Status:    jobQueued,
+		Params:    params,
+		CreatedAt: time.Now(),
+	}
+}
+
+func (s *Server) enqueueJob(ctx context.Context, kind, owner string, params map[string]interface{}) (*Job, error) {
+	job := newJob(kind, owner, params)
+	if _, err := s.jobCollection.InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func acceptJob(c echo.Context, job *Job) error {
+	c.Response().Header().Set(echo.HeaderLocation, "/jobs/"+job.ID.Hex())
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// claimJob takes the oldest queued job, or a running job whose lease has
+// expired because its worker went away, under a new lease token.
+func (s *Server) claimJob(ctx context.Context) (*Job, error) {
+	now := time.Now()
+	lease := now.Add(jobLease)
+	token := primitive.NewObjectID().Hex()
+	var job Job
+	err := s.jobCollection.FindOneAndUpdate(ctx,
+		bson.M{"$or": []bson.M{
+			{"status": jobQueued},
+			{"status": jobRunning, "lease_until": bson.M{"$lt": now}},
+		}},
+		bson.M{
+			"$set": bson.M{"status": jobRunning, "lease": token, "lease_until": lease, "started_at": now},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// finishJob records the outcome of job, failing with errJobLeaseLost if
+// another worker has claimed it since.
+func (s *Server) finishJob(ctx context.Context, job *Job, status string, result map[string]interface{}, errMsg string) error {
+	now := time.Now()
+	set := bson.M{"status": status, "finished_at": now}
+	if result != nil {
+		set["result"] = result
+	}
+	if errMsg != "" {
+		set["error"] = errMsg
+	}
+	res, err := s.jobCollection.UpdateOne(ctx, bson.M{"_id": job.ID, "lease": job.Lease}, bson.M{
+		"$set":   set,
+		"$unset": bson.M{"lease": "", "lease_until": ""},
+	})
+	if err == nil && res.MatchedCount == 0 {
+		err = errJobLeaseLost
+	}
+	return err
+}
+
+// requeueJob hands job, interrupted by shutdown, back to the queue. The
+// interruption does not count as an attempt.
+func (s *Server) requeueJob(ctx context.Context, job *Job) error {
+	res, err := s.jobCollection.UpdateOne(ctx, bson.M{"_id": job.ID, "lease": job.Lease}, bson.M{
+		"$set":   bson.M{"status": jobQueued},
+		"$unset": bson.M{"lease": "", "lease_until": ""},
+		"$inc":   bson.M{"attempts": -1},
+	})
+	if err == nil && res.MatchedCount == 0 {
+		err = errJobLeaseLost
+	}
+	return err
+}
+
+// keepLease renews the lease of job every jobLeaseRenewal until ctx ends, so
+// a handler busy with one slow step does not lose it. It calls cancel when
+// the lease has gone to another worker or cancellation was requested
+// through another instance.
+func (s *Server) keepLease(ctx context.Context, job *Job, cancel context.CancelFunc) {
+	ticker := time.NewTicker(jobLeaseRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var current Job
+		err := s.jobCollection.FindOneAndUpdate(ctx, bson.M{"_id": job.ID, "lease": job.Lease}, bson.M{
+			"$set": bson.M{"lease_until": time.Now().Add(jobLease)},
+		}).Decode(&current)
+		switch {
+		case err == mongo.ErrNoDocuments:
+			s.logger.Errorf("Job %s (%s) lost its lease; stopping", job.ID.Hex(), job.Kind)
+			cancel()
+			return
+		case err != nil:
+			// The lease outlasts a few renewals, so the next tick can still
+			// save it.
+			if ctx.Err() == nil {
+				s.logger.Errorf("Failed to renew lease of job %s: %v", job.ID.Hex(), err)
+			}
+		case current.CancelRequested:
+			cancel()
+			return
+		}
+	}
+}
+
+// runJob runs job until it ends or stopping is cancelled, in which case the
+// job goes back to the queue for the next worker.
+func (s *Server) runJob(stopping context.Context, job *Job) {
+	ctx, cancel := context.WithCancel(stopping)
+	defer cancel()
+	s.runningJobsMu.Lock()
+	s.runningJobs[job.ID] = cancel
+	s.runningJobsMu.Unlock()
+	defer func() {
+		s.runningJobsMu.Lock()
+		delete(s.runningJobs, job.ID)
+		s.runningJobsMu.Unlock()
+	}()
+
+	if job.CancelRequested {
+		s.finishJob(context.Background(), job, jobCancelled, nil, "")
+		return
+	}
+	handler, ok := jobHandlers[job.Kind]
+	if !ok {
+		s.finishJob(context.Background(), job, jobFailed, nil, "unknown job kind "+job.Kind)
+		return
+	}
+	if job.Attempts > maxJobAttempts {
+		s.finishJob(context.Background(), job, jobFailed, nil, "gave up after repeated interruptions")
+		return
+	}
+
+	go s.keepLease(ctx, job, cancel)
+
+	// report records progress and picks up cancellation requested through
+	// another instance.
+	report := func(done, total int64) error {
+		var current Job
+		err := s.jobCollection.FindOneAndUpdate(ctx, bson.M{"_id": job.ID, "lease": job.Lease}, bson.M{"$set": bson.M{
+			"progress": JobProgress{Done: done, Total: total},
+		}}).Decode(&current)
+		if err == mongo.ErrNoDocuments {
+			cancel()
+			return errJobLeaseLost
+		}
+		if err != nil {
+			return err
+		}
+		if current.CancelRequested {
+			cancel()
+			return errJobCancelled
+		}
+		return ctx.Err()
+	}
+
+	result, err := handler(s, ctx, job, report)
+	switch {
+	case errors.Is(err, errJobLeaseLost):
+		// The worker that holds the lease now records the outcome.
+	case err != nil && stopping.Err() != nil:
+		err = s.requeueJob(context.Background(), job)
+	case err == nil:
+		err = s.finishJob(context.Background(), job, jobSucceeded, result, "")
+	case errors.Is(err, errJobCancelled) || errors.Is(err, context.Canceled):
+		err = s.finishJob(context.Background(), job, jobCancelled, result, "")
+	default:
+		s.logger.Errorf("Job %s (%s) failed: %v", job.ID.Hex(), job.Kind, err)
+		err = s.finishJob(context.Background(), job, jobFailed, result, err.Error())
+	}
+	if errors.Is(err, errJobLeaseLost) {
+		s.logger.Errorf("Job %s (%s) was taken over by another worker; outcome discarded", job.ID.Hex(), job.Kind)
+	} else if err != nil {
+		s.logger.Errorf("Failed to record outcome of job %s: %v", job.ID.Hex(), err)
+	}
+}
+
+func (s *Server) startJobWorkers(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		s.goWorker(func() {
+			for ctx.Err() == nil {
+				job, err := s.claimJob(ctx)
+				if err != nil && ctx.Err() == nil {
+					s.logger.Errorf("Failed to claim job: %v", err)
+				}
+				if job == nil {
+					sleep(ctx, jobPollInterval)
+					continue
+				}
+				s.runJob(ctx, job)
+			}
+		})
+	}
+}
+
+// findJob loads the job in the path. Only its owner and admins see a job;
+// to anyone else it does not exist.
+func (s *Server) findJob(c echo.Context) (*Job, error) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var job Job
+	err = s.jobCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Job not found"})
+		}
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch job"})
+	}
+	if job.Owner != s.currentUser(c) && !s.isAdminRequest(c) {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Job not found"})
+	}
+	return &job, nil
+}
+
+func (s *Server) getJob(c echo.Context) error {
+	job, err := s.findJob(c)
+	if job == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// getAllJobs lists the caller's latest jobs, or everyone's for admins.
+func (s *Server) getAllJobs(c echo.Context) error {
+	filter := bson.M{}
+	if !s.isAdminRequest(c) {
+		if user := s.currentUser(c); user != "" {
+			filter["owner"] = user
+		} else {
+			filter["owner"] = bson.M{"$exists": false}
+		}
+	}
+	cursor, err := s.jobCollection.Find(context.Background(), filter,
+		options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(100))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch jobs"})
+	}
+	jobs := []Job{}
+	if err := cursor.All(context.Background(), &jobs); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding job data"})
+	}
+	return c.JSON(http.StatusOK, jobs)
+}
+
+// cancelJob cancels a queued job outright and asks a running one to stop at
+// its next progress report.
+func (s *Server) cancelJob(c echo.Context) error {
+	job, err := s.findJob(c)
+	if job == nil {
+		return err
+	}
+	if isDryRun(c) {
+		switch job.Status {
+		case jobQueued:
+			now := time.Now()
+			job.Status, job.CancelRequested, job.FinishedAt = jobCancelled, true, &now
+		case jobRunning:
+			job.CancelRequested = true
+		default:
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Job already finished"})
+		}
+		return c.JSON(http.StatusAccepted, job)
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	res, err := s.jobCollection.UpdateOne(ctx, bson.M{"_id": job.ID, "status": jobQueued}, bson.M{
+		"$set": bson.M{"status": jobCancelled, "cancel_requested": true, "finished_at": now},
+	})
+	if err == nil && res.ModifiedCount == 0 {
+		res, err = s.jobCollection.UpdateOne(ctx, bson.M{"_id": job.ID, "status": jobRunning}, bson.M{
+			"$set": bson.M{"cancel_requested": true},
+		})
+		if err == nil && res.ModifiedCount > 0 {
+			s.runningJobsMu.Lock()
+			if cancel, ok := s.runningJobs[job.ID]; ok {
+				cancel()
+			}
+			s.runningJobsMu.Unlock()
+		}
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to cancel job"})
+	}
+	if res.ModifiedCount == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Job already finished"})
+	}
+	job, _ = s.findJob(c)
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// getJobResult downloads the file produced by an export job. Files are
+// kept for jobResultRetention.
+func (s *Server) getJobResult(c echo.Context) error {
+	job, err := s.findJob(c)
+	if job == nil {
+		return err
+	}
+	if job.Status != jobSucceeded {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Job has not succeeded"})
+	}
+	file, _ := job.Result["file"].(string)
+	if file == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Job has no downloadable result"})
+	}
+	path := filepath.Join(s.jobDir, filepath.Base(file))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return c.JSON(http.StatusGone, map[string]string{"error": "Job result has expired"})
+	}
+	return c.Attachment(path, filepath.Base(file))
+}
+
+// startJobResultSweep removes export files older than jobResultRetention
+// from the jobs directory every hour.
+func (s *Server) startJobResultSweep(ctx context.Context) {
+	s.goWorker(func() {
+		for {
+			if err := s.sweepJobResults(time.Now().Add(-jobResultRetention)); err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Failed to remove expired job results: %v", err)
+			}
+			if !sleep(ctx, time.Hour) {
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) sweepJobResults(cutoff time.Time) error {
+	files, err := filepath.Glob(filepath.Join(s.jobDir, "export-*.ndjson"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) createExportJob(c echo.Context) error {
+	var req struct {
+		Status  string `json:"status"`
+		Project string `json:"project"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	params := map[string]interface{}{"status": req.Status, "project": req.Project}
+	if isDryRun(c) {
+		return c.JSON(http.StatusAccepted, newJob("export", s.currentUser(c), params))
+	}
+	job, err := s.enqueueJob(context.Background(), "export", s.currentUser(c), params)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create job"})
+	}
+	return acceptJob(c, job)
+}
+
+// createImportJob spools the request body, an array of tasks or NDJSON with
+// one task per line, to disk and queues it for import. Bodies over the import
+// limit are refused. Tasks that would break a WIP limit are not imported,
+// unless an admin passes ?wip_override=true.
+func (s *Server) createImportJob(c echo.Context) error {
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, s.importLimit)
+	if isDryRun(c) {
+		return s.dryRunImport(c)
+	}
+	id := primitive.NewObjectID()
+	name := "import-" + id.Hex() + ".ndjson"
+	f, err := os.Create(filepath.Join(s.jobDir, name))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store import data"})
+	}
+	w := bufio.NewWriter(f)
+	err = s.spoolImport(req.Body, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return importReadError(c, err)
+	}
+
+	job, err := s.enqueueJob(context.Background(), "import", s.currentUser(c), map[string]interface{}{
+		"input": name, "wip_override": s.allowOverride(c, "wip_override"),
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create job"})
+	}
+	return acceptJob(c, job)
+}
+
+// createBulkUpdateJob queues a field update of every task matching the
+// filter. Tasks the update would take over a WIP limit are left alone and
+// counted as blocked in the result, unless an admin passes
+// ?wip_override=true. Moving tasks out of a workflow into a project without
+// one takes ?workflow_override=true.
+func (s *Server) createBulkUpdateJob(c echo.Context) error {
+	var req struct {
+		Filter struct {
+			IDs     []string `json:"ids"`
+			Status  string   `json:"status"`
+			Project string   `json:"project"`
+		} `json:"filter"`
+		Set struct {
+			Status  string     `json:"status"`
+			Project string     `json:"project"`
+			Team    string     `json:"team"`
+			DueDate *time.Time `json:"due_date"`
+		} `json:"set"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	ids := make([]string, 0, len(req.Filter.IDs))
+	for _, id := range req.Filter.IDs {
+		taskID, err := s.parseTaskID(id)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID " + id})
+		}
+		ids = append(ids, string(taskID))
+	}
+
+	set := map[string]interface{}{}
+	if req.Set.Status != "" {
+		set["status"] = req.Set.Status
+	}
+	if req.Set.Project != "" {
+		set["project"] = req.Set.Project
+	}
+	if req.Set.Team != "" {
+		set["team"] = req.Set.Team
+	}
+	if req.Set.DueDate != nil {
+		set["due_date"] = *req.Set.DueDate
+	}
+	if len(set) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Nothing to update"})
+	}
+	params := map[string]interface{}{
+		"ids": ids, "status": req.Filter.Status, "project": req.Filter.Project, "set": set,
+		"wip_override": s.allowOverride(c, "wip_override"),
+	}
+	msg, err := s.checkBulkWorkflow(context.Background(), jobTaskFilter(params), req.Set.Project, req.Set.Status,
+		s.allowOverride(c, "workflow_override"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflow"})
+	}
+	if msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusAccepted, newJob("bulk_update", s.currentUser(c), params))
+	}
+	job, err := s.enqueueJob(context.Background(), "bulk_update", s.currentUser(c), params)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create job"})
+	}
+	return acceptJob(c, job)
+}
+
+func jobTaskFilter(params map[string]interface{}) bson.M {
+	filter := bson.M{}
+	if v, _ := params["status"].(string); v != "" {
+		filter["status"] = v
+	}
+	if v, _ := params["project"].(string); v != "" {
+		filter["project"] = v
+	}
+	// IDs are a []string in a new job and a primitive.A once stored.
+	var taskIDs []TaskID
+	switch ids := params["ids"].(type) {
+	case []string:
+		for _, id := range ids {
+			taskIDs = append(taskIDs, TaskID(id))
+		}
+	case primitive.A:
+		for _, id := range ids {
+			if s, ok := id.(string); ok {
+				taskIDs = append(taskIDs, TaskID(s))
+			}
+		}
+	}
+	if len(taskIDs) > 0 {
+		filter["_id"] = bson.M{"$in": taskIDs}
+	}
+	return filter
+}
+
+func (s *Server) runExportJob(ctx context.Context, job *Job, report func(done, total int64) error) (map[string]interface{}, error) {
+	filter := jobTaskFilter(job.Params)
+	total, err := s.taskCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := s.taskCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	name := "export-" + job.ID.Hex() + ".ndjson"
+	f, err := os.Create(filepath.Join(s.jobDir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	var done int64
+	for cursor.Next(ctx) {
+		var task Task
+		if err := cursor.Decode(&task); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(task); err != nil {
+			return nil, err
+		}
+		done++
+		if done%jobBatchSize == 0 {
+			if err := report(done, total); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := report(done, done); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"file":     name,
+		"count":    done,
+		"download": "/jobs/" + job.ID.Hex() + "/result",
+	}, nil
+}
+
+// runImportJob inserts the spooled tasks. Every spooled task carries an ID,
+// so re-running an interrupted import skips what it already did. Unless the
+// job overrides them, WIP limits are checked task by task, counting the
+// tasks imported before.
+func (s *Server) runImportJob(ctx context.Context, job *Job, report func(done, total int64) error) (map[string]interface{}, error) {
+	name, _ := job.Params["input"].(string)
+	f, err := os.Open(filepath.Join(s.jobDir, filepath.Base(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tasks, err := decodeImport(f)
+	if err != nil {
+		return nil, err
+	}
+	total := int64(len(tasks))
+	ws, err := s.loadWorkflows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	checkWIP := false
+	if override, _ := job.Params["wip_override"].(bool); !override {
+		if checkWIP, err = s.hasWIPLimits(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	var imported, skipped, blocked int64
+	var failures []string
+	for i := range tasks {
+		task := &tasks[i]
+		if msg := s.prepareImportTask(task, ws); msg != "" {
+			failures = append(failures, fmt.Sprintf("item %d: %s", i, msg))
+			continue
+		}
+		if checkWIP {
+			msg, err := s.importWIPFailure(ctx, task)
+			if err != nil {
+				return nil, err
+			}
+			if msg != "" {
+				blocked++
+				failures = append(failures, fmt.Sprintf("item %d: %s", i, msg))
+				continue
+			}
+		}
+
+		_, err := s.taskCollection.InsertOne(ctx, task)
+		switch {
+		case mongo.IsDuplicateKeyError(err):
+			skipped++
+		case err != nil:
+			return nil, err
+		default:
+			imported++
+			if err := s.indexTask(ctx, task); err != nil {
+				failures = append(failures, fmt.Sprintf("item %d: indexing failed", i))
+			}
+		}
+		if (int64(i)+1)%jobBatchSize == 0 {
+			if err := report(int64(i)+1, total); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := report(total, total); err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	if len(failures) > 100 {
+		failures = failures[:100]
+	}
+	return map[string]interface{}{"imported": imported, "skipped": skipped, "wip_blocked": blocked, "failures": failures}, nil
+}
+
+// importWIPFailure describes the WIP limit an imported task would break, if
+// any. A task that is already there is skipped rather than checked.
+func (s *Server) importWIPFailure(ctx context.Context, task *Task) (string, error) {
+	exists, err := s.taskCollection.CountDocuments(ctx, bson.M{"_id": task.ID})
+	if err != nil || exists > 0 {
+		return "", err
+	}
+	violations, err := s.checkWIPLimits(ctx, task)
+	if err != nil || len(violations) == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("WIP limit of %d tasks in status %s exceeded", violations[0].Limit, violations[0].Status), nil
+}
+
+// prepareImportTask validates one imported task against its project's
+// workflow in ws and fills in its defaults, returning a description of the
+// problem if it cannot be imported.
+func (s *Server) prepareImportTask(task *Task, ws workflowSet) string {
+	if task.Title == "" {
+		return "title is required"
+	}
+	if task.ID == "" {
+		task.ID = s.newTaskID()
+	} else if id, err := s.parseTaskID(string(task.ID)); err != nil {
+		return "invalid ID"
+	} else {
+		task.ID = id
+	}
+	wf := ws[task.Project]
+	if task.Status == "" {
+		task.Status = initialStatus(wf)
+	} else if wf != nil && wf.status(task.Status) == nil {
+		return "status " + task.Status + " is not part of the workflow of project " + task.Project
+	}
+	task.DueInDays = 0
+	task.CreatedAt = time.Now()
+	task.UpdatedAt = task.CreatedAt
+	task.startStatusHistory()
+	return ""
+}
+
+// dryRunImport validates an import body in the request instead of spooling
+// it, and answers with the job that would be queued, its result filled in
+// with what the import would do. WIP limits are checked against the tasks
+// there are now, without the ones earlier in the body.
+func (s *Server) dryRunImport(c echo.Context) error {
+	tasks, err := decodeImport(c.Request().Body)
+	if err != nil {
+		return importReadError(c, err)
+	}
+
+	ws, err := s.loadWorkflows(context.Background())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflows"})
+	}
+
+	checkWIP := false
+	if !s.allowOverride(c, "wip_override") {
+		if checkWIP, err = s.hasWIPLimits(context.Background()); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check WIP limits"})
+		}
+	}
+
+	var ids []TaskID
+	var blocked int64
+	failures := []string{}
+	for i := range tasks {
+		if msg := s.prepareImportTask(&tasks[i], ws); msg != "" {
+			failures = append(failures, fmt.Sprintf("item %d: %s", i, msg))
+			continue
+		}
+		if checkWIP {
+			msg, err := s.importWIPFailure(context.Background(), &tasks[i])
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check WIP limits"})
+			}
+			if msg != "" {
+				blocked++
+				failures = append(failures, fmt.Sprintf("item %d: %s", i, msg))
+				continue
+			}
+		}
+		ids = append(ids, tasks[i].ID)
+	}
+	skipped, err := s.taskCollection.CountDocuments(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch tasks"})
+	}
+	if len(failures) > 100 {
+		failures = failures[:100]
+	}
+
+	job := newJob("import", s.currentUser(c), map[string]interface{}{})
+	job.Progress = JobProgress{Total: int64(len(tasks))}
+	job.Result = map[string]interface{}{"imported": int64(len(ids)) - skipped, "skipped": skipped, "wip_blocked": blocked, "failures": failures}
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// importReadError answers a request whose import body could not be read.
+func importReadError(c echo.Context, err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{
+			"error": fmt.Sprintf("Import data exceeds %d bytes", tooLarge.Limit),
+		})
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+// spoolImport copies the import body in r to w as NDJSON, giving each task
+// that has no ID one now. The job then inserts every task under a fixed ID,
+// however often it runs.
+func (s *Server) spoolImport(r io.Reader, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return eachImportItem(r, func(item json.RawMessage) error {
+		var fields map[string]json.RawMessage
+		var task struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(item, &fields); err != nil || fields == nil {
+			return errors.New("invalid import data: every item must be a task object")
+		}
+		if err := json.Unmarshal(item, &task); err != nil {
+			return fmt.Errorf("invalid import data: %w", err)
+		}
+		if task.ID == "" {
+			fields["id"], _ = json.Marshal(s.newTaskID())
+		}
+		return enc.Encode(fields)
+	})
+}
+
+func decodeImport(r io.Reader) ([]Task, error) {
+	var tasks []Task
+	err := eachImportItem(r, func(item json.RawMessage) error {
+		var task Task
+		if err := json.Unmarshal(item, &task); err != nil {
+			return fmt.Errorf("invalid import data: %w", err)
+		}
+		tasks = append(tasks, task)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// eachImportItem calls fn with every item of an import body, either a JSON
+// array or NDJSON with one item per line.
+func eachImportItem(r io.Reader, fn func(json.RawMessage) error) error {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	for err == nil && (first[0] == ' ' || first[0] == '\n' || first[0] == '\r' || first[0] == '\t') {
+		br.ReadByte()
+		first, err = br.Peek(1)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(br)
+	if first[0] == '[' {
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("invalid import data: %w", err)
+		}
+		for dec.More() {
+			var item json.RawMessage
+			if err := dec.Decode(&item); err != nil {
+				return fmt.Errorf("invalid import data: %w", err)
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return fmt.Errorf("invalid import data: %w", err)
+		}
+		return nil
+	}
+	for {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("invalid import data: %w", err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// runBulkUpdateJob applies the job's field updates to every matching task, a
+// batch at a time. Re-running it is harmless since the update is a plain $set
+// and status changes are only recorded for tasks not in the status yet.
+//
+// When the update changes status or project and WIP limits exist, each task
+// it moves is checked and updated on its own, so the counts include the
+// tasks moved before it; tasks that would break a limit are skipped.
+func (s *Server) runBulkUpdateJob(ctx context.Context, job *Job, report func(done, total int64) error) (map[string]interface{}, error) {
+	filter := jobTaskFilter(job.Params)
+	set := bson.M{}
+	if fields, ok := job.Params["set"].(map[string]interface{}); ok {
+		for k, v := range fields {
+			set[k] = v
+		}
+	}
+	total, err := s.taskCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	newStatus, _ := set["status"].(string)
+	newProject, _ := set["project"].(string)
+	checkWIP := false
+	if override, _ := job.Params["wip_override"].(bool); !override && (newStatus != "" || newProject != "") {
+		if checkWIP, err = s.hasWIPLimits(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	cursor, err := s.taskCollection.Find(ctx, filter, options.Find().SetProjection(bson.M{
+		"_id": 1, "status": 1, "project": 1, "assignee": 1,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var done, modified, blocked, reported int64
+	result := func() map[string]interface{} {
+		return map[string]interface{}{"matched": done, "modified": modified, "wip_blocked": blocked}
+	}
+	batch := make([]TaskID, 0, jobBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		now := time.Now()
+		// Status changes go first so they can record the status left; the
+		// $ne keeps a re-run from recording them twice.
+		if status, ok := set["status"].(string); ok {
+			_, err := s.taskCollection.UpdateMany(ctx,
+				bson.M{"_id": bson.M{"$in": batch}, "status": bson.M{"$ne": status}},
+				statusChangePipeline(status, now))
+			if err != nil {
+				return err
+			}
+		}
+		set["updated_at"] = now
+		res, err := s.taskCollection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": batch}}, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
+		done += int64(len(batch))
+		modified += res.ModifiedCount
+		batch = batch[:0]
+		if done-reported < jobBatchSize {
+			return nil
+		}
+		reported = done
+		return report(done, total)
+	}
+	for cursor.Next(ctx) {
+		var task Task
+		if err := cursor.Decode(&task); err != nil {
+			return nil, err
+		}
+		moved := task
+		if newStatus != "" {
+			moved.Status = newStatus
+		}
+		if newProject != "" {
+			moved.Project = newProject
+		}
+		if !checkWIP || (moved.Status == task.Status && moved.Project == task.Project) {
+			batch = append(batch, task.ID)
+			if len(batch) == jobBatchSize {
+				if err := flush(); err != nil {
+					return result(), err
+				}
+			}
+			continue
+		}
+
+		// Flush first so the count includes the tasks moved so far, then
+		// move this one on its own.
+		if err := flush(); err != nil {
+			return result(), err
+		}
+		violations, err := s.checkWIPLimits(ctx, &moved)
+		if err != nil {
+			return result(), err
+		}
+		if len(violations) > 0 {
+			done++
+			blocked++
+			continue
+		}
+		batch = append(batch, task.ID)
+		if err := flush(); err != nil {
+			return result(), err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return result(), err
+	}
+	return result(), report(done, total)
+}
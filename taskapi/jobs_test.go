@@ -0,0 +1,121 @@
+package taskapi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolImport(t *testing.T) {
+	s := &Server{idStrategy: idStrategyObjectID}
+	for _, body := range []string{
+		`[{"title": "a", "id": "65f1c0c0c0c0c0c0c0c0c0c0"}, {"title": "b"}, {"title": "c", "id": ""}]`,
+		"{\"title\": \"a\", \"id\": \"65f1c0c0c0c0c0c0c0c0c0c0\"}\n{\"title\": \"b\"}\n\n{\"title\": \"c\"}\n",
+	} {
+		var spooled bytes.Buffer
+		if err := s.spoolImport(strings.NewReader(body), &spooled); err != nil {
+			t.Fatalf("spoolImport(%q) = %v", body, err)
+		}
+		first, err := decodeImport(bytes.NewReader(spooled.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := decodeImport(bytes.NewReader(spooled.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(first) != 3 {
+			t.Fatalf("spooled %d tasks, want 3", len(first))
+		}
+		if first[0].ID != "65f1c0c0c0c0c0c0c0c0c0c0" {
+			t.Errorf("given ID replaced by %q", first[0].ID)
+		}
+		for i, task := range first {
+			if task.ID == "" || task.ID != again[i].ID {
+				t.Errorf("task %d: IDs %q and %q, want the same non-empty ID", i, task.ID, again[i].ID)
+			}
+			if task.Title != string(rune('a'+i)) {
+				t.Errorf("task %d: title %q", i, task.Title)
+			}
+		}
+	}
+
+	for _, body := range []string{`[1, 2]`, `{"title": "a"} null`, `[{"title": "a"}`, `{"id": 5}`} {
+		if err := s.spoolImport(strings.NewReader(body), &bytes.Buffer{}); err == nil {
+			t.Errorf("spoolImport(%q) accepted", body)
+		}
+	}
+}
+
+func TestPrepareImportTask(t *testing.T) {
+	s := &Server{idStrategy: idStrategyObjectID}
+	ws := workflowSet{"ops": {
+		Project:       "ops",
+		Statuses:      []WorkflowStatus{{Name: "Triage", Category: categoryTodo}, {Name: "Fixed", Category: categoryDone}},
+		InitialStatus: "Triage",
+	}}
+	tests := []struct {
+		name       string
+		task       Task
+		wantStatus string
+		wantErr    bool
+	}{
+		{"no workflow", Task{Title: "a"}, "Pending", false},
+		{"any status without workflow", Task{Title: "a", Status: "Blocked"}, "Blocked", false},
+		{"initial status", Task{Title: "a", Project: "ops"}, "Triage", false},
+		{"workflow status", Task{Title: "a", Project: "ops", Status: "Fixed"}, "Fixed", false},
+		{"status outside workflow", Task{Title: "a", Project: "ops", Status: "Pending"}, "", true},
+		{"no title", Task{Project: "ops"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := tt.task
+			msg := s.prepareImportTask(&task, ws)
+			if (msg != "") != tt.wantErr {
+				t.Fatalf("prepareImportTask = %q, wantErr %v", msg, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if task.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", task.Status, tt.wantStatus)
+			}
+			if task.ID == "" || len(task.StatusHistory) != 1 {
+				t.Errorf("task not filled in: %+v", task)
+			}
+		})
+	}
+}
+
+func TestSweepJobResults(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{jobDir: dir}
+	now := time.Now()
+	files := map[string]time.Time{
+		"export-old.ndjson": now.Add(-jobResultRetention - time.Hour),
+		"export-new.ndjson": now.Add(-time.Hour),
+		"import-old.ndjson": now.Add(-jobResultRetention - time.Hour),
+		"export-old.txt":    now.Add(-jobResultRetention - time.Hour),
+	}
+	for name, mtime := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.sweepJobResults(now.Add(-jobResultRetention)); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed := os.IsNotExist(err); removed != (name == "export-old.ndjson") {
+			t.Errorf("%s removed = %v", name, removed)
+		}
+	}
+}
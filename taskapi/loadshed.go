@@ -0,0 +1,177 @@
+package taskapi
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Request priorities. Each priority may only use a share of the concurrency
+// limit, so as the limit shrinks under load the least important traffic is
+// shed first. Health checks are never shed, and neither are event streams,
+// which would otherwise hold a slot and skew the latency for their lifetime.
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+	priorityCritical
+)
+
+var priorityNames = []string{"low", "normal", "high", "critical"}
+
+var priorityShare = []float64{
+	priorityLow:      0.5,
+	priorityNormal:   0.8,
+	priorityHigh:     1.0,
+	priorityCritical: math.Inf(1),
+}
+
+// The limit adapts with AIMD once per window: it backs off multiplicatively
+// when the window's mean latency exceeds latencyTolerance times the baseline
+// latency, and grows additively while requests are queuing up against it.
+const (
+	initialLimit     = 64
+	minLimit         = 4
+	maxLimit         = 1024
+	limitWindow      = time.Second
+	latencyTolerance = 2.0
+	decreaseFactor   = 0.8
+	increaseStep     = 2
+)
+
+type loadShedder struct {
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+
+	baseline    time.Duration
+	windowStart time.Time
+	windowSum   time.Duration
+	windowCount int
+	windowPeak  int
+
+	admitted [priorityCritical + 1]int64
+	rejected [priorityCritical + 1]int64
+}
+
+// requestPriority classifies a request: writes outrank reads, and bulk reads
+// (full listings, exports, archive scans) rank lowest.
+func (s *Server) requestPriority(c echo.Context) int {
+	path := s.route(c)
+	method := c.Request().Method
+	switch {
+	case path == "/healthz", path == "/estimation-sessions/:id/events":
+		return priorityCritical
+	case path == "/tasks" && method == http.MethodGet,
+		path == "/jobs/:id/result",
+		path == "/archive/search",
+		strings.HasPrefix(path, "/admin/usage"):
+		return priorityLow
+	case method == http.MethodGet || method == http.MethodHead:
+		return priorityNormal
+	}
+	return priorityHigh
+}
+
+func (s *loadShedder) acquire(priority int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if float64(s.inflight) >= s.limit*priorityShare[priority] {
+		s.rejected[priority]++
+		return false
+	}
+	s.inflight++
+	s.admitted[priority]++
+	if s.inflight > s.windowPeak {
+		s.windowPeak = s.inflight
+	}
+	return true
+}
+
+func (s *loadShedder) release(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	s.windowSum += latency
+	s.windowCount++
+
+	now := time.Now()
+	if now.Sub(s.windowStart) < limitWindow || s.windowCount == 0 {
+		return
+	}
+	mean := s.windowSum / time.Duration(s.windowCount)
+	switch {
+	case s.baseline == 0:
+	case float64(mean) > float64(s.baseline)*latencyTolerance:
+		s.limit = math.Max(minLimit, s.limit*decreaseFactor)
+	case float64(s.windowPeak) >= s.limit*priorityShare[priorityNormal]:
+		s.limit = math.Min(maxLimit, s.limit+increaseStep)
+	}
+	// The baseline drops at once and rises slowly, whatever the limit did,
+	// so latency that stays higher for good (more data, slower disks)
+	// becomes the new normal instead of pinning the limit at its minimum.
+	if s.baseline == 0 || mean < s.baseline {
+		s.baseline = mean
+	} else {
+		s.baseline = (s.baseline*19 + mean) / 20
+	}
+	s.windowStart, s.windowSum, s.windowCount, s.windowPeak = now, 0, 0, s.inflight
+}
+
+// loadShedMiddleware rejects requests with 503 as soon as their priority's
+// share of the concurrency limit is used up, rather than letting every
+// request queue on Mongo.
+func (s *Server) loadShedMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		priority := s.requestPriority(c)
+		if priority == priorityCritical {
+			return next(c)
+		}
+		if !s.shedder.acquire(priority) {
+			c.Response().Header().Set("Retry-After", "1")
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Server is overloaded, retry later"})
+		}
+		start := time.Now()
+		defer func() { s.shedder.release(time.Since(start)) }()
+		return next(c)
+	}
+}
+
+func (s *Server) getLoadShedStats(c echo.Context) error {
+	s.shedder.mu.Lock()
+	defer s.shedder.mu.Unlock()
+
+	priorities := map[string]interface{}{}
+	for p, name := range priorityNames {
+		if p == priorityCritical {
+			continue
+		}
+		priorities[name] = map[string]interface{}{
+			"admitted": s.shedder.admitted[p],
+			"rejected": s.shedder.rejected[p],
+			"capacity": int(s.shedder.limit * priorityShare[p]),
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"limit":               int(s.shedder.limit),
+		"inflight":            s.shedder.inflight,
+		"baseline_latency_ms": float64(s.shedder.baseline.Microseconds()) / 1000,
+		"priorities":          priorities,
+	})
+}
+
+// healthCheck reports whether the database is reachable, and how many task
+// events were dropped because the notifier fell behind.
+func (s *Server) healthCheck(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.taskCollection.Database().Client().Ping(ctx, nil); err != nil {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": "Database unreachable"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"status": "ok", "dropped_events": s.droppedEvents.Load()})
+}
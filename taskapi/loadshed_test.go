@@ -0,0 +1,40 @@
+package taskapi
+
+import (
+	"testing"
+	"time"
+)
+
+// closeWindow feeds one request of the given latency and ends the window.
+func closeWindow(s *loadShedder, latency time.Duration) {
+	s.acquire(priorityHigh)
+	s.windowStart = time.Now().Add(-limitWindow)
+	s.release(latency)
+}
+
+func TestLoadShedderBaselineFollowsLastingLatency(t *testing.T) {
+	s := &loadShedder{limit: initialLimit, windowStart: time.Now()}
+	closeWindow(s, 10*time.Millisecond)
+	if s.baseline != 10*time.Millisecond {
+		t.Fatalf("baseline = %s, want 10ms", s.baseline)
+	}
+
+	// Latency jumps to five times the baseline and stays there. The limit
+	// backs off at first, but the baseline catches up and it stops.
+	for i := 0; i < 100; i++ {
+		closeWindow(s, 50*time.Millisecond)
+	}
+	if s.baseline < 25*time.Millisecond {
+		t.Errorf("baseline = %s after lasting 50ms latency, want it to follow", s.baseline)
+	}
+	limit := s.limit
+	closeWindow(s, 50*time.Millisecond)
+	if s.limit < limit {
+		t.Errorf("limit still shrinking (%v -> %v) at the new normal latency", limit, s.limit)
+	}
+
+	closeWindow(s, 5*time.Millisecond)
+	if s.baseline != 5*time.Millisecond {
+		t.Errorf("baseline = %s, want to drop to 5ms at once", s.baseline)
+	}
+}
@@ -0,0 +1,363 @@
+package taskapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mqttConn is a minimal MQTT 3.1.1 client: it connects, subscribes, receives
+// QoS 0/1 messages and publishes at QoS 1, which is all the bridge needs.
+// Received QoS 1 messages are acknowledged only after the handler succeeds,
+// so with a persistent session the broker redelivers anything the server did
+// not get to handle.
+type mqttConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	keepAlive time.Duration
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan byte // packet ID -> SUBACK code or 0 for PUBACK
+	closed  chan struct{}
+	err     error
+}
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+	mqttMaxPacket  = 1 << 20
+	mqttAckTimeout = 30 * time.Second
+)
+
+type mqttConnectOptions struct {
+	clientID     string
+	username     string
+	password     string
+	cleanSession bool
+	keepAlive    time.Duration
+}
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttHandshake sends CONNECT on conn and waits for the broker's CONNACK.
+func mqttHandshake(conn net.Conn, opts mqttConnectOptions) (*mqttConn, error) {
+	var flags byte
+	var payload []byte
+	payload = appendMQTTString(payload, opts.clientID)
+	if opts.username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, opts.username)
+		if opts.password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, opts.password)
+		}
+	}
+	if opts.cleanSession {
+		flags |= 0x02
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.keepAlive/time.Second))
+	body = append(body, payload...)
+
+	c := &mqttConn{
+		conn:      conn,
+		r:         bufio.NewReader(conn),
+		keepAlive: opts.keepAlive,
+		pending:   map[uint16]chan byte{},
+		closed:    make(chan struct{}),
+	}
+	conn.SetDeadline(time.Now().Add(mqttAckTimeout))
+	if err := c.writePacket(mqttConnect<<4, body); err != nil {
+		return nil, err
+	}
+	kind, ack, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if kind>>4 != mqttConnack || len(ack) != 2 {
+		return nil, errors.New("mqtt: expected CONNACK")
+	}
+	if ack[1] != 0 {
+		msg, ok := connackErrors[ack[1]]
+		if !ok {
+			msg = fmt.Sprintf("code %d", ack[1])
+		}
+		return nil, errors.New("mqtt: connection refused: " + msg)
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("mqtt: short packet")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("mqtt: short packet")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func (c *mqttConn) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *mqttConn) readPacket() (byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		mult *= 128
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("mqtt: packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// run reads packets until the connection fails or is closed, passing
+// messages to handle, and sends keep-alive pings meanwhile. When handle
+// fails the connection is dropped without acknowledging the message: MQTT
+// 3.1.1 brokers redeliver unacknowledged messages only on reconnect.
+func (c *mqttConn) run(handle func(topic string, payload []byte) error) error {
+	go c.pinger()
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+		header, body, err := c.readPacket()
+		if err != nil {
+			c.close(err)
+			return err
+		}
+		switch header >> 4 {
+		case mqttPublish:
+			qos := (header >> 1) & 0x03
+			topic, rest, err := readMQTTString(body)
+			if err != nil {
+				c.close(err)
+				return err
+			}
+			var id uint16
+			if qos > 0 {
+				if len(rest) < 2 {
+					c.close(errors.New("mqtt: short packet"))
+					return c.err
+				}
+				id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+			}
+			if err := handle(topic, rest); err != nil {
+				c.close(err)
+				return err
+			}
+			if qos > 0 {
+				if err := c.writePacket(mqttPuback<<4, binary.BigEndian.AppendUint16(nil, id)); err != nil {
+					c.close(err)
+					return err
+				}
+			}
+		case mqttPuback, mqttSuback:
+			if len(body) < 2 {
+				continue
+			}
+			id := binary.BigEndian.Uint16(body)
+			var code byte
+			if header>>4 == mqttSuback && len(body) > 2 {
+				code = body[2]
+			}
+			c.mu.Lock()
+			ch := c.pending[id]
+			delete(c.pending, id)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- code
+			}
+		}
+	}
+}
+
+func (c *mqttConn) pinger() {
+	if c.keepAlive <= 0 {
+		return
+	}
+	t := time.NewTicker(c.keepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-t.C:
+			if err := c.writePacket(mqttPingreq<<4, nil); err != nil {
+				c.close(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *mqttConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	c.err = err
+	close(c.closed)
+	c.conn.Close()
+}
+
+// disconnect ends the session cleanly.
+func (c *mqttConn) disconnect() {
+	c.writePacket(mqttDisconnect<<4, nil)
+	c.close(errors.New("mqtt: disconnected"))
+}
+
+// await sends a packet that the broker acknowledges with the given packet
+// ID and waits for the acknowledgement.
+func (c *mqttConn) await(ctx context.Context, header byte, build func(id uint16) []byte) (byte, error) {
+	c.mu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	ch := make(chan byte, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.writePacket(header, build(id)); err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, mqttAckTimeout)
+	defer cancel()
+	select {
+	case code := <-ch:
+		return code, nil
+	case <-c.closed:
+		return 0, c.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// subscribe subscribes to filter at QoS 1. It must be called while run is
+// reading, which delivers the SUBACK.
+func (c *mqttConn) subscribe(ctx context.Context, filter string) error {
+	code, err := c.await(ctx, mqttSubscribe<<4|0x02, func(id uint16) []byte {
+		b := binary.BigEndian.AppendUint16(nil, id)
+		b = appendMQTTString(b, filter)
+		return append(b, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if code == 0x80 {
+		return fmt.Errorf("mqtt: subscription to %q refused", filter)
+	}
+	return nil
+}
+
+// publish sends a QoS 1 message and waits for the broker's PUBACK.
+func (c *mqttConn) publish(ctx context.Context, topic string, payload []byte, retain bool) error {
+	header := byte(mqttPublish<<4 | 0x02)
+	if retain {
+		header |= 0x01
+	}
+	_, err := c.await(ctx, header, func(id uint16) []byte {
+		b := appendMQTTString(nil, topic)
+		b = binary.BigEndian.AppendUint16(b, id)
+		return append(b, payload...)
+	})
+	return err
+}
+
+// mqttTopicMatch reports whether topic matches filter, with "+" matching one
+// level and a trailing "#" any number of levels.
+func mqttTopicMatch(filter, topic string) bool {
+	for {
+		fl, frest, fmore := strings.Cut(filter, "/")
+		if fl == "#" {
+			return true
+		}
+		tl, trest, tmore := strings.Cut(topic, "/")
+		if fl != "+" && fl != tl {
+			return false
+		}
+		if !fmore || !tmore {
+			return !fmore && !tmore || (fmore && frest == "#")
+		}
+		filter, topic = frest, trest
+	}
+}
@@ -0,0 +1,217 @@
+package taskapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+func TestMQTTTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"+", "a", true},
+		{"+", "a/b", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b/c", true},
+		{"a/+/#", "a/b", true},
+		{"a//b", "a//b", true},
+		{"a/+/b", "a//b", true},
+	}
+	for _, tt := range tests {
+		if got := mqttTopicMatch(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("mqttTopicMatch(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+// testBroker is the broker's end of a piped MQTT connection.
+type testBroker struct {
+	t *testing.T
+	c *mqttConn
+}
+
+func newTestBroker(t *testing.T, conn net.Conn) *testBroker {
+	return &testBroker{t: t, c: &mqttConn{conn: conn, r: bufio.NewReader(conn)}}
+}
+
+// expect reads the next packet, which must be of the given type.
+func (b *testBroker) expect(kind byte) (byte, []byte) {
+	b.t.Helper()
+	b.c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, body, err := b.c.readPacket()
+	if err != nil {
+		b.t.Fatalf("reading packet %d: %v", kind, err)
+	}
+	if header>>4 != kind {
+		b.t.Fatalf("got packet %d, want %d", header>>4, kind)
+	}
+	return header, body
+}
+
+func (b *testBroker) send(header byte, body []byte) {
+	b.t.Helper()
+	if err := b.c.writePacket(header, body); err != nil {
+		b.t.Fatal(err)
+	}
+}
+
+// publish sends a QoS 1 message with the given packet ID.
+func (b *testBroker) publish(id uint16, topic, payload string) {
+	b.t.Helper()
+	body := binary.BigEndian.AppendUint16(appendMQTTString(nil, topic), id)
+	b.send(mqttPublish<<4|0x02, append(body, payload...))
+}
+
+func (b *testBroker) expectPuback(id uint16) {
+	b.t.Helper()
+	if _, body := b.expect(mqttPuback); len(body) != 2 || binary.BigEndian.Uint16(body) != id {
+		b.t.Fatalf("PUBACK %v, want packet ID %d", body, id)
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	client, server := net.Pipe()
+	dialed := false
+	s := &Server{logger: log.New("test")}
+	err := WithMQTT(MQTTConfig{
+		Broker: "broker:1883",
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if dialed {
+				return nil, errors.New("already dialed")
+			}
+			dialed = true
+			return client, nil
+		},
+		Mappings: []MQTTMapping{{
+			Topic:  "devices/+/faults",
+			Device: "{{index .Levels 1}}",
+			Fault:  "{{.Payload.code}}",
+			Title:  "Fault",
+		}},
+		StatusTopic: "devices/{{.Device}}/tasks/{{.Fault}}",
+	})(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.startMQTTBridge(ctx)
+
+	broker := newTestBroker(t, server)
+	_, connect := broker.expect(mqttConnect)
+	if clientID, _, _ := readMQTTString(connect[10:]); clientID != "taskapi" {
+		t.Errorf("client ID %q", clientID)
+	}
+	if connect[7]&0x02 != 0 {
+		t.Error("connected with a clean session")
+	}
+	broker.send(mqttConnack<<4, []byte{0, 0})
+
+	header, sub := broker.expect(mqttSubscribe)
+	if header&0x0f != 0x02 {
+		t.Errorf("SUBSCRIBE flags %#x", header&0x0f)
+	}
+	if filter, _, _ := readMQTTString(sub[2:]); filter != "devices/+/faults" {
+		t.Errorf("subscribed to %q", filter)
+	}
+	broker.send(mqttSuback<<4, append(sub[:2:2], 1))
+
+	// Messages that cannot become tasks are acknowledged all the same.
+	broker.publish(7, "other/topic", `{"code": "E1"}`)
+	broker.expectPuback(7)
+	broker.publish(8, "devices/d1/faults", `{}`)
+	broker.expectPuback(8)
+	s.mqtt.mu.Lock()
+	unmatched, invalid := s.mqtt.stats["unmatched"], s.mqtt.stats["invalid"]
+	s.mqtt.mu.Unlock()
+	if unmatched != 1 || invalid != 1 {
+		t.Errorf("unmatched %d, invalid %d, want 1 each", unmatched, invalid)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		s.mqtt.mu.Lock()
+		connected := s.mqtt.conn != nil
+		s.mqtt.mu.Unlock()
+		if connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bridge did not connect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	task := Task{ID: "t1", Title: "Fault", Status: "Done", ExternalSource: mqttSource, ExternalID: "d1/E1"}
+	s.publishMQTTStatus(taskEvent{Type: eventStatusChanged, Task: task, At: time.Now()})
+	s.publishMQTTStatus(taskEvent{Type: eventDeleted, Task: task, At: time.Now()})
+	for i, wantStatus := range []string{"Done", ""} {
+		header, body := broker.expect(mqttPublish)
+		if header&0x0f != 0x03 {
+			t.Errorf("status %d: PUBLISH flags %#x, want QoS 1 and retain", i, header&0x0f)
+		}
+		topic, rest, err := readMQTTString(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if topic != "devices/d1/tasks/E1" {
+			t.Errorf("status %d: topic %q", i, topic)
+		}
+		id, payload := binary.BigEndian.Uint16(rest), rest[2:]
+		if wantStatus == "" {
+			if len(payload) != 0 {
+				t.Errorf("deleted task published %q, want an empty payload", payload)
+			}
+		} else {
+			var status struct{ Status string }
+			if err := json.Unmarshal(payload, &status); err != nil || status.Status != wantStatus {
+				t.Errorf("status %d: payload %s", i, payload)
+			}
+		}
+		broker.send(mqttPuback<<4, binary.BigEndian.AppendUint16(nil, id))
+	}
+
+	cancel()
+	broker.expect(mqttDisconnect)
+	s.workers.Wait()
+}
+
+func TestMQTTConnHandlerError(t *testing.T) {
+	client, server := net.Pipe()
+	c := &mqttConn{conn: client, r: bufio.NewReader(client), pending: map[uint16]chan byte{}, closed: make(chan struct{})}
+	failed := errors.New("database unavailable")
+	done := make(chan error, 1)
+	go func() {
+		done <- c.run(func(topic string, payload []byte) error { return failed })
+	}()
+
+	broker := newTestBroker(t, server)
+	broker.publish(9, "devices/d1/faults", `{"code": "E1"}`)
+	// The message must not be acknowledged, so the connection closes
+	// instead.
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if header, _, err := broker.c.readPacket(); err == nil {
+		t.Fatalf("got packet %d, want the connection closed", header>>4)
+	}
+	if err := <-done; !errors.Is(err, failed) {
+		t.Errorf("run = %v, want %v", err, failed)
+	}
+}
@@ -0,0 +1,471 @@
+package taskapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mqttSource is the external source of tasks opened by the MQTT bridge. The
+// external ID is "<device>/<fault>", so a fault that keeps being reported
+// maps to one task.
+const mqttSource = "mqtt"
+
+const (
+	mqttKeepAlive      = 60 * time.Second
+	mqttMaxBackoff     = time.Minute
+	mqttPublishTimeout = 10 * time.Second
+	// mqttStatusQueue bounds the status updates waiting to be published.
+	mqttStatusQueue = 1000
+)
+
+// errInvalidMQTTMessage marks messages that can never be turned into a task.
+// They are acknowledged, since redelivering them would not help.
+var errInvalidMQTTMessage = errors.New("invalid message")
+
+// MQTTConfig configures the MQTT bridge, which opens tasks from messages
+// published by devices and can report their status back.
+type MQTTConfig struct {
+	// Broker is the broker's host:port.
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// CleanSession discards the broker's session on connect. By default the
+	// session persists, so messages sent while the server was down are
+	// delivered when it reconnects.
+	CleanSession bool `json:"clean_session"`
+	// Dial opens the connection to the broker, e.g. with TLS or to an
+	// in-process broker. It defaults to a plain TCP dial.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+
+	Mappings []MQTTMapping `json:"mappings"`
+	// StatusTopic, when set, is a template for the topic task status changes
+	// are published to, e.g. "facilities/{{.Device}}/tasks/{{.Fault}}".
+	// Messages are retained, so a device sees the latest status on connect;
+	// deleting a task clears its retained message.
+	StatusTopic string `json:"status_topic"`
+}
+
+// MQTTMapping turns messages on topics matching Topic ("+" and "#"
+// wildcards) into tasks. Device, Fault, Title and Description are
+// text/template templates over the message: .Topic, .Levels (the topic split
+// on "/"), .Payload (the decoded JSON payload, if it is JSON) and .Raw.
+type MQTTMapping struct {
+	Topic       string   `json:"topic"`
+	Device      string   `json:"device"`
+	Fault       string   `json:"fault"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Project     string   `json:"project"`
+	Team        string   `json:"team"`
+	Assignee    string   `json:"assignee"`
+	Priority    string   `json:"priority"`
+	Tags        []string `json:"tags"`
+
+	device, fault, title, description *template.Template
+}
+
+type mqttMessage struct {
+	Topic   string
+	Levels  []string
+	Payload interface{}
+	Raw     string
+}
+
+// mqttStatus is a status update waiting to be published. An empty payload
+// clears the topic's retained message.
+type mqttStatus struct {
+	taskID  TaskID
+	topic   string
+	payload []byte
+}
+
+type mqttBridge struct {
+	cfg         MQTTConfig
+	statusTopic *template.Template
+	statuses    chan mqttStatus
+
+	mu        sync.Mutex
+	conn      *mqttConn
+	lastError string
+	stats     map[string]int64
+}
+
+// WithMQTT runs the MQTT bridge with cfg. Its templates are checked here.
+func WithMQTT(cfg MQTTConfig) Option {
+	return func(s *Server) error {
+		if cfg.Broker == "" {
+			return errors.New("MQTT needs a broker address")
+		}
+		if cfg.ClientID == "" {
+			cfg.ClientID = "taskapi"
+		}
+		if cfg.Dial == nil {
+			cfg.Dial = (&net.Dialer{Timeout: 10 * time.Second}).DialContext
+		}
+		b := &mqttBridge{cfg: cfg, stats: map[string]int64{}}
+		var err error
+		for i := range b.cfg.Mappings {
+			m := &b.cfg.Mappings[i]
+			if m.Topic == "" || m.Device == "" || m.Fault == "" || m.Title == "" {
+				return fmt.Errorf("MQTT mapping %d needs topic, device, fault and title", i)
+			}
+			for _, t := range []struct {
+				dst **template.Template
+				src string
+			}{{&m.device, m.Device}, {&m.fault, m.Fault}, {&m.title, m.Title}, {&m.description, m.Description}} {
+				if *t.dst, err = template.New("").Option("missingkey=zero").Parse(t.src); err != nil {
+					return fmt.Errorf("MQTT mapping %d: %w", i, err)
+				}
+			}
+		}
+		if cfg.StatusTopic != "" {
+			if b.statusTopic, err = template.New("").Parse(cfg.StatusTopic); err != nil {
+				return fmt.Errorf("MQTT status topic: %w", err)
+			}
+			b.statuses = make(chan mqttStatus, mqttStatusQueue)
+		}
+		s.mqtt = b
+		return nil
+	}
+}
+
+// render executes a mapping template. Payload fields missing from a message
+// render as empty rather than "<no value>".
+func render(t *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.ReplaceAll(buf.String(), "<no value>", "")), nil
+}
+
+func (b *mqttBridge) count(stat string) {
+	b.mu.Lock()
+	b.stats[stat]++
+	b.mu.Unlock()
+}
+
+func (b *mqttBridge) setConn(conn *mqttConn, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn = conn
+	if err != nil {
+		b.lastError = err.Error()
+	}
+}
+
+// startMQTTBridge keeps a connection to the broker, reconnecting with
+// backoff when it drops, and publishes queued status updates until ctx ends.
+func (s *Server) startMQTTBridge(ctx context.Context) {
+	b := s.mqtt
+	if b.statuses != nil {
+		s.goWorker(func() { s.publishMQTTStatuses(ctx) })
+	}
+	s.goWorker(func() {
+		backoff := time.Second
+		for {
+			connected, err := s.runMQTTSession(ctx)
+			b.setConn(nil, err)
+			if ctx.Err() != nil {
+				return
+			}
+			// A session that got going resets the backoff, so one dropped
+			// connection is retried quickly.
+			if connected {
+				backoff = time.Second
+			}
+			s.logger.Errorf("MQTT bridge disconnected: %v", err)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			if backoff *= 2; backoff > mqttMaxBackoff {
+				backoff = mqttMaxBackoff
+			}
+		}
+	})
+}
+
+// runMQTTSession connects to the broker and handles messages until the
+// connection drops or ctx ends. It reports whether it got as far as
+// subscribing.
+func (s *Server) runMQTTSession(ctx context.Context) (bool, error) {
+	b := s.mqtt
+	raw, err := b.cfg.Dial(ctx, "tcp", b.cfg.Broker)
+	if err != nil {
+		return false, err
+	}
+	conn, err := mqttHandshake(raw, mqttConnectOptions{
+		clientID:     b.cfg.ClientID,
+		username:     b.cfg.Username,
+		password:     b.cfg.Password,
+		cleanSession: b.cfg.CleanSession,
+		keepAlive:    mqttKeepAlive,
+	})
+	if err != nil {
+		raw.Close()
+		return false, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- conn.run(s.handleMQTTMessage) }()
+	ended := make(chan struct{})
+	defer close(ended)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.disconnect()
+		case <-ended:
+		}
+	}()
+	for _, m := range b.cfg.Mappings {
+		if err := conn.subscribe(ctx, m.Topic); err != nil {
+			conn.disconnect()
+			<-done
+			return false, err
+		}
+	}
+	b.setConn(conn, nil)
+	s.logger.Infof("MQTT bridge connected to %s", b.cfg.Broker)
+	return true, <-done
+}
+
+// handleMQTTMessage opens a task for the first mapping the topic matches.
+// A fault that already has an open task is counted as a duplicate; one whose
+// task was closed reopens it. It returns an error only when the message
+// should be delivered again.
+func (s *Server) handleMQTTMessage(topic string, payload []byte) error {
+	b := s.mqtt
+	b.count("received")
+	msg := mqttMessage{Topic: topic, Levels: strings.Split(topic, "/"), Raw: string(payload)}
+	if json.Unmarshal(payload, &msg.Payload) != nil {
+		msg.Payload = nil
+	}
+
+	for i := range b.cfg.Mappings {
+		m := &b.cfg.Mappings[i]
+		if !mqttTopicMatch(m.Topic, topic) {
+			continue
+		}
+		err := s.openMQTTTask(context.Background(), m, &msg)
+		if errors.Is(err, errInvalidMQTTMessage) {
+			b.count("invalid")
+			s.logger.Errorf("MQTT message on %s: %v", topic, err)
+			return nil
+		}
+		if err != nil {
+			b.count("failed")
+			return fmt.Errorf("handling message on %s: %w", topic, err)
+		}
+		return nil
+	}
+	b.count("unmatched")
+	return nil
+}
+
+func (s *Server) openMQTTTask(ctx context.Context, m *MQTTMapping, msg *mqttMessage) error {
+	device, err := render(m.device, msg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMQTTMessage, err)
+	}
+	fault, err := render(m.fault, msg)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMQTTMessage, err)
+	}
+	if device == "" || fault == "" {
+		return fmt.Errorf("%w: no device or fault key", errInvalidMQTTMessage)
+	}
+	// The fault is the last level of the external ID.
+	key := device + "/" + strings.ReplaceAll(fault, "/", "_")
+
+	existing, err := s.externalTask(ctx, mqttSource, key, true)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		wf, err := s.workflowFor(ctx, existing.Project)
+		if err != nil {
+			return err
+		}
+		if (workflowSet{existing.Project: wf}).category(existing.Project, existing.Status) != categoryDone {
+			s.mqtt.count("duplicates")
+			return nil
+		}
+		return s.reopenMQTTTask(ctx, existing, initialStatus(wf))
+	}
+
+	wf, err := s.workflowFor(ctx, m.Project)
+	if err != nil {
+		return err
+	}
+	task := &Task{
+		ID:             s.newTaskID(),
+		Status:         initialStatus(wf),
+		ExternalSource: mqttSource,
+		ExternalID:     key,
+		Project:        m.Project,
+		Team:           m.Team,
+		Assignee:       m.Assignee,
+		Priority:       m.Priority,
+		Tags:           m.Tags,
+	}
+	if task.Title, err = render(m.title, msg); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMQTTMessage, err)
+	}
+	if task.Description, err = render(m.description, msg); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidMQTTMessage, err)
+	}
+	if task.Title == "" {
+		task.Title = "Fault " + fault + " on " + device
+	}
+	task.CreatedAt = time.Now()
+	task.UpdatedAt = task.CreatedAt
+	task.startStatusHistory()
+
+	// Device tasks bypass WIP limits: a fault has to be recorded whatever
+	// the team's workload.
+	if _, err := s.taskCollection.InsertOne(ctx, task); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			s.mqtt.count("duplicates")
+			return nil
+		}
+		return err
+	}
+	if err := s.indexTask(ctx, task); err != nil {
+		s.logger.Errorf("Failed to index task %s: %v", task.ID, err)
+	}
+	s.mqtt.count("created")
+	s.emit(taskEvent{Type: eventCreated, Task: *task})
+	return nil
+}
+
+func (s *Server) reopenMQTTTask(ctx context.Context, existing *Task, status string) error {
+	now := time.Now()
+	task := *existing
+	task.Status = status
+	task.StatusHistory, task.StatusSince = existing.historyWith(task.Status, now), &now
+	task.UpdatedAt = now
+	result, err := s.taskCollection.UpdateOne(ctx, bson.M{"_id": existing.ID, "status": existing.Status}, bson.M{
+		"$set": bson.M{
+			"status":         task.Status,
+			"status_history": task.StatusHistory,
+			"status_since":   task.StatusSince,
+			"updated_at":     now,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		s.mqtt.count("duplicates")
+		return nil
+	}
+	s.mqtt.count("reopened")
+	s.emit(taskEvent{Type: eventStatusChanged, Task: task, Previous: existing})
+	return nil
+}
+
+// publishMQTTStatus queues status changes of device tasks for the status
+// topic. It runs on the event loop, so updates are queued in order, and
+// drops the update rather than block when the queue is full.
+func (s *Server) publishMQTTStatus(ev taskEvent) {
+	b := s.mqtt
+	if b == nil || b.statusTopic == nil || ev.Task.ExternalSource != mqttSource {
+		return
+	}
+	if ev.Type != eventCreated && ev.Type != eventStatusChanged && ev.Type != eventDeleted {
+		return
+	}
+	i := strings.LastIndex(ev.Task.ExternalID, "/")
+	if i < 0 {
+		return
+	}
+	topic, err := render(b.statusTopic, map[string]string{
+		"Device": ev.Task.ExternalID[:i],
+		"Fault":  ev.Task.ExternalID[i+1:],
+		"TaskID": string(ev.Task.ID),
+	})
+	if err != nil {
+		s.logger.Errorf("MQTT status topic: %v", err)
+		return
+	}
+	var payload []byte
+	if ev.Type != eventDeleted {
+		payload, err = json.Marshal(map[string]interface{}{
+			"task_id": ev.Task.ID,
+			"title":   ev.Task.Title,
+			"status":  ev.Task.Status,
+			"at":      ev.At,
+		})
+		if err != nil {
+			return
+		}
+	}
+	select {
+	case b.statuses <- mqttStatus{taskID: ev.Task.ID, topic: topic, payload: payload}:
+	default:
+		b.count("publish_dropped")
+	}
+}
+
+// publishMQTTStatuses publishes queued status updates in order until ctx
+// ends. Updates queued while the bridge is not connected are dropped.
+func (s *Server) publishMQTTStatuses(ctx context.Context) {
+	b := s.mqtt
+	for {
+		var st mqttStatus
+		select {
+		case <-ctx.Done():
+			return
+		case st = <-b.statuses:
+		}
+		b.mu.Lock()
+		conn := b.conn
+		b.mu.Unlock()
+		if conn == nil {
+			b.count("publish_dropped")
+			continue
+		}
+		pctx, cancel := context.WithTimeout(ctx, mqttPublishTimeout)
+		err := conn.publish(pctx, st.topic, st.payload, true)
+		cancel()
+		if err != nil {
+			b.count("publish_failed")
+			s.logger.Errorf("Failed to publish status of task %s: %v", st.taskID, err)
+			continue
+		}
+		b.count("published")
+	}
+}
+
+func (s *Server) getMQTTStatus(c echo.Context) error {
+	b := s.mqtt
+	if b == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "MQTT bridge is not configured"})
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := map[string]int64{}
+	for k, v := range b.stats {
+		stats[k] = v
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"broker":     b.cfg.Broker,
+		"connected":  b.conn != nil,
+		"last_error": b.lastError,
+		"stats":      stats,
+	})
+}
@@ -0,0 +1,488 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DailyPlan is the list of tasks a user picked to work on for one day. Past
+// plans are kept as history.
+type DailyPlan struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	User      string             `bson:"user" json:"user"`
+	Date      string             `bson:"date" json:"date"`
+	Items     []PlanItem         `bson:"items" json:"items"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type PlanItem struct {
+	TaskID  TaskID    `bson:"task_id" json:"task_id"`
+	AddedAt time.Time `bson:"added_at" json:"added_at"`
+	// RolledOverFrom is the date of the plan the item was carried over from
+	// because it was not finished that day.
+	RolledOverFrom string `bson:"rolled_over_from,omitempty" json:"rolled_over_from,omitempty"`
+}
+
+type planItemView struct {
+	PlanItem
+	Task *Task `json:"task,omitempty"`
+	Done bool  `json:"done"`
+}
+
+type dailyPlanView struct {
+	DailyPlan
+	Items []planItemView `json:"items"`
+}
+
+func (s *Server) ensureDailyPlanIndex(ctx context.Context) error {
+	_, err := s.dailyPlanCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user", Value: 1}, {Key: "date", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func isClosedStatus(status string) bool {
+	for _, s := range closedStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// planLocation returns the timezone given by ?tz, UTC by default.
+func planLocation(c echo.Context) (*time.Location, error) {
+	if tz := c.QueryParam("tz"); tz != "" {
+		return time.LoadLocation(tz)
+	}
+	return time.UTC, nil
+}
+
+// planDate resolves the :date parameter, accepting "today" in the timezone
+// given by ?tz.
+func planDate(c echo.Context) (string, string, error) {
+	loc, err := planLocation(c)
+	if err != nil {
+		return "", "", err
+	}
+	today := time.Now().In(loc).Format(dateLayout)
+	date := c.Param("date")
+	if date == "today" {
+		return today, today, nil
+	}
+	if _, err := time.Parse(dateLayout, date); err != nil {
+		return "", "", err
+	}
+	return date, today, nil
+}
+
+// loadPlan returns the user's plan for date. Today's plan is created on first
+// access by rolling over the unfinished items of the user's latest earlier
+// plan; other dates get an empty plan only when create is set. It returns
+// nil if there is no plan and none was created. With dryRun a new plan is
+// returned without being saved.
+func (s *Server) loadPlan(ctx context.Context, user, date, today string, create, dryRun bool) (*DailyPlan, error) {
+	var plan DailyPlan
+	err := s.dailyPlanCollection.FindOne(ctx, bson.M{"user": user, "date": date}).Decode(&plan)
+	if err == nil {
+		return &plan, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if date != today && !create {
+		return nil, nil
+	}
+
+	plan = DailyPlan{
+		ID:        primitive.NewObjectID(),
+		User:      user,
+		Date:      date,
+		Items:     []PlanItem{},
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if date == today {
+		items, err := s.rolloverItems(ctx, user, date)
+		if err != nil {
+			return nil, err
+		}
+		plan.Items = items
+	}
+	if dryRun {
+		return &plan, nil
+	}
+
+	if _, err := s.dailyPlanCollection.InsertOne(ctx, plan); err != nil {
+		// Someone else created it first; use theirs.
+		if mongo.IsDuplicateKeyError(err) {
+			return s.loadPlan(ctx, user, date, today, false, false)
+		}
+		return nil, err
+	}
+	return &plan, nil
+}
+
+func (s *Server) rolloverItems(ctx context.Context, user, date string) ([]PlanItem, error) {
+	var prev DailyPlan
+	err := s.dailyPlanCollection.FindOne(ctx,
+		bson.M{"user": user, "date": bson.M{"$lt": date}},
+		options.FindOne().SetSort(bson.M{"date": -1}),
+	).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return []PlanItem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := s.planTasks(ctx, prev.Items)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := s.loadWorkflows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items := []PlanItem{}
+	for _, item := range prev.Items {
+		task, ok := tasks[item.TaskID]
+		if !ok || ws.isClosed(task) {
+			continue
+		}
+		items = append(items, PlanItem{TaskID: item.TaskID, AddedAt: time.Now(), RolledOverFrom: prev.Date})
+	}
+	return items, nil
+}
+
+func (s *Server) planTasks(ctx context.Context, items []PlanItem) (map[TaskID]*Task, error) {
+	ids := make([]TaskID, len(items))
+	for i, item := range items {
+		ids[i] = item.TaskID
+	}
+	cursor, err := s.taskCollection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var tasks []Task
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	byID := make(map[TaskID]*Task, len(tasks))
+	for i := range tasks {
+		byID[tasks[i].ID] = &tasks[i]
+	}
+	return byID, nil
+}
+
+func (s *Server) renderPlan(c echo.Context, status int, plan *DailyPlan) error {
+	tasks, err := s.planTasks(context.Background(), plan.Items)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch tasks"})
+	}
+	ws, err := s.loadWorkflows(context.Background())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflows"})
+	}
+	view := dailyPlanView{DailyPlan: *plan, Items: make([]planItemView, len(plan.Items))}
+	for i, item := range plan.Items {
+		task := tasks[item.TaskID]
+		view.Items[i] = planItemView{PlanItem: item, Task: task, Done: task != nil && ws.isClosed(task)}
+	}
+	return c.JSON(status, view)
+}
+
+// planRequest resolves the user and date of a daily plan request, writing
+// the error response itself when they are invalid.
+func (s *Server) planRequest(c echo.Context) (user, date, today string, err error) {
+	user = s.currentUser(c)
+	if user == "" {
+		return "", "", "", c.JSON(http.StatusUnauthorized, map[string]string{"error": "User identity required"})
+	}
+	date, today, err = planDate(c)
+	if err != nil {
+		return "", "", "", c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid date"})
+	}
+	return user, date, today, nil
+}
+
+func (s *Server) getDailyPlan(c echo.Context) error {
+	user, date, today, err := s.planRequest(c)
+	if user == "" {
+		return err
+	}
+	// Reading today's plan shows the rollover without saving it; the first
+	// change to the plan does.
+	plan, err := s.loadPlan(context.Background(), user, date, today, false, true)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch daily plan"})
+	}
+	if plan == nil {
+		plan = &DailyPlan{User: user, Date: date, Items: []PlanItem{}}
+	}
+	return s.renderPlan(c, http.StatusOK, plan)
+}
+
+func (s *Server) addDailyPlanItem(c echo.Context) error {
+	user, date, today, err := s.planRequest(c)
+	if user == "" {
+		return err
+	}
+	var req struct {
+		TaskID string `json:"task_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	taskID, err := s.parseTaskID(req.TaskID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid task ID"})
+	}
+
+	ctx := context.Background()
+	count, err := s.taskCollection.CountDocuments(ctx, bson.M{"_id": taskID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if count == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+
+	plan, err := s.loadPlan(ctx, user, date, today, true, isDryRun(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch daily plan"})
+	}
+	if isDryRun(c) {
+		for _, item := range plan.Items {
+			if item.TaskID == taskID {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Task is already planned for this day"})
+			}
+		}
+		plan.Items = append(plan.Items, PlanItem{TaskID: taskID, AddedAt: time.Now()})
+		return s.renderPlan(c, http.StatusOK, plan)
+	}
+	result, err := s.dailyPlanCollection.UpdateOne(ctx,
+		bson.M{"_id": plan.ID, "items.task_id": bson.M{"$ne": taskID}},
+		bson.M{
+			"$push": bson.M{"items": PlanItem{TaskID: taskID, AddedAt: time.Now()}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update daily plan"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Task is already planned for this day"})
+	}
+
+	plan, err = s.loadPlan(ctx, user, date, today, false, false)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch daily plan"})
+	}
+	return s.renderPlan(c, http.StatusOK, plan)
+}
+
+func (s *Server) removeDailyPlanItem(c echo.Context) error {
+	user, date, _, err := s.planRequest(c)
+	if user == "" {
+		return err
+	}
+	taskID, err := s.parseTaskID(c.Param("taskId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid task ID"})
+	}
+
+	filter := bson.M{"user": user, "date": date, "items.task_id": taskID}
+	if isDryRun(c) {
+		count, err := s.dailyPlanCollection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch daily plan"})
+		}
+		if count == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task is not planned for this day"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Task removed from daily plan"})
+	}
+
+	result, err := s.dailyPlanCollection.UpdateOne(context.Background(), filter,
+		bson.M{
+			"$pull": bson.M{"items": bson.M{"task_id": taskID}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update daily plan"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task is not planned for this day"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Task removed from daily plan"})
+}
+
+// reorderDailyPlan sets the item order; task_ids must list exactly the
+// tasks already in the plan.
+func (s *Server) reorderDailyPlan(c echo.Context) error {
+	user, date, today, err := s.planRequest(c)
+	if user == "" {
+		return err
+	}
+	var req struct {
+		TaskIDs []string `json:"task_ids"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+
+	ctx := context.Background()
+	plan, err := s.loadPlan(ctx, user, date, today, false, isDryRun(c))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch daily plan"})
+	}
+	if plan == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Daily plan not found"})
+	}
+
+	byID := map[TaskID]PlanItem{}
+	for _, item := range plan.Items {
+		byID[item.TaskID] = item
+	}
+	if len(req.TaskIDs) != len(plan.Items) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "task_ids must list every planned task exactly once"})
+	}
+	items := make([]PlanItem, 0, len(req.TaskIDs))
+	for _, raw := range req.TaskIDs {
+		id, err := s.parseTaskID(raw)
+		item, ok := byID[id]
+		if err != nil || !ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "task_ids must list every planned task exactly once"})
+		}
+		delete(byID, id)
+		items = append(items, item)
+	}
+
+	if isDryRun(c) {
+		plan.Items = items
+		return s.renderPlan(c, http.StatusOK, plan)
+	}
+
+	// Guard against a concurrent add or remove changing the item set.
+	result, err := s.dailyPlanCollection.UpdateOne(ctx,
+		bson.M{"_id": plan.ID, "updated_at": plan.UpdatedAt},
+		bson.M{"$set": bson.M{"items": items, "updated_at": time.Now()}})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update daily plan"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Daily plan changed, reload and retry"})
+	}
+	plan.Items = items
+	return s.renderPlan(c, http.StatusOK, plan)
+}
+
+// getDailyPlanSuggestions lists the user's open tasks that are overdue or due
+// on the plan's date and are not planned yet. The date runs from midnight to
+// midnight in the timezone given by ?tz.
+func (s *Server) getDailyPlanSuggestions(c echo.Context) error {
+	user, date, today, err := s.planRequest(c)
+	if user == "" {
+		return err
+	}
+	ctx := context.Background()
+	plan, err := s.loadPlan(ctx, user, date, today, false, true)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch daily plan"})
+	}
+	planned := []TaskID{}
+	if plan != nil {
+		for _, item := range plan.Items {
+			planned = append(planned, item.TaskID)
+		}
+	}
+
+	ws, err := s.loadWorkflows(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflows"})
+	}
+
+	// planRequest has validated both.
+	loc, _ := planLocation(c)
+	day, endOfDay := planDayBounds(date, loc)
+	cursor, err := s.taskCollection.Find(ctx, bson.M{
+		"assignee": user,
+		"$nor":     bson.A{ws.closedFilter()},
+		"due_date": bson.M{"$lt": endOfDay},
+		"_id":      bson.M{"$nin": planned},
+	}, options.Find().SetSort(bson.M{"due_date": 1}).SetLimit(50))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch tasks"})
+	}
+	var tasks []Task
+	if err := cursor.All(ctx, &tasks); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding task data"})
+	}
+
+	suggestions := []map[string]interface{}{}
+	for i := range tasks {
+		suggestions = append(suggestions, map[string]interface{}{"task": tasks[i], "reason": suggestionReason(*tasks[i].DueDate, day)})
+	}
+	return c.JSON(http.StatusOK, suggestions)
+}
+
+// planDayBounds returns the midnights that start and end date in loc. The
+// day may be shorter or longer than 24 hours when the clocks change.
+func planDayBounds(date string, loc *time.Location) (time.Time, time.Time) {
+	day, _ := time.ParseInLocation(dateLayout, date, loc)
+	return day, day.AddDate(0, 0, 1)
+}
+
+// suggestionReason tells why a task due at due is suggested for the day
+// starting at day.
+func suggestionReason(due, day time.Time) string {
+	if due.Before(day) {
+		return "overdue"
+	}
+	return "due_today"
+}
+
+// getDailyPlanHistory lists the user's plans between ?from and ?to
+// (inclusive, default: the last 30 days), newest first.
+func (s *Server) getDailyPlanHistory(c echo.Context) error {
+	user := s.currentUser(c)
+	if user == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "User identity required"})
+	}
+	to := c.QueryParam("to")
+	if to == "" {
+		to = time.Now().UTC().Format(dateLayout)
+	}
+	from := c.QueryParam("from")
+	if from == "" {
+		t, _ := time.Parse(dateLayout, to)
+		from = t.AddDate(0, 0, -30).Format(dateLayout)
+	}
+	if _, err := time.Parse(dateLayout, from); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid from"})
+	}
+	if _, err := time.Parse(dateLayout, to); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid to"})
+	}
+
+	cursor, err := s.dailyPlanCollection.Find(context.Background(),
+		bson.M{"user": user, "date": bson.M{"$gte": from, "$lte": to}},
+		options.Find().SetSort(bson.M{"date": -1}))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch daily plans"})
+	}
+	plans := []DailyPlan{}
+	if err := cursor.All(context.Background(), &plans); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding daily plan data"})
+	}
+	return c.JSON(http.StatusOK, plans)
+}
@@ -0,0 +1,52 @@
+package taskapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlanDayBounds(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	tests := []struct {
+		date   string
+		loc    *time.Location
+		start  string
+		length time.Duration
+	}{
+		{"2024-05-06", time.UTC, "2024-05-06T00:00:00Z", 24 * time.Hour},
+		{"2024-05-06", berlin, "2024-05-05T22:00:00Z", 24 * time.Hour},
+		// The days the clocks change.
+		{"2024-03-31", berlin, "2024-03-30T23:00:00Z", 23 * time.Hour},
+		{"2024-10-27", berlin, "2024-10-26T22:00:00Z", 25 * time.Hour},
+	}
+	for _, tt := range tests {
+		start, end := planDayBounds(tt.date, tt.loc)
+		if got := start.UTC().Format(time.RFC3339); got != tt.start {
+			t.Errorf("%s in %s starts at %s, want %s", tt.date, tt.loc, got, tt.start)
+		}
+		if got := end.Sub(start); got != tt.length {
+			t.Errorf("%s in %s lasts %s, want %s", tt.date, tt.loc, got, tt.length)
+		}
+	}
+}
+
+func TestSuggestionReason(t *testing.T) {
+	day, _ := planDayBounds("2024-05-06", time.UTC)
+	tests := []struct {
+		due  time.Time
+		want string
+	}{
+		{day.Add(-time.Nanosecond), "overdue"},
+		{day.AddDate(0, 0, -3), "overdue"},
+		{day, "due_today"},
+		{day.Add(23*time.Hour + 59*time.Minute), "due_today"},
+	}
+	for _, tt := range tests {
+		if got := suggestionReason(tt.due, day); got != tt.want {
+			t.Errorf("suggestionReason(%s) = %q, want %q", tt.due.Format(time.RFC3339Nano), got, tt.want)
+		}
+	}
+}
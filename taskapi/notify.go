@@ -0,0 +1,784 @@
+package taskapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Task events. An update that changes the status is reported as
+// status_changed rather than updated, so a rule that wants every change
+// lists both.
+const (
+	eventCreated       = "created"
+	eventUpdated       = "updated"
+	eventStatusChanged = "status_changed"
+	eventDeleted       = "deleted"
+
+	// eventDigest marks a notification that collects the events a rule
+	// held back during quiet hours.
+	eventDigest = "digest"
+)
+
+const (
+	channelEmail   = "email"
+	channelWebhook = "webhook"
+	channelChat    = "chat"
+)
+
+const (
+	notificationPending    = "pending"
+	notificationSent       = "sent"
+	notificationFailed     = "failed"
+	notificationSuppressed = "suppressed"
+)
+
+const (
+	eventBufferSize       = 1024
+	notifyPollInterval    = 5 * time.Second
+	notifyLease           = 2 * time.Minute
+	maxNotifyAttempts     = 5
+	notifyDeliveryTimeout = 10 * time.Second
+	maxDigestEntries      = 100
+	// emitTimeout is how long a request waits for room for its event when
+	// the notifier falls behind.
+	emitTimeout = 2 * time.Second
+)
+
+// secretMask stands in for a channel secret in responses.
+const secretMask = "********"
+
+// taskEvent is a change to a task made through the API. Background jobs do
+// not emit events.
+type taskEvent struct {
+	Type     string
+	Task     Task
+	Previous *Task
+	// Actor is the user who made the change, if known.
+	Actor string
+	At    time.Time
+}
+
+// NotificationRule sends a project's task events that match its filters to
+// one channel. Empty filters match everything; Tags matches tasks with any of
+// the listed tags.
+type NotificationRule struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name string             `bson:"name" json:"name"`
+	// Project is the project the rule applies to, or "*" for every project.
+	Project    string              `bson:"project" json:"project"`
+	Disabled   bool                `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	Events     []string            `bson:"events,omitempty" json:"events,omitempty"`
+	Statuses   []string            `bson:"statuses,omitempty" json:"statuses,omitempty"`
+	Priorities []string            `bson:"priorities,omitempty" json:"priorities,omitempty"`
+	Tags       []string            `bson:"tags,omitempty" json:"tags,omitempty"`
+	Channel    NotificationChannel `bson:"channel" json:"channel"`
+	QuietHours *QuietHours         `bson:"quiet_hours,omitempty" json:"quiet_hours,omitempty"`
+	Throttle   *Throttle           `bson:"throttle,omitempty" json:"throttle,omitempty"`
+	CreatedAt  time.Time           `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time           `bson:"updated_at" json:"updated_at"`
+}
+
+// NotificationChannel is where a rule delivers. Email goes to To through the
+// configured SMTP server; webhook posts the event as JSON to URL, signed with
+// Secret when set; chat posts a {"text": ...} message to an incoming-webhook
+// URL, as Slack, Mattermost and Rocket.Chat accept. Secret is never shown:
+// responses mask it, and sending the mask back keeps the stored secret.
+type NotificationChannel struct {
+	Type   string   `bson:"type" json:"type"`
+	To     []string `bson:"to,omitempty" json:"to,omitempty"`
+	URL    string   `bson:"url,omitempty" json:"url,omitempty"`
+	Secret string   `bson:"secret,omitempty" json:"secret,omitempty"`
+}
+
+// QuietHours holds a rule's notifications from Start until End (HH:MM in
+// TimeZone, UTC by default). The events held are delivered as one digest
+// when the period ends. A period may cross midnight.
+type QuietHours struct {
+	Start    string `bson:"start" json:"start"`
+	End      string `bson:"end" json:"end"`
+	TimeZone string `bson:"time_zone,omitempty" json:"time_zone,omitempty"`
+}
+
+// Throttle caps a rule at Max notifications per WindowMinutes. Events over
+// the cap are recorded as suppressed instead of delivered.
+type Throttle struct {
+	Max           int `bson:"max" json:"max"`
+	WindowMinutes int `bson:"window_minutes" json:"window_minutes"`
+}
+
+// Notification is one delivery of an event to a rule's channel. It is kept
+// after delivery as a log.
+type Notification struct {
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	RuleID      primitive.ObjectID  `bson:"rule_id" json:"rule_id"`
+	Channel     NotificationChannel `bson:"channel" json:"-"`
+	ChannelType string              `bson:"channel_type" json:"channel_type"`
+	Event       string              `bson:"event" json:"event"`
+	TaskID      TaskID              `bson:"task_id" json:"task_id"`
+	Task        Task                `bson:"task" json:"-"`
+	Previous    *Task               `bson:"previous,omitempty" json:"-"`
+	Subject     string              `bson:"subject" json:"subject"`
+	// Push and SubscriptionID are the message and browser of a push
+	// notification.
+	Push           *pushMessage        `bson:"push,omitempty" json:"-"`
+	SubscriptionID *primitive.ObjectID `bson:"subscription_id,omitempty" json:"subscription_id,omitempty"`
+	// Digest lists the first maxDigestEntries events of a quiet hours
+	// digest, of DigestCount in total.
+	Digest       []digestEntry `bson:"digest,omitempty" json:"digest,omitempty"`
+	DigestCount  int           `bson:"digest_count,omitempty" json:"digest_count,omitempty"`
+	Status       string        `bson:"status" json:"status"`
+	Attempts     int           `bson:"attempts" json:"attempts"`
+	DeliverAfter time.Time     `bson:"deliver_after" json:"deliver_after"`
+	LastError    string        `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	EventAt      time.Time     `bson:"event_at" json:"event_at"`
+	CreatedAt    time.Time     `bson:"created_at" json:"created_at"`
+	SentAt       *time.Time    `bson:"sent_at,omitempty" json:"sent_at,omitempty"`
+}
+
+type digestEntry struct {
+	Event   string    `bson:"event" json:"event"`
+	TaskID  TaskID    `bson:"task_id" json:"task_id"`
+	Subject string    `bson:"subject" json:"subject"`
+	At      time.Time `bson:"at" json:"at"`
+}
+
+type smtpConfig struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+var notifyClient = &http.Client{Timeout: notifyDeliveryTimeout}
+
+func (s *Server) ensureNotificationIndexes(ctx context.Context) error {
+	_, err := s.notificationCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "deliver_after", Value: 1}}},
+		{Keys: bson.D{{Key: "rule_id", Value: 1}, {Key: "created_at", Value: 1}}},
+	})
+	return err
+}
+
+// emit hands an event to the notifier, which feeds notification rules, push
+// and MQTT statuses. When the notifier falls behind the request waits up to
+// emitTimeout for room rather than lose the event; events that still do not
+// fit are dropped and counted.
+func (s *Server) emit(ev taskEvent) {
+	ev.At = time.Now()
+	timer := time.NewTimer(emitTimeout)
+	defer timer.Stop()
+	select {
+	case s.events <- ev:
+	case <-timer.C:
+		dropped := s.droppedEvents.Add(1)
+		s.logger.Errorf("Dropped %s event for task %s: notifier is behind (%d dropped so far)", ev.Type, ev.Task.ID, dropped)
+	}
+}
+
+func (s *Server) startNotifier(ctx context.Context) {
+	s.goWorker(func() {
+		for {
+			var ev taskEvent
+			select {
+			case <-ctx.Done():
+				return
+			case ev = <-s.events:
+			}
+			if err := s.routeEvent(context.Background(), ev); err != nil {
+				s.logger.Errorf("Failed to route %s event for task %s: %v", ev.Type, ev.Task.ID, err)
+			}
+			if err := s.routePushEvent(context.Background(), ev); err != nil {
+				s.logger.Errorf("Failed to queue push notifications for task %s: %v", ev.Task.ID, err)
+			}
+			s.publishMQTTStatus(ev)
+		}
+	})
+	s.goWorker(func() {
+		for ctx.Err() == nil {
+			n, err := s.claimNotification(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Errorf("Failed to claim notification: %v", err)
+			}
+			if n == nil {
+				sleep(ctx, notifyPollInterval)
+				continue
+			}
+			s.deliverNotification(n)
+		}
+	})
+}
+
+func (r *NotificationRule) matches(ev taskEvent) bool {
+	if r.Disabled {
+		return false
+	}
+	if len(r.Events) > 0 && !containsString(r.Events, ev.Type) {
+		return false
+	}
+	if len(r.Statuses) > 0 && !containsString(r.Statuses, ev.Task.Status) {
+		return false
+	}
+	if len(r.Priorities) > 0 && !containsString(r.Priorities, ev.Task.Priority) {
+		return false
+	}
+	if len(r.Tags) > 0 {
+		for _, tag := range ev.Task.Tags {
+			if containsString(r.Tags, tag) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// routeEvent queues a notification for every rule the event matches,
+// applying each rule's throttle and quiet hours.
+func (s *Server) routeEvent(ctx context.Context, ev taskEvent) error {
+	cursor, err := s.notificationRuleCollection.Find(ctx, bson.M{"project": bson.M{"$in": []string{ev.Task.Project, "*"}}})
+	if err != nil {
+		return err
+	}
+	var rules []NotificationRule
+	if err := cursor.All(ctx, &rules); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, rule := range rules {
+		if !rule.matches(ev) {
+			continue
+		}
+		n := &Notification{
+			ID:           primitive.NewObjectID(),
+			RuleID:       rule.ID,
+			Channel:      rule.Channel,
+			ChannelType:  rule.Channel.Type,
+			Event:        ev.Type,
+			TaskID:       ev.Task.ID,
+			Task:         ev.Task,
+			Previous:     ev.Previous,
+			Subject:      eventSubject(ev),
+			Status:       notificationPending,
+			DeliverAfter: now,
+			EventAt:      ev.At,
+			CreatedAt:    now,
+		}
+		if rule.Throttle != nil {
+			recent, err := s.notificationCollection.CountDocuments(ctx, bson.M{
+				"rule_id":    rule.ID,
+				"status":     bson.M{"$ne": notificationSuppressed},
+				"created_at": bson.M{"$gte": now.Add(-time.Duration(rule.Throttle.WindowMinutes) * time.Minute)},
+			})
+			if err != nil {
+				return err
+			}
+			if recent >= int64(rule.Throttle.Max) {
+				n.Status = notificationSuppressed
+			}
+		}
+		if rule.QuietHours != nil && n.Status == notificationPending {
+			if until := rule.QuietHours.until(now); until.After(now) {
+				if err := s.holdForDigest(ctx, &rule, n, until); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if _, err := s.notificationCollection.InsertOne(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdForDigest adds the event of n to the rule's digest for the quiet
+// period ending at until, so the period ends with one message rather than a
+// burst of them.
+func (s *Server) holdForDigest(ctx context.Context, rule *NotificationRule, n *Notification, until time.Time) error {
+	entry := digestEntry{Event: n.Event, TaskID: n.TaskID, Subject: n.Subject, At: n.EventAt}
+	_, err := s.notificationCollection.UpdateOne(ctx,
+		bson.M{"rule_id": rule.ID, "event": eventDigest, "status": notificationPending, "deliver_after": until},
+		bson.M{
+			"$setOnInsert": bson.M{
+				"_id":          primitive.NewObjectID(),
+				"channel":      n.Channel,
+				"channel_type": n.ChannelType,
+				"subject":      "[" + rule.Name + "] Held during quiet hours",
+				"attempts":     0,
+				"event_at":     n.EventAt,
+				"created_at":   n.CreatedAt,
+			},
+			"$push": bson.M{"digest": bson.M{"$each": []digestEntry{entry}, "$slice": maxDigestEntries}},
+			"$inc":  bson.M{"digest_count": 1},
+		},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+func eventSubject(ev taskEvent) string {
+	var what string
+	switch ev.Type {
+	case eventCreated:
+		what = "created"
+	case eventStatusChanged:
+		what = fmt.Sprintf("%s → %s", ev.Previous.Status, ev.Task.Status)
+	case eventDeleted:
+		what = "deleted"
+	default:
+		what = "updated"
+	}
+	subject := fmt.Sprintf("%s: %s", ev.Task.Title, what)
+	if ev.Task.Project != "" {
+		subject = "[" + ev.Task.Project + "] " + subject
+	}
+	return subject
+}
+
+// subject returns the subject line to send, which for a digest includes the
+// number of events.
+func (n *Notification) subject() string {
+	if n.Event == eventDigest {
+		return fmt.Sprintf("%s: %d task events", n.Subject, n.DigestCount)
+	}
+	return n.Subject
+}
+
+func (n *Notification) body() string {
+	var b strings.Builder
+	if n.Event == eventDigest {
+		for _, e := range n.Digest {
+			fmt.Fprintf(&b, "%s  %s\n", e.At.UTC().Format(time.RFC3339), e.Subject)
+		}
+		if more := n.DigestCount - len(n.Digest); more > 0 {
+			fmt.Fprintf(&b, "... and %d more\n", more)
+		}
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Task %s %s at %s\n\n", n.TaskID, strings.ReplaceAll(n.Event, "_", " "), n.EventAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Title:    %s\n", n.Task.Title)
+	fmt.Fprintf(&b, "Status:   %s\n", n.Task.Status)
+	if n.Task.Priority != "" {
+		fmt.Fprintf(&b, "Priority: %s\n", n.Task.Priority)
+	}
+	if n.Task.Assignee != "" {
+		fmt.Fprintf(&b, "Assignee: %s\n", n.Task.Assignee)
+	}
+	if len(n.Task.Tags) > 0 {
+		fmt.Fprintf(&b, "Tags:     %s\n", strings.Join(n.Task.Tags, ", "))
+	}
+	return b.String()
+}
+
+// until returns when the quiet period containing t ends, or t if t is
+// outside quiet hours.
+func (q *QuietHours) until(t time.Time) time.Time {
+	loc, err := time.LoadLocation(q.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	start, err1 := parseClock(q.Start)
+	end, err2 := parseClock(q.End)
+	if err1 != nil || err2 != nil || start == end {
+		return t
+	}
+
+	lt := t.In(loc)
+	now := time.Duration(lt.Hour())*time.Hour + time.Duration(lt.Minute())*time.Minute
+	endOn := func(days int) time.Time {
+		return time.Date(lt.Year(), lt.Month(), lt.Day()+days, int(end/time.Hour), int(end%time.Hour/time.Minute), 0, 0, loc)
+	}
+	switch {
+	case start < end && now >= start && now < end:
+		return endOn(0)
+	case start > end && now >= start:
+		return endOn(1)
+	case start > end && now < end:
+		return endOn(0)
+	}
+	return t
+}
+
+func (s *Server) claimNotification(ctx context.Context) (*Notification, error) {
+	now := time.Now()
+	var n Notification
+	err := s.notificationCollection.FindOneAndUpdate(ctx,
+		bson.M{"status": notificationPending, "deliver_after": bson.M{"$lte": now}},
+		bson.M{
+			"$set": bson.M{"deliver_after": now.Add(notifyLease)},
+			"$inc": bson.M{"attempts": 1},
+		},
+		options.FindOneAndUpdate().SetSort(bson.M{"deliver_after": 1}).SetReturnDocument(options.After),
+	).Decode(&n)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// deliverNotification sends n and records the outcome. Failed deliveries are
+// retried with a growing delay until maxNotifyAttempts, except to push
+// subscriptions that are gone.
+func (s *Server) deliverNotification(n *Notification) {
+	ctx := context.Background()
+	err := s.send(ctx, n)
+	now := time.Now()
+	set := bson.M{}
+	switch {
+	case err == nil:
+		set["status"], set["sent_at"] = notificationSent, now
+	case n.Attempts >= maxNotifyAttempts || errors.Is(err, errPushGone):
+		set["status"], set["last_error"] = notificationFailed, err.Error()
+	default:
+		set["deliver_after"] = now.Add(time.Duration(n.Attempts*n.Attempts) * time.Minute)
+		set["last_error"] = err.Error()
+	}
+	if _, uerr := s.notificationCollection.UpdateOne(ctx, bson.M{"_id": n.ID}, bson.M{"$set": set}); uerr != nil {
+		s.logger.Errorf("Failed to record delivery of notification %s: %v", n.ID.Hex(), uerr)
+	}
+}
+
+func (s *Server) send(ctx context.Context, n *Notification) error {
+	switch n.Channel.Type {
+	case channelEmail:
+		if s.smtp == nil {
+			return errors.New("email is not configured")
+		}
+		msg := "From: " + s.smtp.from + "\r\n" +
+			"To: " + strings.Join(n.Channel.To, ", ") + "\r\n" +
+			"Subject: " + mime.BEncoding.Encode("utf-8", n.subject()) + "\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+			strings.ReplaceAll(n.body(), "\n", "\r\n")
+		return s.smtp.sendMail(ctx, n.Channel.To, []byte(msg))
+	case channelWebhook:
+		payload := map[string]interface{}{
+			"event":    n.Event,
+			"task":     n.Task,
+			"previous": n.Previous,
+			"at":       n.EventAt,
+		}
+		if n.Event == eventDigest {
+			payload = map[string]interface{}{
+				"event":  n.Event,
+				"events": n.Digest,
+				"count":  n.DigestCount,
+				"at":     n.EventAt,
+			}
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		header := http.Header{"Content-Type": {"application/json"}}
+		if n.Channel.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(n.Channel.Secret))
+			mac.Write(body)
+			header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		return postNotification(ctx, n.Channel.URL, header, body)
+	case channelChat:
+		body, err := json.Marshal(map[string]string{"text": n.subject() + "\n" + n.body()})
+		if err != nil {
+			return err
+		}
+		return postNotification(ctx, n.Channel.URL, http.Header{"Content-Type": {"application/json"}}, body)
+	case channelPush:
+		return s.sendPush(ctx, n)
+	}
+	return fmt.Errorf("unknown channel type %q", n.Channel.Type)
+}
+
+// sendMail delivers msg the way smtp.SendMail does, but bounds the whole
+// exchange by notifyDeliveryTimeout or ctx, whichever ends first, so a hung
+// server cannot stall the delivery worker.
+func (cfg *smtpConfig) sendMail(ctx context.Context, to []string, msg []byte) error {
+	deadline := time.Now().Add(notifyDeliveryTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn, err := (&net.Dialer{Deadline: deadline}).DialContext(ctx, "tcp", cfg.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	host, _, _ := strings.Cut(cfg.addr, ":")
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.username, cfg.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func postNotification(ctx context.Context, target string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", target, resp.Status)
+	}
+	return nil
+}
+
+// validateRule checks a rule and returns a message for the client, or "".
+func (s *Server) validateRule(r *NotificationRule) string {
+	if r.Project == "" {
+		return `Project is required ("*" for all projects)`
+	}
+	for _, e := range r.Events {
+		switch e {
+		case eventCreated, eventUpdated, eventStatusChanged, eventDeleted:
+		default:
+			return "Unknown event " + e
+		}
+	}
+	switch r.Channel.Type {
+	case channelEmail:
+		if s.smtp == nil {
+			return "Email is not configured on this server"
+		}
+		if len(r.Channel.To) == 0 {
+			return "Email channels need at least one recipient"
+		}
+		for _, to := range r.Channel.To {
+			if !strings.Contains(to, "@") || strings.ContainsAny(to, "\r\n") {
+				return "Invalid email address " + to
+			}
+		}
+	case channelWebhook, channelChat:
+		u, err := url.Parse(r.Channel.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "Channel URL must be an http(s) URL"
+		}
+	default:
+		return "Channel type must be email, webhook or chat"
+	}
+	if q := r.QuietHours; q != nil {
+		_, err1 := parseClock(q.Start)
+		_, err2 := parseClock(q.End)
+		if err1 != nil || err2 != nil {
+			return "Quiet hours start and end must be HH:MM"
+		}
+		if _, err := time.LoadLocation(q.TimeZone); err != nil {
+			return "Unknown time zone " + q.TimeZone
+		}
+	}
+	if t := r.Throttle; t != nil && (t.Max <= 0 || t.WindowMinutes <= 0) {
+		return "Throttle max and window_minutes must be positive"
+	}
+	return ""
+}
+
+func (s *Server) createNotificationRule(c echo.Context) error {
+	rule := new(NotificationRule)
+	if err := c.Bind(rule); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if msg := s.validateRule(rule); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	rule.ID = primitive.NewObjectID()
+	rule.CreatedAt = time.Now()
+	rule.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, rule.redacted())
+	}
+	if _, err := s.notificationRuleCollection.InsertOne(context.Background(), rule); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create notification rule"})
+	}
+	return c.JSON(http.StatusCreated, rule.redacted())
+}
+
+// redacted returns a copy of r fit for responses, with the secret masked.
+func (r *NotificationRule) redacted() *NotificationRule {
+	out := *r
+	if out.Channel.Secret != "" {
+		out.Channel.Secret = secretMask
+	}
+	return &out
+}
+
+func (s *Server) getAllNotificationRules(c echo.Context) error {
+	filter := bson.M{}
+	if project := c.QueryParam("project"); project != "" {
+		filter["project"] = project
+	}
+	cursor, err := s.notificationRuleCollection.Find(context.Background(), filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch notification rules"})
+	}
+	rules := []NotificationRule{}
+	if err := cursor.All(context.Background(), &rules); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding notification rule data"})
+	}
+	for i := range rules {
+		rules[i] = *rules[i].redacted()
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+func (s *Server) findNotificationRule(c echo.Context) (*NotificationRule, error) {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var rule NotificationRule
+	err = s.notificationRuleCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&rule)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Notification rule not found"})
+		}
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch notification rule"})
+	}
+	return &rule, nil
+}
+
+func (s *Server) getNotificationRule(c echo.Context) error {
+	rule, err := s.findNotificationRule(c)
+	if rule == nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, rule.redacted())
+}
+
+func (s *Server) updateNotificationRule(c echo.Context) error {
+	rule, err := s.findNotificationRule(c)
+	if rule == nil {
+		return err
+	}
+	update := new(NotificationRule)
+	if err := c.Bind(update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if msg := s.validateRule(update); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	if update.Channel.Secret == secretMask {
+		update.Channel.Secret = rule.Channel.Secret
+	}
+	update.ID = rule.ID
+	update.CreatedAt = rule.CreatedAt
+	update.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, update.redacted())
+	}
+	if _, err := s.notificationRuleCollection.ReplaceOne(context.Background(), bson.M{"_id": rule.ID}, update); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update notification rule"})
+	}
+	return c.JSON(http.StatusOK, update.redacted())
+}
+
+// deleteNotificationRule removes a rule. Notifications it already queued are
+// still delivered.
+func (s *Server) deleteNotificationRule(c echo.Context) error {
+	rule, err := s.findNotificationRule(c)
+	if rule == nil {
+		return err
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Notification rule deleted successfully"})
+	}
+	if _, err := s.notificationRuleCollection.DeleteOne(context.Background(), bson.M{"_id": rule.ID}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete notification rule"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Notification rule deleted successfully"})
+}
+
+// getNotifications lists queued and past notifications, newest first,
+// optionally filtered by ?status= and ?rule_id=.
+func (s *Server) getNotifications(c echo.Context) error {
+	filter := bson.M{}
+	if status := c.QueryParam("status"); status != "" {
+		filter["status"] = status
+	}
+	if v := c.QueryParam("rule_id"); v != "" {
+		ruleID, err := primitive.ObjectIDFromHex(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid rule_id"})
+		}
+		filter["rule_id"] = ruleID
+	}
+	cursor, err := s.notificationCollection.Find(context.Background(), filter,
+		options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(200))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch notifications"})
+	}
+	notifications := []Notification{}
+	if err := cursor.All(context.Background(), &notifications); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding notification data"})
+	}
+	return c.JSON(http.StatusOK, notifications)
+}
@@ -0,0 +1,133 @@
+package taskapi
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+func TestQuietHoursUntil(t *testing.T) {
+	utc := func(value string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name string
+		q    QuietHours
+		at   string
+		want string
+	}{
+		{"before daytime period", QuietHours{Start: "12:00", End: "14:00"}, "2024-05-06 11:59", "2024-05-06 11:59"},
+		{"in daytime period", QuietHours{Start: "12:00", End: "14:00"}, "2024-05-06 12:00", "2024-05-06 14:00"},
+		{"end is outside", QuietHours{Start: "12:00", End: "14:00"}, "2024-05-06 14:00", "2024-05-06 14:00"},
+		{"overnight, evening", QuietHours{Start: "22:00", End: "07:00"}, "2024-05-06 23:30", "2024-05-07 07:00"},
+		{"overnight, morning", QuietHours{Start: "22:00", End: "07:00"}, "2024-05-07 03:00", "2024-05-07 07:00"},
+		{"overnight, daytime", QuietHours{Start: "22:00", End: "07:00"}, "2024-05-07 12:00", "2024-05-07 12:00"},
+		{"overnight, month end", QuietHours{Start: "22:00", End: "07:00"}, "2024-05-31 22:00", "2024-06-01 07:00"},
+		{"empty period", QuietHours{Start: "09:00", End: "09:00"}, "2024-05-06 09:00", "2024-05-06 09:00"},
+		{"bad clock", QuietHours{Start: "9am", End: "10:00"}, "2024-05-06 09:30", "2024-05-06 09:30"},
+		// 20:30 UTC is 22:30 in Berlin, inside the period, which ends at
+		// 07:00 Berlin time, 05:00 UTC.
+		{"time zone", QuietHours{Start: "22:00", End: "07:00", TimeZone: "Europe/Berlin"}, "2024-05-06 20:30", "2024-05-07 05:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.q.TimeZone != "" {
+				if _, err := time.LoadLocation(tt.q.TimeZone); err != nil {
+					t.Skip("time zone data not available")
+				}
+			}
+			if got := tt.q.until(utc(tt.at)); !got.Equal(utc(tt.want)) {
+				t.Errorf("until(%s) = %s, want %s", tt.at, got.UTC().Format("2006-01-02 15:04"), tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestMessage(t *testing.T) {
+	at := time.Date(2024, 5, 7, 1, 2, 0, 0, time.UTC)
+	n := &Notification{
+		Event:       eventDigest,
+		Subject:     "[ops] Held during quiet hours",
+		Digest:      []digestEntry{{Event: eventCreated, TaskID: "t1", Subject: "[ops] Disk full: created", At: at}},
+		DigestCount: 3,
+	}
+	if got, want := n.subject(), "[ops] Held during quiet hours: 3 task events"; got != want {
+		t.Errorf("subject() = %q, want %q", got, want)
+	}
+	body := n.body()
+	for _, want := range []string{"2024-05-07T01:02:00Z  [ops] Disk full: created", "... and 2 more"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body() = %q, missing %q", body, want)
+		}
+	}
+}
+
+func TestNotificationRuleRedacted(t *testing.T) {
+	rule := &NotificationRule{Channel: NotificationChannel{Type: channelWebhook, Secret: "s3cret"}}
+	if got := rule.redacted().Channel.Secret; got != secretMask {
+		t.Errorf("redacted secret = %q", got)
+	}
+	if rule.Channel.Secret != "s3cret" {
+		t.Error("redacted changed the rule itself")
+	}
+	if got := (&NotificationRule{}).redacted().Channel.Secret; got != "" {
+		t.Errorf("empty secret redacted to %q", got)
+	}
+}
+
+func TestEmitWaitsForNotifier(t *testing.T) {
+	s := &Server{events: make(chan taskEvent, 1), logger: log.New("test")}
+	s.emit(taskEvent{Type: eventCreated})
+	done := make(chan struct{})
+	go func() {
+		s.emit(taskEvent{Type: eventUpdated})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if ev := <-s.events; ev.Type != eventCreated {
+		t.Fatalf("first event %q", ev.Type)
+	}
+	<-done
+	if ev := <-s.events; ev.Type != eventUpdated {
+		t.Errorf("second event %q", ev.Type)
+	}
+	if n := s.droppedEvents.Load(); n != 0 {
+		t.Errorf("%d events dropped", n)
+	}
+}
+
+func TestSendMailHungServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// The server accepts but never greets.
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	cfg := &smtpConfig{addr: ln.Addr().String(), from: "tasks@example.com"}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := cfg.sendMail(ctx, []string{"ops@example.com"}, []byte("Subject: x\r\n\r\nx")); err == nil {
+		t.Fatal("sendMail to a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sendMail took %s, want it bounded by the deadline", elapsed)
+	}
+}
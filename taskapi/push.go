@@ -0,0 +1,577 @@
+package taskapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Push notifications go through the notification outbox like rule
+// deliveries, one per subscription, so they get the same retries. They are
+// not tied to a rule.
+const (
+	channelPush   = "push"
+	eventAssigned = "assigned"
+	eventReminder = "reminder"
+
+	reminderPollInterval = 30 * time.Second
+)
+
+// PushSubscription is a browser's Web Push subscription, as returned by
+// PushManager.subscribe, registered for a user.
+type PushSubscription struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	User      string             `bson:"user" json:"user"`
+	Endpoint  string             `bson:"endpoint" json:"endpoint"`
+	Keys      PushKeys           `bson:"keys" json:"-"`
+	UserAgent string             `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// PushKeys are the browser's public key and auth secret, base64url encoded.
+type PushKeys struct {
+	P256dh string `bson:"p256dh" json:"p256dh"`
+	Auth   string `bson:"auth" json:"auth"`
+}
+
+// Reminder asks for a push notification about a task at RemindAt. SentAt is
+// set once it has been handled.
+type Reminder struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TaskID    TaskID             `bson:"task_id" json:"task_id"`
+	User      string             `bson:"user" json:"user"`
+	RemindAt  time.Time          `bson:"remind_at" json:"remind_at"`
+	Note      string             `bson:"note,omitempty" json:"note,omitempty"`
+	SentAt    *time.Time         `bson:"sent_at,omitempty" json:"sent_at,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func (s *Server) ensurePushIndexes(ctx context.Context) error {
+	_, err := s.pushSubscriptionCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "endpoint", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.reminderCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "remind_at", Value: 1}}, Options: options.Index().SetPartialFilterExpression(bson.M{"sent_at": bson.M{"$exists": false}})},
+		{Keys: bson.D{{Key: "user", Value: 1}, {Key: "remind_at", Value: 1}}},
+		{Keys: bson.D{{Key: "task_id", Value: 1}}},
+	})
+	return err
+}
+
+// pushTag derives a Topic header value, which push services limit to 32
+// base64url characters, from what the notification is about.
+func pushTag(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// queuePush queues msg for every push subscription of user.
+func (s *Server) queuePush(ctx context.Context, user, event string, task *Task, msg *pushMessage) (int, error) {
+	cursor, err := s.pushSubscriptionCollection.Find(ctx, bson.M{"user": user})
+	if err != nil {
+		return 0, err
+	}
+	var subs []PushSubscription
+	if err := cursor.All(ctx, &subs); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for _, sub := range subs {
+		subID := sub.ID
+		n := &Notification{
+			ID:             primitive.NewObjectID(),
+			Channel:        NotificationChannel{Type: channelPush, To: []string{user}},
+			ChannelType:    channelPush,
+			Event:          event,
+			TaskID:         task.ID,
+			Task:           *task,
+			Subject:        msg.Title,
+			Push:           msg,
+			SubscriptionID: &subID,
+			Status:         notificationPending,
+			DeliverAfter:   now,
+			EventAt:        now,
+			CreatedAt:      now,
+		}
+		if _, err := s.notificationCollection.InsertOne(ctx, n); err != nil {
+			return 0, err
+		}
+	}
+	return len(subs), nil
+}
+
+// sendPush delivers a queued push notification. Subscriptions the push
+// service reports as gone are removed.
+func (s *Server) sendPush(ctx context.Context, n *Notification) error {
+	if s.push == nil {
+		return fmt.Errorf("web push is not configured")
+	}
+	if n.SubscriptionID == nil || n.Push == nil {
+		return errPushGone
+	}
+	var sub PushSubscription
+	err := s.pushSubscriptionCollection.FindOne(ctx, bson.M{"_id": *n.SubscriptionID}).Decode(&sub)
+	if err == mongo.ErrNoDocuments {
+		return errPushGone
+	}
+	if err != nil {
+		return err
+	}
+	err = s.push.send(ctx, &sub, n.Push)
+	if err == errPushGone {
+		if _, derr := s.pushSubscriptionCollection.DeleteOne(ctx, bson.M{"_id": sub.ID}); derr != nil {
+			s.logger.Errorf("Failed to remove expired push subscription %s: %v", sub.ID.Hex(), derr)
+		}
+	}
+	return err
+}
+
+// routePushEvent tells the assignee of a task, on their browsers, that it
+// was assigned to them by someone else.
+func (s *Server) routePushEvent(ctx context.Context, ev taskEvent) error {
+	if s.push == nil || ev.Type == eventDeleted {
+		return nil
+	}
+	assignee := ev.Task.Assignee
+	if assignee == "" || assignee == ev.Actor || ev.Previous != nil && ev.Previous.Assignee == assignee {
+		return nil
+	}
+	body := "Assigned to you"
+	if ev.Actor != "" {
+		body += " by " + ev.Actor
+	}
+	if ev.Task.Project != "" {
+		body += " in " + ev.Task.Project
+	}
+	_, err := s.queuePush(ctx, assignee, eventAssigned, &ev.Task, &pushMessage{
+		Title:  ev.Task.Title,
+		Body:   body,
+		Event:  eventAssigned,
+		TaskID: ev.Task.ID,
+		Tag:    pushTag(eventAssigned, string(ev.Task.ID)),
+	})
+	return err
+}
+
+// startReminderLoop turns due reminders into push notifications.
+func (s *Server) startReminderLoop(ctx context.Context) {
+	s.goWorker(func() {
+		for {
+			for ctx.Err() == nil {
+				r, err := s.claimReminder(ctx)
+				if err != nil && ctx.Err() == nil {
+					s.logger.Errorf("Failed to claim reminder: %v", err)
+				}
+				if r == nil {
+					break
+				}
+				// A claimed reminder is delivered even while stopping, as
+				// it would be lost otherwise.
+				if err := s.deliverReminder(context.Background(), r); err != nil {
+					s.logger.Errorf("Failed to deliver reminder %s: %v", r.ID.Hex(), err)
+				}
+			}
+			if !sleep(ctx, reminderPollInterval) {
+				return
+			}
+		}
+	})
+}
+
+// claimReminder marks the next due reminder as sent and returns it. A
+// reminder is claimed once, so a failure to queue it loses it rather than
+// repeating it.
+func (s *Server) claimReminder(ctx context.Context) (*Reminder, error) {
+	now := time.Now()
+	var r Reminder
+	err := s.reminderCollection.FindOneAndUpdate(ctx,
+		bson.M{"sent_at": bson.M{"$exists": false}, "remind_at": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"sent_at": now}},
+		options.FindOneAndUpdate().SetSort(bson.M{"remind_at": 1}),
+	).Decode(&r)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// deliverReminder queues the reminder's notification, unless its task is
+// gone or finished by now.
+func (s *Server) deliverReminder(ctx context.Context, r *Reminder) error {
+	var task Task
+	err := s.taskCollection.FindOne(ctx, bson.M{"_id": r.TaskID}).Decode(&task)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	wf, err := s.workflowFor(ctx, task.Project)
+	if err != nil {
+		return err
+	}
+	if (workflowSet{task.Project: wf}).isClosed(&task) {
+		return nil
+	}
+
+	body := r.Note
+	if body == "" {
+		body = "Status: " + task.Status
+		if task.DueDate != nil {
+			body += ", due " + task.DueDate.UTC().Format("Jan 2 15:04 MST")
+		}
+	}
+	_, err = s.queuePush(ctx, r.User, eventReminder, &task, &pushMessage{
+		Title:   "Reminder: " + task.Title,
+		Body:    body,
+		Event:   eventReminder,
+		TaskID:  task.ID,
+		Tag:     pushTag(eventReminder, string(task.ID)),
+		Urgency: "high",
+	})
+	return err
+}
+
+// validEndpoint accepts https endpoints, rejecting hosts that are
+// non-public addresses up front; hosts that resolve to one are refused when
+// the push client dials them. With AllowInsecureEndpoints it also accepts
+// http ones on loopback.
+func (wp *webPush) validEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	local := host == "localhost" || strings.HasSuffix(host, ".localhost") || ip != nil && ip.IsLoopback()
+	switch {
+	case u.Scheme == "http":
+		return wp.allowInsecure && local
+	case u.Scheme != "https":
+		return false
+	case local:
+		return wp.allowInsecure
+	}
+	return ip == nil || publicAddress(ip)
+}
+
+func (k *PushKeys) validate() string {
+	pub, err := base64.RawURLEncoding.DecodeString(trimPadding(k.P256dh))
+	if err != nil || len(pub) != 65 || pub[0] != 4 {
+		return "keys.p256dh must be an uncompressed P-256 public key"
+	}
+	auth, err := base64.RawURLEncoding.DecodeString(trimPadding(k.Auth))
+	if err != nil || len(auth) != 16 {
+		return "keys.auth must be a 16-byte secret"
+	}
+	return ""
+}
+
+// pushUser resolves the caller of a push or reminder route, writing the
+// error response itself when there is none or push is off.
+func (s *Server) pushUser(c echo.Context, needPush bool) (string, error) {
+	if needPush && s.push == nil {
+		return "", c.JSON(http.StatusNotFound, map[string]string{"error": "Web push is not configured"})
+	}
+	user := s.currentUser(c)
+	if user == "" {
+		return "", c.JSON(http.StatusUnauthorized, map[string]string{"error": "User identity required"})
+	}
+	return user, nil
+}
+
+func (s *Server) getVAPIDPublicKey(c echo.Context) error {
+	if s.push == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Web push is not configured"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"public_key": base64.RawURLEncoding.EncodeToString(s.push.publicKey)})
+}
+
+// createPushSubscription registers the JSON of a browser's
+// PushSubscription for the caller. Registering an endpoint again updates
+// it, and moves it to the caller if another user had it.
+func (s *Server) createPushSubscription(c echo.Context) error {
+	user, err := s.pushUser(c, true)
+	if user == "" {
+		return err
+	}
+	var req struct {
+		Endpoint string   `json:"endpoint"`
+		Keys     PushKeys `json:"keys"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if !s.push.validEndpoint(req.Endpoint) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Endpoint must be an https URL of a public push service"})
+	}
+	if msg := req.Keys.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	now := time.Now()
+	sub := &PushSubscription{
+		ID:        primitive.NewObjectID(),
+		User:      user,
+		Endpoint:  req.Endpoint,
+		Keys:      req.Keys,
+		UserAgent: c.Request().UserAgent(),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, sub)
+	}
+	err = s.pushSubscriptionCollection.FindOneAndUpdate(context.Background(),
+		bson.M{"endpoint": sub.Endpoint},
+		bson.M{
+			"$set":         bson.M{"user": sub.User, "keys": sub.Keys, "user_agent": sub.UserAgent, "updated_at": now},
+			"$setOnInsert": bson.M{"_id": sub.ID, "created_at": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(sub)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save push subscription"})
+	}
+	return c.JSON(http.StatusCreated, sub)
+}
+
+func (s *Server) getPushSubscriptions(c echo.Context) error {
+	user, err := s.pushUser(c, false)
+	if user == "" {
+		return err
+	}
+	cursor, err := s.pushSubscriptionCollection.Find(context.Background(), bson.M{"user": user},
+		options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch push subscriptions"})
+	}
+	subs := []PushSubscription{}
+	if err := cursor.All(context.Background(), &subs); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding push subscription data"})
+	}
+	return c.JSON(http.StatusOK, subs)
+}
+
+// findPushSubscription loads the caller's subscription named by the route.
+// It returns nil after writing the response when there is none.
+func (s *Server) findPushSubscription(c echo.Context, needPush bool) (*PushSubscription, error) {
+	user, err := s.pushUser(c, needPush)
+	if user == "" {
+		return nil, err
+	}
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var sub PushSubscription
+	err = s.pushSubscriptionCollection.FindOne(context.Background(), bson.M{"_id": objectID, "user": user}).Decode(&sub)
+	if err == mongo.ErrNoDocuments {
+		return nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Push subscription not found"})
+	}
+	if err != nil {
+		return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch push subscription"})
+	}
+	return &sub, nil
+}
+
+func (s *Server) deletePushSubscription(c echo.Context) error {
+	sub, err := s.findPushSubscription(c, false)
+	if sub == nil {
+		return err
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Push subscription deleted successfully"})
+	}
+	if _, err := s.pushSubscriptionCollection.DeleteOne(context.Background(), bson.M{"_id": sub.ID}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete push subscription"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Push subscription deleted successfully"})
+}
+
+// testPushSubscription sends a notification to one subscription right away
+// and reports what the push service said.
+func (s *Server) testPushSubscription(c echo.Context) error {
+	sub, err := s.findPushSubscription(c, true)
+	if sub == nil {
+		return err
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Test notification sent"})
+	}
+	err = s.push.send(context.Background(), sub, &pushMessage{
+		Title: "Test notification",
+		Body:  "Notifications are working.",
+		Event: "test",
+	})
+	if err == errPushGone {
+		s.pushSubscriptionCollection.DeleteOne(context.Background(), bson.M{"_id": sub.ID})
+		return c.JSON(http.StatusGone, map[string]string{"error": "Push subscription expired and was removed"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Push delivery failed: " + err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Test notification sent"})
+}
+
+// createReminder schedules a reminder about a task for the caller, either
+// at remind_at or before_due (e.g. 2h, 1d) before the task's due date in
+// the working time of the task's calendar.
+func (s *Server) createReminder(c echo.Context) error {
+	user, err := s.pushUser(c, false)
+	if user == "" {
+		return err
+	}
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var req struct {
+		RemindAt  *time.Time `json:"remind_at"`
+		BeforeDue string     `json:"before_due"`
+		Note      string     `json:"note"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if (req.RemindAt == nil) == (req.BeforeDue == "") {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Exactly one of remind_at and before_due is required"})
+	}
+
+	var task Task
+	err = s.taskCollection.FindOne(context.Background(), bson.M{"_id": taskID}).Decode(&task)
+	if err == mongo.ErrNoDocuments {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+
+	r := &Reminder{
+		ID:        primitive.NewObjectID(),
+		TaskID:    taskID,
+		User:      user,
+		Note:      req.Note,
+		CreatedAt: time.Now(),
+	}
+	if req.RemindAt != nil {
+		r.RemindAt = *req.RemindAt
+	} else {
+		if task.DueDate == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Task has no due date"})
+		}
+		cal, err := s.calendarFor(context.Background(), task.Project, task.Team)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load working calendar"})
+		}
+		if r.RemindAt, err = remindBefore(cal, *task.DueDate, req.BeforeDue); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "before_due must be a duration like 1d or 2h"})
+		}
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, r)
+	}
+	if _, err := s.reminderCollection.InsertOne(context.Background(), r); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create reminder"})
+	}
+	return c.JSON(http.StatusCreated, r)
+}
+
+// remindBefore returns the time before of working time ahead of due. Days
+// ("d") are working days of the calendar's working hours and weeks ("w")
+// five of them; other durations are working hours.
+func remindBefore(cal *Calendar, due time.Time, before string) (time.Time, error) {
+	d, err := parseAge(before)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if d == 0 {
+		return due, nil
+	}
+	if strings.HasSuffix(before, "d") || strings.HasSuffix(before, "w") {
+		days := float64(d) / float64(24*time.Hour)
+		if strings.HasSuffix(before, "w") {
+			days = days * 5 / 7
+		}
+		start, _ := parseClock(cal.WorkStart)
+		end, _ := parseClock(cal.WorkEnd)
+		d = time.Duration(days * float64(end-start))
+	}
+	return cal.AddWorkingTime(due, -d), nil
+}
+
+// getReminders lists the caller's pending reminders, or all of them with
+// ?all=true.
+func (s *Server) getReminders(c echo.Context) error {
+	user, err := s.pushUser(c, false)
+	if user == "" {
+		return err
+	}
+	filter := bson.M{"user": user}
+	if c.QueryParam("all") != "true" {
+		filter["sent_at"] = bson.M{"$exists": false}
+	}
+	cursor, err := s.reminderCollection.Find(context.Background(), filter, options.Find().SetSort(bson.M{"remind_at": 1}))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch reminders"})
+	}
+	reminders := []Reminder{}
+	if err := cursor.All(context.Background(), &reminders); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding reminder data"})
+	}
+	return c.JSON(http.StatusOK, reminders)
+}
+
+func (s *Server) deleteReminder(c echo.Context) error {
+	user, err := s.pushUser(c, false)
+	if user == "" {
+		return err
+	}
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	filter := bson.M{"_id": objectID, "user": user}
+	if isDryRun(c) {
+		count, err := s.reminderCollection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch reminder"})
+		}
+		if count == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Reminder not found"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Reminder deleted successfully"})
+	}
+	result, err := s.reminderCollection.DeleteOne(context.Background(), filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete reminder"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Reminder not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Reminder deleted successfully"})
+}
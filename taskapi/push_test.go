@@ -0,0 +1,80 @@
+package taskapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint    string
+		secure, dev bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", true, true},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", true, true},
+		{"https://203.0.113.7/push", true, true},
+		{"http://fcm.googleapis.com/fcm/send/abc", false, false},
+		{"ftp://example.com/push", false, false},
+		{"https:///push", false, false},
+		{"not a url", false, false},
+		// Nothing on the server's own network, unless a stand-in push
+		// service runs there in development.
+		{"http://localhost:8081/push", false, true},
+		{"http://127.0.0.1:8081/push", false, true},
+		{"http://[::1]:8081/push", false, true},
+		{"https://localhost/push", false, true},
+		{"http://10.0.0.5/push", false, false},
+		{"https://10.0.0.5/push", false, false},
+		{"https://192.168.1.20/push", false, false},
+		{"https://169.254.169.254/latest/meta-data", false, false},
+		{"https://[fd00::1]/push", false, false},
+		{"https://0.0.0.0/push", false, false},
+		{"https://100.64.1.1/push", false, false},
+	}
+	for _, tt := range tests {
+		if got := (&webPush{}).validEndpoint(tt.endpoint); got != tt.secure {
+			t.Errorf("validEndpoint(%q) = %v, want %v", tt.endpoint, got, tt.secure)
+		}
+		if got := (&webPush{allowInsecure: true}).validEndpoint(tt.endpoint); got != tt.dev {
+			t.Errorf("validEndpoint(%q) allowing insecure endpoints = %v, want %v", tt.endpoint, got, tt.dev)
+		}
+	}
+}
+
+func TestRemindBefore(t *testing.T) {
+	cal := defaultCalendar
+	utc := func(value string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		due, before, want string
+	}{
+		{"2024-05-08 17:00", "2h", "2024-05-08 15:00"},
+		{"2024-05-08 17:00", "0d", "2024-05-08 17:00"},
+		// A working day is the calendar's eight working hours.
+		{"2024-05-08 12:00", "1d", "2024-05-07 12:00"},
+		{"2024-05-08 12:00", "1.5d", "2024-05-06 16:00"},
+		// Over the weekend.
+		{"2024-05-06 10:00", "2h", "2024-05-03 16:00"},
+		{"2024-05-06 10:00", "1d", "2024-05-03 10:00"},
+		{"2024-05-08 17:00", "1w", "2024-05-02 09:00"},
+		// Before working hours counts from the previous day's end.
+		{"2024-05-08 07:00", "1h", "2024-05-07 16:00"},
+	}
+	for _, tt := range tests {
+		got, err := remindBefore(&cal, utc(tt.due), tt.before)
+		if err != nil {
+			t.Fatalf("remindBefore(%s, %s) = %v", tt.due, tt.before, err)
+		}
+		if !got.Equal(utc(tt.want)) {
+			t.Errorf("remindBefore(%s, %s) = %s, want %s", tt.due, tt.before, got.UTC().Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+	if _, err := remindBefore(&cal, utc("2024-05-08 17:00"), "soon"); err == nil {
+		t.Error("remindBefore accepted an invalid duration")
+	}
+}
@@ -0,0 +1,182 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Dependency is a finish-to-start link: the task must not be due earlier
+// than LagDays working days after its prerequisite, counted on the task's
+// working calendar.
+type Dependency struct {
+	TaskID  TaskID `bson:"task_id" json:"task_id"`
+	LagDays int    `bson:"lag_days,omitempty" json:"lag_days,omitempty"`
+}
+
+// ensureDependencyIndex lets rescheduling find a task's dependents.
+func (s *Server) ensureDependencyIndex(ctx context.Context) error {
+	_, err := s.taskCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "dependencies.task_id", Value: 1}},
+	})
+	return err
+}
+
+// maxRescheduleSteps bounds propagation so a dependency cycle cannot spin.
+const maxRescheduleSteps = 10000
+
+type rescheduledTask struct {
+	TaskID     TaskID    `json:"task_id"`
+	Title      string    `json:"title"`
+	OldDueDate time.Time `json:"old_due_date"`
+	NewDueDate time.Time `json:"new_due_date"`
+}
+
+type reschedulePlan struct {
+	Shifted []rescheduledTask `json:"shifted"`
+	// Fixed lists dependents that would need to move but opted out.
+	Fixed []rescheduledTask `json:"fixed"`
+}
+
+// planReschedule works out which downstream tasks must move when the task
+// with the given ID becomes due at newDue. A dependent only moves as far as
+// needed to keep its lag after the prerequisite, so slack absorbs part of the
+// delay; pulling a date in never moves dependents.
+func (s *Server) planReschedule(ctx context.Context, id TaskID, newDue time.Time) (*reschedulePlan, error) {
+	plan := &reschedulePlan{Shifted: []rescheduledTask{}, Fixed: []rescheduledTask{}}
+	newDues := map[TaskID]time.Time{id: newDue}
+	shifted := map[TaskID]int{}
+	fixed := map[TaskID]int{}
+	calendars := map[string]*Calendar{}
+
+	queue := []TaskID{id}
+	for steps := 0; len(queue) > 0 && steps < maxRescheduleSteps; steps++ {
+		prereq := queue[0]
+		queue = queue[1:]
+		prereqDue := newDues[prereq]
+
+		cursor, err := s.taskCollection.Find(ctx, bson.M{"dependencies.task_id": prereq})
+		if err != nil {
+			return nil, err
+		}
+		var dependents []Task
+		if err := cursor.All(ctx, &dependents); err != nil {
+			return nil, err
+		}
+
+		for _, dep := range dependents {
+			if dep.DueDate == nil || dep.ID == id {
+				continue
+			}
+			current := *dep.DueDate
+			if due, ok := newDues[dep.ID]; ok {
+				current = due
+			}
+			required := prereqDue
+			if lag := dep.lagAfter(prereq); lag > 0 {
+				key := dep.Project + "\x00" + dep.Team
+				cal, ok := calendars[key]
+				if !ok {
+					if cal, err = s.calendarFor(ctx, dep.Project, dep.Team); err != nil {
+						return nil, err
+					}
+					calendars[key] = cal
+				}
+				required = cal.AddWorkingDays(prereqDue, lag)
+			}
+			if !required.After(current) {
+				continue
+			}
+
+			entry := rescheduledTask{TaskID: dep.ID, Title: dep.Title, OldDueDate: *dep.DueDate, NewDueDate: required}
+			if dep.FixedDueDate {
+				if i, ok := fixed[dep.ID]; ok {
+					plan.Fixed[i] = entry
+				} else {
+					fixed[dep.ID] = len(plan.Fixed)
+					plan.Fixed = append(plan.Fixed, entry)
+				}
+				continue
+			}
+
+			newDues[dep.ID] = required
+			if i, ok := shifted[dep.ID]; ok {
+				plan.Shifted[i] = entry
+			} else {
+				shifted[dep.ID] = len(plan.Shifted)
+				plan.Shifted = append(plan.Shifted, entry)
+			}
+			queue = append(queue, dep.ID)
+		}
+	}
+	return plan, nil
+}
+
+func (t *Task) lagAfter(prereq TaskID) int {
+	for _, d := range t.Dependencies {
+		if d.TaskID == prereq {
+			return d.LagDays
+		}
+	}
+	return 0
+}
+
+// applyReschedule moves the shifted dependents of plan, re-indexing each
+// and announcing it as updated by actor.
+func (s *Server) applyReschedule(ctx context.Context, plan *reschedulePlan, actor string) error {
+	now := time.Now()
+	for _, t := range plan.Shifted {
+		var previous Task
+		err := s.taskCollection.FindOneAndUpdate(ctx, bson.M{"_id": t.TaskID}, bson.M{
+			"$set": bson.M{"due_date": t.NewDueDate, "updated_at": now},
+		}).Decode(&previous)
+		if err == mongo.ErrNoDocuments {
+			// Deleted since the plan was made.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		task, due := previous, t.NewDueDate
+		task.DueDate, task.UpdatedAt = &due, now
+		if err := s.indexTask(ctx, &task); err != nil {
+			s.logger.Errorf("Failed to index task %s: %v", task.ID, err)
+		}
+		s.emit(taskEvent{Type: eventUpdated, Task: task, Previous: &previous, Actor: actor})
+	}
+	return nil
+}
+
+// previewReschedule reports what changing a task's due date would do to its
+// dependents without changing anything.
+func (s *Server) previewReschedule(c echo.Context) error {
+	id, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	var req struct {
+		DueDate time.Time `json:"due_date"`
+	}
+	if err := c.Bind(&req); err != nil || req.DueDate.IsZero() {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "due_date is required"})
+	}
+
+	err = s.taskCollection.FindOne(context.Background(), bson.M{"_id": id}).Err()
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+
+	plan, err := s.planReschedule(context.Background(), id, req.DueDate)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to plan reschedule"})
+	}
+	return c.JSON(http.StatusOK, plan)
+}
@@ -0,0 +1,483 @@
+package taskapi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search sources recorded on each index entry, reported back as the place a
+// query matched.
+const (
+	sourceTask       = "task"
+	sourceComment    = "comment"
+	sourceAttachment = "attachment"
+)
+
+// maxExtractBytes caps how much of an attachment is downloaded for indexing.
+const maxExtractBytes = 10 << 20
+
+type searchEntry struct {
+	ID        string    `bson:"_id"`
+	TaskID    TaskID    `bson:"task_id"`
+	Source    string    `bson:"source"`
+	SourceID  string    `bson:"source_id"`
+	Text      string    `bson:"text"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+type searchMatch struct {
+	Source   string `json:"source"`
+	SourceID string `json:"source_id"`
+	Snippet  string `json:"snippet"`
+}
+
+type searchResult struct {
+	TaskID  TaskID        `json:"task_id"`
+	Title   string        `json:"title"`
+	Score   float64       `json:"score"`
+	Matches []searchMatch `json:"matches"`
+}
+
+func ensureSearchIndex(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "text", Value: "text"}}},
+		{Keys: bson.D{{Key: "task_id", Value: 1}}},
+	})
+	return err
+}
+
+func (s *Server) indexSearchEntry(ctx context.Context, source, sourceID string, taskID TaskID, text string) error {
+	return putSearchEntry(ctx, s.searchCollection, source, sourceID, taskID, text)
+}
+
+func putSearchEntry(ctx context.Context, coll *mongo.Collection, source, sourceID string, taskID TaskID, text string) error {
+	entry := searchEntry{
+		ID:        searchEntryID(source, sourceID),
+		TaskID:    taskID,
+		Source:    source,
+		SourceID:  sourceID,
+		Text:      text,
+		UpdatedAt: time.Now(),
+	}
+	_, err := coll.ReplaceOne(ctx, bson.M{"_id": entry.ID}, entry, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *Server) removeSearchEntry(ctx context.Context, source, sourceID string) error {
+	_, err := s.searchCollection.DeleteOne(ctx, bson.M{"_id": searchEntryID(source, sourceID)})
+	return err
+}
+
+func searchEntryID(source, sourceID string) string {
+	return source + ":" + sourceID
+}
+
+func (s *Server) indexTask(ctx context.Context, task *Task) error {
+	return s.indexSearchEntry(ctx, sourceTask, string(task.ID), task.ID, task.Title+"\n"+task.Description)
+}
+
+// removeTaskFromSearch drops the task and everything attached to it.
+func (s *Server) removeTaskFromSearch(ctx context.Context, taskID TaskID) error {
+	_, err := s.searchCollection.DeleteMany(ctx, bson.M{"task_id": taskID})
+	return err
+}
+
+// rebuildSearchIndex indexes every task, comment and attachment in db and
+// returns how many entries it wrote. indexAttachment indexes the contents of
+// one attachment; without it only attachment filenames are indexed. Once
+// everything is indexed, entries of documents that no longer exist are
+// removed.
+func rebuildSearchIndex(ctx context.Context, db *mongo.Database, indexAttachment func(context.Context, *Attachment) error) (int, error) {
+	index := db.Collection("search_index")
+	if err := ensureSearchIndex(ctx, index); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	seen := map[string]bool{}
+	n := 0
+	err := eachDocument(ctx, db.Collection("tasks"), func(t *Task) error {
+		n++
+		seen[searchEntryID(sourceTask, string(t.ID))] = true
+		return putSearchEntry(ctx, index, sourceTask, string(t.ID), t.ID, t.Title+"\n"+t.Description)
+	})
+	if err != nil {
+		return n, err
+	}
+	err = eachDocument(ctx, db.Collection("comments"), func(cm *Comment) error {
+		n++
+		seen[searchEntryID(sourceComment, cm.ID.Hex())] = true
+		return putSearchEntry(ctx, index, sourceComment, cm.ID.Hex(), cm.TaskID, cm.Body)
+	})
+	if err != nil {
+		return n, err
+	}
+	err = eachDocument(ctx, db.Collection("attachments"), func(att *Attachment) error {
+		n++
+		seen[searchEntryID(sourceAttachment, att.ID.Hex())] = true
+		if indexAttachment == nil {
+			return putSearchEntry(ctx, index, sourceAttachment, att.ID.Hex(), att.TaskID, att.Filename)
+		}
+		return indexAttachment(ctx, att)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, removeUnseenEntries(ctx, index, seen, start)
+}
+
+// removeUnseenEntries deletes the entries of index that are not in seen.
+// Entries written since start, by writes that ran during the rebuild, stay.
+func removeUnseenEntries(ctx context.Context, index *mongo.Collection, seen map[string]bool, start time.Time) error {
+	cursor, err := index.Find(ctx, bson.M{"updated_at": bson.M{"$lt": start}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	var stale []string
+	flush := func() error {
+		if len(stale) == 0 {
+			return nil
+		}
+		_, err := index.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": stale}, "updated_at": bson.M{"$lt": start}})
+		stale = stale[:0]
+		return err
+	}
+	for cursor.Next(ctx) {
+		var entry struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if seen[entry.ID] {
+			continue
+		}
+		stale = append(stale, entry.ID)
+		if len(stale) == jobBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// eachDocument decodes the documents of coll one at a time and calls fn
+// with each, stopping at the first error.
+func eachDocument[T any](ctx context.Context, coll *mongo.Collection, fn func(*T) error) error {
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var doc T
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(&doc); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// reindexSearch rebuilds the server's search index from its data, the way
+// the write paths would have indexed it.
+func (s *Server) reindexSearch(ctx context.Context) (int, error) {
+	return rebuildSearchIndex(ctx, s.db, func(ctx context.Context, att *Attachment) error {
+		if att.Status != attachmentUploaded {
+			return nil
+		}
+		// An attachment that cannot be read is skipped rather than stopping
+		// the rebuild.
+		if err := s.indexAttachmentText(ctx, att); err != nil {
+			s.logger.Errorf("Failed to index attachment %s: %v", att.ID.Hex(), err)
+		}
+		return nil
+	})
+}
+
+// startSearchBackfill builds the search index in the background when it is
+// empty but there are tasks, e.g. on the first start after search was added.
+func (s *Server) startSearchBackfill(ctx context.Context) {
+	s.goWorker(func() {
+		entries, err := s.searchCollection.EstimatedDocumentCount(ctx)
+		if err != nil || entries > 0 {
+			return
+		}
+		tasks, err := s.taskCollection.EstimatedDocumentCount(ctx)
+		if err != nil || tasks == 0 {
+			return
+		}
+		s.logger.Infof("Search index is empty; indexing %d tasks", tasks)
+		n, err := s.reindexSearch(ctx)
+		if err != nil {
+			s.logger.Errorf("Search backfill failed after %d entries: %v", n, err)
+			return
+		}
+		s.logger.Infof("Search backfill indexed %d entries", n)
+	})
+}
+
+// rebuildSearch re-indexes everything, for data written before search
+// existed or an index that has drifted.
+func (s *Server) rebuildSearch(c echo.Context) error {
+	ctx := context.Background()
+	if isDryRun(c) {
+		var total int64
+		for _, coll := range []*mongo.Collection{s.taskCollection, s.commentCollection, s.attachmentCollection} {
+			n, err := coll.CountDocuments(ctx, bson.M{})
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to count documents"})
+			}
+			total += n
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"indexed": total})
+	}
+
+	n, err := s.reindexSearch(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{"error": "Search rebuild failed", "indexed": n})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"indexed": n})
+}
+
+// indexAttachmentText downloads an uploaded attachment and indexes its text,
+// if it is a format we can extract text from.
+func (s *Server) indexAttachmentText(ctx context.Context, att *Attachment) error {
+	kind := attachmentTextKind(att)
+	if kind == "" || s.blobStore == nil {
+		return nil
+	}
+	body, err := s.blobStore.getObject(ctx, att.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxExtractBytes))
+	if err != nil {
+		return err
+	}
+
+	var text string
+	if kind == "pdf" {
+		text = extractPDFText(data)
+	} else {
+		text = strings.ToValidUTF8(string(data), " ")
+	}
+	return s.indexSearchEntry(ctx, sourceAttachment, att.ID.Hex(), att.TaskID, att.Filename+"\n"+text)
+}
+
+func attachmentTextKind(att *Attachment) string {
+	ct := strings.ToLower(att.ContentType)
+	ext := strings.ToLower(path.Ext(att.Filename))
+	switch {
+	case ct == "application/pdf" || ext == ".pdf":
+		return "pdf"
+	case strings.HasPrefix(ct, "text/"), ct == "application/json", ct == "application/xml":
+		return "text"
+	}
+	switch ext {
+	case ".txt", ".log", ".md", ".csv", ".json", ".xml", ".yaml", ".yml":
+		return "text"
+	}
+	return ""
+}
+
+var (
+	pdfStreamRe = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n(.*?)\r?\nendstream`)
+	pdfTextRe   = regexp.MustCompile(`(?s)BT(.*?)ET`)
+	pdfStringRe = regexp.MustCompile(`\((?:\\.|[^\\)])*\)\s*(?:Tj|'|")|\[(?:[^\]])*\]\s*TJ`)
+	pdfLitRe    = regexp.MustCompile(`\((?:\\.|[^\\)])*\)`)
+)
+
+// extractPDFText is a best-effort extractor for the text operators in PDF
+// content streams. It handles uncompressed and Flate streams with simple
+// string encodings, which covers the log exports and reports we attach; it
+// does not attempt font-specific glyph mapping.
+func extractPDFText(data []byte) string {
+	var out strings.Builder
+	for _, m := range pdfStreamRe.FindAllSubmatch(data, -1) {
+		dict, stream := m[1], m[2]
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			inflated, err := io.ReadAll(io.LimitReader(zr, maxExtractBytes))
+			zr.Close()
+			if err != nil && len(inflated) == 0 {
+				continue
+			}
+			stream = inflated
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue
+		}
+
+		for _, block := range pdfTextRe.FindAllSubmatch(stream, -1) {
+			for _, op := range pdfStringRe.FindAll(block[1], -1) {
+				for _, lit := range pdfLitRe.FindAll(op, -1) {
+					out.WriteString(unescapePDFString(lit[1 : len(lit)-1]))
+				}
+				out.WriteByte(' ')
+			}
+			out.WriteByte('\n')
+		}
+	}
+	return strings.ToValidUTF8(out.String(), " ")
+}
+
+func unescapePDFString(s []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			v, _ := strconv.ParseUint(string(s[i:j]), 8, 8)
+			b.WriteByte(byte(v))
+			i = j - 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// snippet returns a short excerpt of text around the first query term found.
+func snippet(text, q string) string {
+	const radius = 60
+	lower := strings.ToLower(text)
+	pos := -1
+	for _, term := range strings.Fields(strings.ToLower(q)) {
+		if i := strings.Index(lower, strings.Trim(term, `"-`)); i >= 0 {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	start, end := pos-radius, pos+radius
+	if start < 0 {
+		start = 0
+	}
+	if end > len(text) {
+		end = len(text)
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	s := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(text) {
+		s += "…"
+	}
+	return s
+}
+
+// searchTasks runs a full-text query over task text, comments and attachment
+// contents, and groups the hits by task with the sources that matched. Hits
+// on tasks that are no longer in Mongo, such as tiered ones, are dropped
+// before the limit applies.
+func (s *Server) searchTasks(c echo.Context) error {
+	q := c.QueryParam("q")
+	if q == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "q is required"})
+	}
+	limit := 20
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+		}
+		limit = n
+	}
+
+	ctx := context.Background()
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$text": bson.M{"$search": q}}}},
+		{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+		{{Key: "$sort", Value: bson.M{"score": -1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     "$task_id",
+			"score":   bson.M{"$max": "$score"},
+			"entries": bson.M{"$push": bson.M{"source": "$source", "source_id": "$source_id", "text": "$text"}},
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         s.taskCollection.Name(),
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "task",
+		}}},
+		{{Key: "$match", Value: bson.M{"task.0": bson.M{"$exists": true}}}},
+		{{Key: "$sort", Value: bson.M{"score": -1}}},
+		{{Key: "$limit", Value: limit}},
+		{{Key: "$set", Value: bson.M{"title": bson.M{"$arrayElemAt": bson.A{"$task.title", 0}}}}},
+		{{Key: "$unset", Value: "task"}},
+	}
+	cursor, err := s.searchCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search tasks"})
+	}
+	var groups []struct {
+		TaskID  TaskID  `bson:"_id"`
+		Score   float64 `bson:"score"`
+		Title   string  `bson:"title"`
+		Entries []struct {
+			Source   string `bson:"source"`
+			SourceID string `bson:"source_id"`
+			Text     string `bson:"text"`
+		} `bson:"entries"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding search results"})
+	}
+
+	results := []searchResult{}
+	for _, g := range groups {
+		r := searchResult{TaskID: g.TaskID, Title: g.Title, Score: g.Score}
+		for _, e := range g.Entries {
+			r.Matches = append(r.Matches, searchMatch{Source: e.Source, SourceID: e.SourceID, Snippet: snippet(e.Text, q)})
+		}
+		results = append(results, r)
+	}
+	return c.JSON(http.StatusOK, results)
+}
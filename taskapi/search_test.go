@@ -0,0 +1,39 @@
+package taskapi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("a ", 100) + "needle " + strings.Repeat("b ", 100)
+	tests := []struct {
+		text, q    string
+		want       string
+		wantPrefix bool
+		wantSuffix bool
+	}{
+		{"Fix the login bug", "login", "Fix the login bug", false, false},
+		{"Fix the\n\nlogin   bug", "LOGIN", "Fix the login bug", false, false},
+		{"No match here", "absent", "No match here", false, false},
+		{long, "needle", "", true, true},
+		{long, `"needle"`, "", true, true},
+		{long, "-absent needle", "", true, true},
+	}
+	for _, tt := range tests {
+		got := snippet(tt.text, tt.q)
+		if tt.want != "" && got != tt.want {
+			t.Errorf("snippet(%.20q, %q) = %q, want %q", tt.text, tt.q, got, tt.want)
+		}
+		if strings.HasPrefix(got, "…") != tt.wantPrefix || strings.HasSuffix(got, "…") != tt.wantSuffix {
+			t.Errorf("snippet(%.20q, %q) = %q, want ellipses %v/%v", tt.text, tt.q, got, tt.wantPrefix, tt.wantSuffix)
+		}
+		if tt.want == "" && !strings.Contains(got, "needle") {
+			t.Errorf("snippet(%.20q, %q) = %q, want it around the match", tt.text, tt.q, got)
+		}
+	}
+	// Cuts never split a multi-byte rune.
+	if got := snippet(strings.Repeat("é", 200)+"needle", "needle"); !strings.HasPrefix(got, "…é") {
+		t.Errorf("snippet split a rune: %q", got[:8])
+	}
+}
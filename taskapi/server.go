@@ -0,0 +1,599 @@
+// Package taskapi is the task API server. It can run on its own (see the
+// mylearning command) or be embedded in another service, either mounted onto
+// an existing echo instance or served as an http.Handler.
+package taskapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Server holds the API's storage and background workers. Create it with New.
+type Server struct {
+	db         *mongo.Database
+	auth       Auth
+	prefix     string
+	middleware []echo.MiddlewareFunc
+	logger     echo.Logger
+
+	idStrategy       string
+	coldDir          string
+	jobDir           string
+	jobWorkers       int
+	importLimit      int64
+	tieringAfterDays int
+	deprecatedRoutes map[string]bool
+
+	taskCollection             *mongo.Collection
+	attachmentCollection       *mongo.Collection
+	calendarCollection         *mongo.Collection
+	commentCollection          *mongo.Collection
+	searchCollection           *mongo.Collection
+	usageCollection            *mongo.Collection
+	jobCollection              *mongo.Collection
+	wipLimitCollection         *mongo.Collection
+	dailyPlanCollection        *mongo.Collection
+	timeEntryCollection        *mongo.Collection
+	billingRateCollection      *mongo.Collection
+	invoiceCollection          *mongo.Collection
+	counterCollection          *mongo.Collection
+	notificationRuleCollection *mongo.Collection
+	notificationCollection     *mongo.Collection
+	estimationCollection       *mongo.Collection
+	workflowCollection         *mongo.Collection
+	pushSubscriptionCollection *mongo.Collection
+	reminderCollection         *mongo.Collection
+
+	cold      *coldStore
+	blobStore *s3Store
+	smtp      *smtpConfig
+	push      *webPush
+	events    chan taskEvent
+	// droppedEvents counts events emit gave up on.
+	droppedEvents atomic.Int64
+	mqtt          *mqttBridge
+	users         *UserStore
+	dev           *devState
+	usage         *usageRecorder
+	shedder       *loadShedder
+
+	estimationHub *sessionHub
+
+	runningJobsMu sync.Mutex
+	runningJobs   map[primitive.ObjectID]context.CancelFunc
+
+	indexesReady bool
+
+	// ctx is the workers' context, which Close cancels.
+	ctx     context.Context
+	stop    context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// An Option configures a Server.
+type Option func(*Server) error
+
+// WithDatabase sets the database the server stores its data in. It is
+// required.
+func WithDatabase(db *mongo.Database) Option {
+	return func(s *Server) error {
+		s.db = db
+		return nil
+	}
+}
+
+// WithAuth sets how callers are identified. The default is HeaderAuth with
+// no admin token, which closes the admin routes; StoreAuth uses the accounts
+// managed with UserStore.
+func WithAuth(auth Auth) Option {
+	return func(s *Server) error {
+		s.auth = auth
+		return nil
+	}
+}
+
+// WithMiddleware adds middleware that runs on every API route, after the
+// server's own usage tracking, load shedding and dry-run handling.
+func WithMiddleware(mw ...echo.MiddlewareFunc) Option {
+	return func(s *Server) error {
+		s.middleware = append(s.middleware, mw...)
+		return nil
+	}
+}
+
+// WithPrefix mounts the API routes under prefix, e.g. "/api/tasks".
+func WithPrefix(prefix string) Option {
+	return func(s *Server) error {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return errors.New("prefix must start with /")
+		}
+		s.prefix = strings.TrimSuffix(prefix, "/")
+		return nil
+	}
+}
+
+// WithLogger sets the logger for background work and startup problems.
+func WithLogger(logger echo.Logger) Option {
+	return func(s *Server) error {
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithIDStrategy selects how new task IDs are generated: "objectid" (the
+// default), "ulid" or "uuidv7".
+func WithIDStrategy(name string) Option {
+	return func(s *Server) error {
+		return s.setIDStrategy(name)
+	}
+}
+
+// WithColdStorage sets the directory closed tasks are tiered into. The
+// default is "cold".
+func WithColdStorage(dir string) Option {
+	return func(s *Server) error {
+		s.coldDir = dir
+		return nil
+	}
+}
+
+// WithTiering moves tasks closed more than afterDays days ago to cold
+// storage once a day. Tiering only runs on demand by default.
+func WithTiering(afterDays int) Option {
+	return func(s *Server) error {
+		s.tieringAfterDays = afterDays
+		return nil
+	}
+}
+
+// WithJobs sets the directory import uploads are spooled to and the number
+// of job workers. The defaults are "jobs" and 2.
+func WithJobs(dir string, workers int) Option {
+	return func(s *Server) error {
+		s.jobDir, s.jobWorkers = dir, workers
+		return nil
+	}
+}
+
+// WithImportLimit caps the size of an import upload in bytes. The default
+// is 100 MiB.
+func WithImportLimit(maxBytes int64) Option {
+	return func(s *Server) error {
+		if maxBytes <= 0 {
+			return errors.New("import limit must be positive")
+		}
+		s.importLimit = maxBytes
+		return nil
+	}
+}
+
+// WithS3 stores attachments in an S3-compatible bucket. Attachment routes
+// answer 503 without it.
+func WithS3(endpoint, bucket, region, accessKey, secretKey string) Option {
+	return func(s *Server) error {
+		store, err := newS3Store(endpoint, bucket, region, accessKey, secretKey)
+		if err != nil {
+			return err
+		}
+		s.blobStore = store
+		return nil
+	}
+}
+
+// WithSMTP sends email notifications through the SMTP server at addr
+// (host:port) from the given address, authenticating when username is set.
+// Email notification rules are refused without it.
+func WithSMTP(addr, from, username, password string) Option {
+	return func(s *Server) error {
+		if addr == "" || from == "" {
+			return errors.New("SMTP needs an address and a sender")
+		}
+		s.smtp = &smtpConfig{addr: addr, from: from, username: username, password: password}
+		return nil
+	}
+}
+
+// WithDeprecatedRoutes marks routes, given as "METHOD /route" using echo
+// route templates relative to the prefix, as deprecated.
+func WithDeprecatedRoutes(routes ...string) Option {
+	return func(s *Server) error {
+		s.deprecatedRoutes = parseDeprecatedRoutes(strings.Join(routes, ","))
+		return nil
+	}
+}
+
+// New creates a Server, preparing its collections, indexes and storage
+// directories. Call Start to run its background workers and Close to stop
+// them.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		auth:             HeaderAuth{},
+		logger:           log.New("taskapi"),
+		idStrategy:       idStrategyObjectID,
+		coldDir:          "cold",
+		jobDir:           "jobs",
+		jobWorkers:       2,
+		importLimit:      defaultImportLimit,
+		deprecatedRoutes: map[string]bool{},
+		usage:            newUsageRecorder(),
+		shedder:          &loadShedder{limit: initialLimit, windowStart: time.Now()},
+		runningJobs:      map[primitive.ObjectID]context.CancelFunc{},
+		events:           make(chan taskEvent, eventBufferSize),
+		estimationHub:    &sessionHub{subs: map[primitive.ObjectID]map[chan sessionEvent]struct{}{}},
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.db == nil {
+		return nil, errors.New("taskapi: a database is required")
+	}
+
+	s.taskCollection = s.db.Collection("tasks")
+	s.attachmentCollection = s.db.Collection("attachments")
+	s.calendarCollection = s.db.Collection("calendars")
+	s.commentCollection = s.db.Collection("comments")
+	s.searchCollection = s.db.Collection("search_index")
+	s.usageCollection = s.db.Collection("api_usage")
+	s.jobCollection = s.db.Collection("jobs")
+	s.wipLimitCollection = s.db.Collection("wip_limits")
+	s.dailyPlanCollection = s.db.Collection("daily_plans")
+	s.timeEntryCollection = s.db.Collection("time_entries")
+	s.billingRateCollection = s.db.Collection("billing_rates")
+	s.invoiceCollection = s.db.Collection("invoices")
+	s.counterCollection = s.db.Collection("counters")
+	s.notificationRuleCollection = s.db.Collection("notification_rules")
+	s.notificationCollection = s.db.Collection("notifications")
+	s.estimationCollection = s.db.Collection("estimation_sessions")
+	s.workflowCollection = s.db.Collection("workflows")
+	s.pushSubscriptionCollection = s.db.Collection("push_subscriptions")
+	s.reminderCollection = s.db.Collection("reminders")
+	s.users = NewUserStore(s.db)
+
+	// Index creation failures are not fatal, so the server can start while
+	// MongoDB is still coming up; Start tries again in the background.
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	s.indexesReady = s.ensureIndexes(ctx) == nil
+	cancel()
+
+	var err error
+	if s.cold, err = openColdStore(s.coldDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.jobDir, 0o755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// indexTimeout bounds index creation in New, so an unreachable MongoDB does
+// not hold up startup.
+const indexTimeout = 10 * time.Second
+
+// ensureIndexes creates the indexes of every collection, logging failures
+// and returning them joined.
+func (s *Server) ensureIndexes(ctx context.Context) error {
+	steps := []struct {
+		what   string
+		ensure func(context.Context) error
+	}{
+		{"external reference index", s.ensureExternalRefIndex},
+		{"status index", s.ensureStatusIndex},
+		{"dependency index", s.ensureDependencyIndex},
+		{"search index", func(ctx context.Context) error { return ensureSearchIndex(ctx, s.searchCollection) }},
+		{"calendar indexes", s.ensureCalendarIndexes},
+		{"daily plan index", s.ensureDailyPlanIndex},
+		{"time entry index", s.ensureTimeEntryIndex},
+		{"billing rate index", s.ensureBillingRateIndex},
+		{"notification indexes", s.ensureNotificationIndexes},
+		{"workflow index", s.ensureWorkflowIndex},
+		{"push indexes", s.ensurePushIndexes},
+		{"user indexes", s.users.EnsureIndexes},
+	}
+	var errs []error
+	for _, step := range steps {
+		if err := step.ensure(ctx); err != nil {
+			s.logger.Errorf("Failed to create %s: %v", step.what, err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Start runs the background workers: job workers, the job result sweep,
+// usage flushing, notification delivery, search backfill and, when
+// configured, the MQTT bridge, reminders, upload cleanup and tiering. It
+// also retries the indexes New failed to create. The workers run until ctx
+// ends or Close is called. Call it once.
+func (s *Server) Start(ctx context.Context) {
+	ctx, s.stop = context.WithCancel(ctx)
+	s.ctx = ctx
+	if !s.indexesReady {
+		s.goWorker(func() { s.retryIndexes(ctx) })
+	}
+	s.startUsageLoop(ctx)
+	s.startJobWorkers(ctx, s.jobWorkers)
+	s.startJobResultSweep(ctx)
+	s.startNotifier(ctx)
+	s.startSearchBackfill(ctx)
+	if s.mqtt != nil {
+		s.startMQTTBridge(ctx)
+	}
+	if s.push != nil {
+		s.startReminderLoop(ctx)
+	}
+	if s.blobStore != nil {
+		s.startAttachmentCleanupLoop(ctx)
+	}
+	if s.tieringAfterDays > 0 {
+		s.startTieringLoop(ctx, s.tieringAfterDays)
+	}
+}
+
+// Close stops the background workers and waits for them to finish what
+// they are doing. Running jobs are handed back to the queue.
+func (s *Server) Close() error {
+	if s.stop != nil {
+		s.stop()
+	}
+	s.workers.Wait()
+	return nil
+}
+
+// workerContext is the context for work a handler leaves running after it
+// responds: it ends when Close is called.
+func (s *Server) workerContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// goWorker runs fn in a goroutine that Close waits for.
+func (s *Server) goWorker(fn func()) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn()
+	}()
+}
+
+// sleep waits for d and reports whether ctx is still live afterwards.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// retryIndexes creates the indexes New could not, once a minute until it
+// succeeds.
+func (s *Server) retryIndexes(ctx context.Context) {
+	for sleep(ctx, time.Minute) {
+		if s.ensureIndexes(ctx) == nil {
+			s.logger.Infof("Created the indexes that failed at startup")
+			return
+		}
+	}
+}
+
+// Handler returns the API as a standalone http.Handler, for mounting in a
+// plain net/http mux.
+func (s *Server) Handler() http.Handler {
+	e := echo.New()
+	e.Logger = s.logger
+	e.Use(middleware.Recover())
+	s.Register(e)
+	return e
+}
+
+// Register mounts the API routes onto e under the configured prefix.
+func (s *Server) Register(e *echo.Echo) {
+	mw := append([]echo.MiddlewareFunc{s.usageMiddleware, s.loadShedMiddleware, s.dryRunMiddleware}, s.middleware...)
+	if s.dev != nil {
+		mw = append([]echo.MiddlewareFunc{s.mockMiddleware}, mw...)
+	}
+	g := e.Group(s.prefix, mw...)
+
+	g.GET("/healthz", s.healthCheck)
+	g.GET("/auth/password-reset", s.getPasswordReset)
+	g.POST("/auth/password-reset", s.resetPassword)
+	g.POST("/auth/api-keys", s.createAPIKey)
+	g.GET("/auth/api-keys", s.getAPIKeys)
+	g.DELETE("/auth/api-keys/:keyId", s.revokeAPIKey)
+
+	if s.dev != nil {
+		if s.dev.reset {
+			g.POST("/dev/reset", s.resetDemoData)
+		}
+		g.GET("/dev/fixtures", s.getDemoData)
+	}
+
+	g.POST("/tasks", s.createTask)
+	g.GET("/tasks", s.getAllTasks)
+	g.GET("/tasks/:id", s.getTaskByID)
+	g.PUT("/tasks/:id", s.updateTask)
+	g.DELETE("/tasks/:id", s.deleteTask)
+	g.POST("/tasks/:id/reschedule-preview", s.previewReschedule)
+	g.POST("/tasks/:id/move", s.moveTask)
+	g.GET("/tasks/:id/sla", s.getTaskSLA)
+	g.POST("/tasks/:id/reminders", s.createReminder)
+	g.GET("/tasks/external/:source/:externalId", s.getExternalTask)
+	g.PUT("/tasks/external/:source/:externalId", s.upsertExternalTask)
+	g.GET("/archive/search", s.searchColdTasks)
+	g.GET("/search", s.searchTasks)
+
+	g.POST("/tasks/:id/comments", s.createComment)
+	g.GET("/tasks/:id/comments", s.getTaskComments)
+	g.PUT("/tasks/:id/comments/:commentId", s.updateComment)
+	g.DELETE("/tasks/:id/comments/:commentId", s.deleteComment)
+
+	g.POST("/tasks/:id/time-entries", s.createTimeEntry)
+	g.GET("/tasks/:id/time-entries", s.getTaskTimeEntries)
+	g.DELETE("/tasks/:id/time-entries/:entryId", s.deleteTimeEntry)
+
+	g.POST("/calendars", s.createCalendar)
+	g.GET("/calendars", s.getAllCalendars)
+	g.GET("/calendars/:id", s.getCalendarByID)
+	g.PUT("/calendars/:id", s.updateCalendar)
+	g.DELETE("/calendars/:id", s.deleteCalendar)
+	g.POST("/calendars/:id/holidays/import", s.importCalendarHolidays)
+	g.GET("/calendars/:id/duration", s.getCalendarDuration)
+
+	attachments := g.Group("/tasks/:id/attachments", s.requireBlobStore)
+	attachments.POST("", s.createAttachment)
+	attachments.GET("", s.getTaskAttachments)
+	attachments.POST("/:attachmentId/complete", s.completeAttachment)
+	attachments.GET("/:attachmentId/download", s.downloadAttachment)
+	attachments.DELETE("/:attachmentId", s.deleteAttachment)
+
+	g.POST("/estimation-sessions", s.createEstimationSession)
+	g.GET("/estimation-sessions", s.getEstimationSessions)
+	g.GET("/estimation-sessions/:id", s.getEstimationSession)
+	g.GET("/estimation-sessions/:id/events", s.streamEstimationSession)
+	g.PUT("/estimation-sessions/:id/tasks/:taskId/vote", s.voteEstimate)
+	g.POST("/estimation-sessions/:id/tasks/:taskId/reveal", s.revealEstimates)
+	g.POST("/estimation-sessions/:id/tasks/:taskId/reset", s.resetEstimates)
+	g.POST("/estimation-sessions/:id/tasks/:taskId/accept", s.acceptEstimate)
+	g.POST("/estimation-sessions/:id/close", s.closeEstimationSession)
+
+	g.GET("/projects/:project/workflow", s.getProjectWorkflow)
+	g.GET("/reports/categories", s.getCategoryReport)
+
+	g.GET("/me/day/:date", s.getDailyPlan)
+	g.POST("/me/day/:date/items", s.addDailyPlanItem)
+	g.DELETE("/me/day/:date/items/:taskId", s.removeDailyPlanItem)
+	g.PUT("/me/day/:date/order", s.reorderDailyPlan)
+	g.GET("/me/day/:date/suggestions", s.getDailyPlanSuggestions)
+	g.GET("/me/days", s.getDailyPlanHistory)
+	g.GET("/me/reminders", s.getReminders)
+	g.DELETE("/me/reminders/:id", s.deleteReminder)
+	g.GET("/push/vapid-public-key", s.getVAPIDPublicKey)
+	g.POST("/me/push-subscriptions", s.createPushSubscription)
+	g.GET("/me/push-subscriptions", s.getPushSubscriptions)
+	g.DELETE("/me/push-subscriptions/:id", s.deletePushSubscription)
+	g.POST("/me/push-subscriptions/:id/test", s.testPushSubscription)
+
+	admin := g.Group("/admin", s.requireAdmin)
+	admin.POST("/tiering", s.runTiering)
+	admin.POST("/search/rebuild", s.rebuildSearch)
+	admin.GET("/usage", s.getUsage)
+	admin.GET("/loadshed", s.getLoadShedStats)
+	admin.POST("/wip-limits", s.createWIPLimit)
+	admin.GET("/wip-limits", s.getAllWIPLimits)
+	admin.PUT("/wip-limits/:id", s.updateWIPLimit)
+	admin.DELETE("/wip-limits/:id", s.deleteWIPLimit)
+	admin.POST("/notification-rules", s.createNotificationRule)
+	admin.GET("/notification-rules", s.getAllNotificationRules)
+	admin.GET("/notification-rules/:id", s.getNotificationRule)
+	admin.PUT("/notification-rules/:id", s.updateNotificationRule)
+	admin.DELETE("/notification-rules/:id", s.deleteNotificationRule)
+	admin.GET("/notifications", s.getNotifications)
+	admin.POST("/workflows", s.createWorkflow)
+	admin.GET("/workflows", s.getAllWorkflows)
+	admin.PUT("/workflows/:id", s.updateWorkflow)
+	admin.DELETE("/workflows/:id", s.deleteWorkflow)
+	admin.GET("/mqtt", s.getMQTTStatus)
+	admin.POST("/billing-rates", s.createBillingRate)
+	admin.GET("/billing-rates", s.getAllBillingRates)
+	admin.PUT("/billing-rates/:id", s.updateBillingRate)
+	admin.DELETE("/billing-rates/:id", s.deleteBillingRate)
+	admin.POST("/invoices", s.createInvoice)
+	admin.GET("/invoices", s.getAllInvoices)
+	admin.GET("/invoices/:id", s.getInvoice)
+	admin.POST("/invoices/:id/issue", s.issueInvoice)
+	admin.DELETE("/invoices/:id", s.deleteInvoice)
+	admin.GET("/invoices/:id/export", s.exportInvoice)
+
+	g.POST("/jobs/exports", s.createExportJob)
+	g.POST("/jobs/imports", s.createImportJob)
+	g.POST("/jobs/bulk-updates", s.createBulkUpdateJob)
+	g.GET("/jobs", s.getAllJobs)
+	g.GET("/jobs/:id", s.getJob)
+	g.GET("/jobs/:id/result", s.getJobResult)
+	g.POST("/jobs/:id/cancel", s.cancelJob)
+}
+
+// route returns the matched route template without the mount prefix.
+func (s *Server) route(c echo.Context) string {
+	return strings.TrimPrefix(c.Path(), s.prefix)
+}
+
+// Auth identifies the caller of a request.
+type Auth interface {
+	// User returns the caller's user ID, or "" for anonymous requests.
+	User(c echo.Context) string
+	// IsAdmin reports whether the caller may use the /admin routes.
+	IsAdmin(c echo.Context) bool
+}
+
+// HeaderAuth takes the user from the X-User-ID header and requires
+// AdminToken as a bearer token for admin routes. When AdminToken is empty the
+// admin routes are closed, unless InsecureOpenAdmin opens them to everyone.
+type HeaderAuth struct {
+	AdminToken string
+	// InsecureOpenAdmin lets anyone use the admin routes when no AdminToken
+	// is set. Only use it on trusted local setups.
+	InsecureOpenAdmin bool
+}
+
+func (a HeaderAuth) User(c echo.Context) string {
+	return strings.TrimSpace(c.Request().Header.Get("X-User-ID"))
+}
+
+func (a HeaderAuth) IsAdmin(c echo.Context) bool {
+	if a.AdminToken == "" {
+		return a.InsecureOpenAdmin
+	}
+	return c.Request().Header.Get("Authorization") == "Bearer "+a.AdminToken
+}
+
+// requireAdmin guards the /admin routes.
+func (s *Server) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !s.isAdminRequest(c) {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Admin token required"})
+		}
+		return next(c)
+	}
+}
+
+func (s *Server) isAdminRequest(c echo.Context) bool {
+	return s.auth.IsAdmin(c)
+}
+
+// allowOverride reports whether the request bypasses a rule with
+// ?param=true. Only admins may, and only ones proven by credentials: with
+// HeaderAuth and no AdminToken, InsecureOpenAdmin would otherwise let anyone
+// ignore the rule.
+func (s *Server) allowOverride(c echo.Context, param string) bool {
+	if c.QueryParam(param) != "true" {
+		return false
+	}
+	if a, ok := s.auth.(HeaderAuth); ok && a.AdminToken == "" {
+		return false
+	}
+	return s.isAdminRequest(c)
+}
+
+// currentUser identifies the caller. It returns "" for anonymous requests.
+func (s *Server) currentUser(c echo.Context) string {
+	return s.auth.User(c)
+}
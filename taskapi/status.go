@@ -0,0 +1,146 @@
+package taskapi
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StatusPeriod is a stretch of time a task spent in one status. The current
+// period has no ExitedAt.
+type StatusPeriod struct {
+	Status    string     `bson:"status" json:"status"`
+	EnteredAt time.Time  `bson:"entered_at" json:"entered_at"`
+	ExitedAt  *time.Time `bson:"exited_at,omitempty" json:"exited_at,omitempty"`
+}
+
+func (s *Server) ensureStatusIndex(ctx context.Context) error {
+	_, err := s.taskCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "status_since", Value: 1}},
+	})
+	return err
+}
+
+// statusPeriods returns the task's status history. Tasks stored before
+// history was recorded get a single period starting at their last update,
+// which is when they were last known to be in their status.
+func (t *Task) statusPeriods() []StatusPeriod {
+	if len(t.StatusHistory) > 0 {
+		return t.StatusHistory
+	}
+	return []StatusPeriod{{Status: t.Status, EnteredAt: t.UpdatedAt}}
+}
+
+// startStatusHistory begins the history of a new task.
+func (t *Task) startStatusHistory() {
+	t.StatusHistory = []StatusPeriod{{Status: t.Status, EnteredAt: t.CreatedAt}}
+	t.StatusSince = &t.CreatedAt
+}
+
+// historyWith returns the task's status history with the current period
+// closed and one for status opened at the given time.
+func (t *Task) historyWith(status string, at time.Time) []StatusPeriod {
+	history := append([]StatusPeriod(nil), t.statusPeriods()...)
+	for i := range history {
+		if history[i].ExitedAt == nil {
+			history[i].ExitedAt = &at
+		}
+	}
+	return append(history, StatusPeriod{Status: status, EnteredAt: at})
+}
+
+// fillTimeInStatus sets the cumulative seconds the task has spent in each
+// status up to now.
+func (t *Task) fillTimeInStatus(now time.Time) {
+	t.TimeInStatus = map[string]int64{}
+	for _, p := range t.statusPeriods() {
+		end := now
+		if p.ExitedAt != nil {
+			end = *p.ExitedAt
+		}
+		if end.After(p.EnteredAt) {
+			t.TimeInStatus[p.Status] += int64(end.Sub(p.EnteredAt).Seconds())
+		}
+	}
+}
+
+// legacyStatusHistory is the history statusPeriods implies for a task stored
+// before history was recorded, as an aggregation expression.
+var legacyStatusHistory = bson.A{bson.M{"status": "$status", "entered_at": "$updated_at"}}
+
+// keepStatusPipeline is an update pipeline for changes that leave the status
+// alone. It writes out the implied history of a task stored before history
+// was recorded, which would otherwise restart at the update.
+func keepStatusPipeline() []bson.M {
+	return []bson.M{{"$set": bson.M{
+		"status_history": bson.M{"$ifNull": bson.A{"$status_history", legacyStatusHistory}},
+		"status_since":   bson.M{"$ifNull": bson.A{"$status_since", "$updated_at"}},
+	}}}
+}
+
+// statusChangePipeline is an update pipeline that moves tasks into status
+// at now, closing their current status period the same way historyWith
+// does. Apply it only to tasks not already in status.
+func statusChangePipeline(status string, now time.Time) []bson.M {
+	return []bson.M{{"$set": bson.M{
+		"status_history": bson.M{"$concatArrays": bson.A{
+			bson.M{"$map": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$status_history", legacyStatusHistory}},
+				"as":    "p",
+				"in": bson.M{"$cond": bson.A{
+					bson.M{"$ifNull": bson.A{"$$p.exited_at", false}},
+					"$$p",
+					bson.M{"$mergeObjects": bson.A{"$$p", bson.M{"exited_at": now}}},
+				}},
+			}},
+			bson.A{bson.M{"status": bson.M{"$literal": status}, "entered_at": now}},
+		}},
+		"status_since": now,
+		"status":       bson.M{"$literal": status},
+	}}}
+}
+
+// literalStage is a pipeline stage that sets fields to the given values
+// as they are, so that strings starting with "$" are not read as field
+// paths.
+func literalStage(fields bson.M) bson.M {
+	set := bson.M{}
+	for k, v := range fields {
+		set[k] = bson.M{"$literal": v}
+	}
+	return bson.M{"$set": set}
+}
+
+// inStatusLongerThan matches tasks that entered their current status before
+// cutoff. Tasks without recorded history are judged by their last update,
+// which never overstates the time.
+func inStatusLongerThan(cutoff time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"status_since": bson.M{"$lte": cutoff}},
+		{"status_since": nil, "updated_at": bson.M{"$lte": cutoff}},
+	}}
+}
+
+// parseAge parses a duration such as "3d", "2w" or anything
+// time.ParseDuration accepts.
+func parseAge(v string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(v, suffix); ok {
+			f, err := strconv.ParseFloat(n, 64)
+			if err != nil || f < 0 {
+				return 0, errors.New("invalid duration " + v)
+			}
+			return time.Duration(f * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid duration " + v)
+	}
+	return d, nil
+}
@@ -0,0 +1,89 @@
+package taskapi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"3d", 72 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{"0d", 0, false},
+		{"90m", 90 * time.Minute, false},
+		{"2h30m", 150 * time.Minute, false},
+		{"", 0, true},
+		{"d", 0, true},
+		{"-1d", 0, true},
+		{"-5m", 0, true},
+		{"xw", 0, true},
+		{"3 days", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseAge(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAge(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseAge(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusChangePipeline(t *testing.T) {
+	now := time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC)
+	pipeline := statusChangePipeline("$done", now)
+	if len(pipeline) != 1 {
+		t.Fatalf("pipeline has %d stages, want 1", len(pipeline))
+	}
+	set, ok := pipeline[0]["$set"].(bson.M)
+	if !ok {
+		t.Fatalf("stage = %v, want a $set", pipeline[0])
+	}
+	// The status is user input and must not be read as a field path.
+	if got, want := set["status"], (bson.M{"$literal": "$done"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("status = %v, want %v", got, want)
+	}
+	if got := set["status_since"]; got != now {
+		t.Errorf("status_since = %v, want %v", got, now)
+	}
+
+	parts := set["status_history"].(bson.M)["$concatArrays"].(bson.A)
+	if len(parts) != 2 {
+		t.Fatalf("$concatArrays has %d parts, want 2", len(parts))
+	}
+	closed := parts[0].(bson.M)["$map"].(bson.M)
+	input := bson.M{"$ifNull": bson.A{"$status_history", legacyStatusHistory}}
+	if !reflect.DeepEqual(closed["input"], input) {
+		t.Errorf("$map input = %v, want %v", closed["input"], input)
+	}
+	merge := closed["in"].(bson.M)["$cond"].(bson.A)[2]
+	if want := (bson.M{"$mergeObjects": bson.A{"$$p", bson.M{"exited_at": now}}}); !reflect.DeepEqual(merge, want) {
+		t.Errorf("open period closed with %v, want %v", merge, want)
+	}
+	opened := bson.A{bson.M{"status": bson.M{"$literal": "$done"}, "entered_at": now}}
+	if !reflect.DeepEqual(parts[1], opened) {
+		t.Errorf("new period = %v, want %v", parts[1], opened)
+	}
+}
+
+func TestKeepStatusPipeline(t *testing.T) {
+	set := keepStatusPipeline()[0]["$set"].(bson.M)
+	if _, ok := set["status"]; ok {
+		t.Error("keepStatusPipeline sets the status")
+	}
+	want := bson.M{"$ifNull": bson.A{"$status_history", legacyStatusHistory}}
+	if !reflect.DeepEqual(set["status_history"], want) {
+		t.Errorf("status_history = %v, want %v", set["status_history"], want)
+	}
+}
@@ -0,0 +1,375 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Task struct {
+	ID          TaskID `bson:"_id,omitempty" json:"id"`
+	Title       string `bson:"title" json:"title"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	Status      string `bson:"status" json:"status"`
+	// ExternalSource and ExternalID identify the task in the system that
+	// syncs it to us; the pair is unique.
+	ExternalSource string   `bson:"external_source,omitempty" json:"external_source,omitempty"`
+	ExternalID     string   `bson:"external_id,omitempty" json:"external_id,omitempty"`
+	Project        string   `bson:"project,omitempty" json:"project,omitempty"`
+	Team           string   `bson:"team,omitempty" json:"team,omitempty"`
+	Assignee       string   `bson:"assignee,omitempty" json:"assignee,omitempty"`
+	Priority       string   `bson:"priority,omitempty" json:"priority,omitempty"`
+	Tags           []string `bson:"tags,omitempty" json:"tags,omitempty"`
+	// Estimate is the agreed size of the task, in the team's units.
+	Estimate *float64   `bson:"estimate,omitempty" json:"estimate,omitempty"`
+	DueDate  *time.Time `bson:"due_date,omitempty" json:"due_date,omitempty"`
+	// DueInDays sets DueDate on create to the end of the working day that
+	// many working days from now, per the project or team calendar.
+	DueInDays int `bson:"-" json:"due_in_days,omitempty"`
+	// FixedDueDate opts the task out of automatic rescheduling when one of
+	// its prerequisites slips.
+	FixedDueDate bool         `bson:"fixed_due_date,omitempty" json:"fixed_due_date,omitempty"`
+	Dependencies []Dependency `bson:"dependencies,omitempty" json:"dependencies,omitempty"`
+	// StatusHistory records every status the task has been in; StatusSince
+	// is when it entered the current one. Both are maintained by the server.
+	StatusHistory []StatusPeriod `bson:"status_history,omitempty" json:"status_history,omitempty"`
+	StatusSince   *time.Time     `bson:"status_since,omitempty" json:"status_since,omitempty"`
+	// TimeInStatus is the total number of seconds spent in each status,
+	// computed when the task is read.
+	TimeInStatus map[string]int64 `bson:"-" json:"time_in_status,omitempty"`
+	CreatedAt    time.Time        `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time        `bson:"updated_at" json:"updated_at"`
+}
+
+func (s *Server) createTask(c echo.Context) error {
+	task := new(Task)
+	if err := c.Bind(task); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+
+	task.ID = s.newTaskID()
+	return s.insertTask(c, task)
+}
+
+// insertTask validates and stores a new task whose ID is already set, and
+// writes the 201 response.
+func (s *Server) insertTask(c echo.Context, task *Task) error {
+	if task.Title == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Title is required"})
+	}
+	if ok, err := s.enforceWorkflow(c, nil, task); !ok {
+		return err
+	}
+	if task.Status == "" {
+		task.Status = "Pending"
+	}
+	for _, d := range task.Dependencies {
+		if d.TaskID == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dependency task_id is required"})
+		}
+		if d.TaskID == task.ID {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "A task cannot depend on itself"})
+		}
+	}
+
+	if task.DueInDays < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "due_in_days must not be negative"})
+	}
+	if task.DueInDays > 0 && task.DueDate == nil {
+		cal, err := s.calendarFor(context.Background(), task.Project, task.Team)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load working calendar"})
+		}
+		due := cal.EndOfWorkingDay(cal.AddWorkingDays(time.Now(), task.DueInDays))
+		task.DueDate = &due
+	}
+	task.DueInDays = 0
+
+	if ok, err := s.enforceWIPLimits(c, task); !ok {
+		return err
+	}
+
+	task.CreatedAt = time.Now()
+	task.UpdatedAt = time.Now()
+	task.startStatusHistory()
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, task)
+	}
+
+	_, err := s.taskCollection.InsertOne(context.Background(), task)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Task already exists"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create task"})
+	}
+	if err := s.indexTask(context.Background(), task); err != nil {
+		c.Logger().Errorf("Failed to index task %s: %v", task.ID, err)
+	}
+	s.emit(taskEvent{Type: eventCreated, Task: *task, Actor: s.currentUser(c)})
+
+	return c.JSON(http.StatusCreated, task)
+}
+
+// getAllTasks lists tasks, optionally only those with ?status= and those
+// that have been in their current status longer than ?in_status_longer_than=
+// (e.g. 3d, 12h).
+func (s *Server) getAllTasks(c echo.Context) error {
+	filter := bson.M{}
+	if status := c.QueryParam("status"); status != "" {
+		filter["status"] = status
+	}
+	if v := c.QueryParam("in_status_longer_than"); v != "" {
+		age, err := parseAge(v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "in_status_longer_than must be a duration like 3d or 12h"})
+		}
+		for k, v := range inStatusLongerThan(time.Now().Add(-age)) {
+			filter[k] = v
+		}
+	}
+
+	cursor, err := s.taskCollection.Find(context.Background(), filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch tasks"})
+	}
+	defer cursor.Close(context.Background())
+
+	now := time.Now()
+	tasks := []Task{}
+	for cursor.Next(context.Background()) {
+		var task Task
+		if err := cursor.Decode(&task); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding task data"})
+		}
+		task.fillTimeInStatus(now)
+		tasks = append(tasks, task)
+	}
+
+	return c.JSON(http.StatusOK, tasks)
+}
+
+func (s *Server) getTaskByID(c echo.Context) error {
+	id, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	var task Task
+	err = s.taskCollection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&task)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			archived, err := s.rehydrateTask(context.Background(), id)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to restore archived task"})
+			}
+			if archived == nil {
+				return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+			}
+			archived.fillTimeInStatus(time.Now())
+			return c.JSON(http.StatusOK, archived)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+
+	task.fillTimeInStatus(time.Now())
+	return c.JSON(http.StatusOK, task)
+}
+
+func (s *Server) updateTask(c echo.Context) error {
+	id, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	update := new(Task)
+	if err := c.Bind(update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	// PUT creates the task under the client's ID when it does not exist yet,
+	// after checking it has not been moved to cold storage. A dry run looks
+	// at the archived task without restoring it.
+	var existing Task
+	err = s.taskCollection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		var archived *Task
+		var rerr error
+		if isDryRun(c) {
+			archived, rerr = s.archivedTask(id)
+		} else {
+			archived, rerr = s.rehydrateTask(context.Background(), id)
+		}
+		if rerr != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to restore archived task"})
+		}
+		if archived == nil {
+			update.ID = id
+			return s.insertTask(c, update)
+		}
+		existing, err = *archived, nil
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+
+	return s.replaceTask(c, &existing, update)
+}
+
+// replaceTask overwrites the editable fields of existing with those of
+// update, then moves dependents if the due date slipped.
+func (s *Server) replaceTask(c echo.Context, existing, update *Task) error {
+	id := existing.ID
+	for _, d := range update.Dependencies {
+		if d.TaskID == id {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "A task cannot depend on itself"})
+		}
+	}
+
+	update.ID = id
+	if update.Status != existing.Status || update.Project != existing.Project {
+		if ok, err := s.enforceWorkflow(c, existing, update); !ok {
+			return err
+		}
+	}
+	if update.Status != existing.Status || update.Project != existing.Project || update.Assignee != existing.Assignee {
+		if ok, err := s.enforceWIPLimits(c, update); !ok {
+			return err
+		}
+	}
+
+	update.UpdatedAt = time.Now()
+	update.StatusHistory, update.StatusSince = existing.statusPeriods(), existing.StatusSince
+	if update.StatusSince == nil {
+		update.StatusSince = &existing.UpdatedAt
+	}
+	if update.Status != existing.Status {
+		update.StatusHistory, update.StatusSince = existing.historyWith(update.Status, update.UpdatedAt), &update.UpdatedAt
+	}
+	if !isDryRun(c) {
+		// The history is updated in the database, not written from the
+		// copy read above, and only while the task is still in the status
+		// it was read in, so a concurrent status change is not lost.
+		pipeline := keepStatusPipeline()
+		if update.Status != existing.Status {
+			pipeline = statusChangePipeline(update.Status, update.UpdatedAt)
+		}
+		pipeline = append(pipeline, literalStage(bson.M{
+			"title":          update.Title,
+			"description":    update.Description,
+			"project":        update.Project,
+			"team":           update.Team,
+			"assignee":       update.Assignee,
+			"priority":       update.Priority,
+			"tags":           update.Tags,
+			"estimate":       update.Estimate,
+			"due_date":       update.DueDate,
+			"fixed_due_date": update.FixedDueDate,
+			"dependencies":   update.Dependencies,
+			"updated_at":     update.UpdatedAt,
+		}))
+		result, err := s.taskCollection.UpdateOne(context.Background(), bson.M{"_id": id, "status": existing.Status}, pipeline)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update task"})
+		}
+		if result.MatchedCount == 0 {
+			count, err := s.taskCollection.CountDocuments(context.Background(), bson.M{"_id": id})
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update task"})
+			}
+			if count > 0 {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Task status changed meanwhile, reload and retry"})
+			}
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+		}
+		if err := s.indexTask(context.Background(), update); err != nil {
+			c.Logger().Errorf("Failed to index task %s: %v", id, err)
+		}
+		event := eventUpdated
+		if update.Status != existing.Status {
+			event = eventStatusChanged
+		}
+		update.CreatedAt = existing.CreatedAt
+		s.emit(taskEvent{Type: event, Task: *update, Previous: existing, Actor: s.currentUser(c)})
+	}
+
+	resp := map[string]interface{}{"message": "Task updated successfully"}
+	if update.DueDate != nil && (existing.DueDate == nil || !update.DueDate.Equal(*existing.DueDate)) {
+		plan, err := s.planReschedule(context.Background(), id, *update.DueDate)
+		if err == nil && !isDryRun(c) {
+			err = s.applyReschedule(context.Background(), plan, s.currentUser(c))
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Task updated but rescheduling dependents failed"})
+		}
+		resp["rescheduled"] = plan.Shifted
+		if len(plan.Fixed) > 0 {
+			resp["fixed"] = plan.Fixed
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) deleteTask(c echo.Context) error {
+	id, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	if isDryRun(c) {
+		count, err := s.taskCollection.CountDocuments(context.Background(), bson.M{"_id": id})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+		}
+		if _, archived := s.cold.lookup(string(id)); count == 0 && !archived {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Task deleted successfully"})
+	}
+
+	// An archived copy is tombstoned first, so a failure between the two
+	// steps cannot bring the task back from cold storage.
+	archived, err := s.archivedTask(id)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete task"})
+	}
+	if archived != nil {
+		if err := s.cold.forget(string(id)); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete task"})
+		}
+	}
+	var task Task
+	err = s.taskCollection.FindOneAndDelete(context.Background(), bson.M{"_id": id}).Decode(&task)
+	if err == mongo.ErrNoDocuments {
+		if archived == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+		}
+		task, err = *archived, nil
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete task"})
+	}
+	if err := s.deleteTaskAttachments(context.Background(), id); err != nil {
+		c.Logger().Errorf("Failed to delete attachments of task %s: %v", id, err)
+	}
+	if _, err := s.commentCollection.DeleteMany(context.Background(), bson.M{"task_id": id}); err != nil {
+		c.Logger().Errorf("Failed to delete comments of task %s: %v", id, err)
+	}
+	if _, err := s.reminderCollection.DeleteMany(context.Background(), bson.M{"task_id": id}); err != nil {
+		c.Logger().Errorf("Failed to delete reminders of task %s: %v", id, err)
+	}
+	// Invoiced time stays, since the invoice still refers to it.
+	if _, err := s.timeEntryCollection.DeleteMany(context.Background(),
+		bson.M{"task_id": id, "invoice_id": bson.M{"$exists": false}}); err != nil {
+		c.Logger().Errorf("Failed to delete time entries of task %s: %v", id, err)
+	}
+	if err := s.removeTaskFromSearch(context.Background(), id); err != nil {
+		c.Logger().Errorf("Failed to unindex task %s: %v", id, err)
+	}
+	s.emit(taskEvent{Type: eventDeleted, Task: task})
+	return c.JSON(http.StatusOK, map[string]string{"message": "Task deleted successfully"})
+}
@@ -0,0 +1,602 @@
+package taskapi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// closedStatuses are the task statuses considered finished in projects
+// without a workflow.
+var closedStatuses = []string{"Completed", "Done", "Closed", "Cancelled"}
+
+// Cold segments are written as a sequence of gzip members, one per task, so a
+// single task can be read back by seeking to its member offset. Each segment
+// has a sidecar JSON index mapping task IDs to those offsets.
+const (
+	segmentExt   = ".ndjson.gz"
+	indexExt     = ".idx.json"
+	tombstoneLog = "tombstones.ndjson"
+)
+
+type coldLocation struct {
+	Segment   string    `json:"segment"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"-"`
+}
+
+type segmentIndex struct {
+	Segment      string                  `json:"segment"`
+	CreatedAt    time.Time               `json:"created_at"`
+	ClosedBefore time.Time               `json:"closed_before"`
+	Count        int                     `json:"count"`
+	Tasks        map[string]coldLocation `json:"tasks"`
+	// Refs maps the external references of the segment's tasks to their IDs.
+	// Indexes written before it existed are filled in when the store opens.
+	Refs map[string]string `json:"refs"`
+}
+
+type tombstone struct {
+	ID        string    `json:"id"`
+	RemovedAt time.Time `json:"removed_at"`
+}
+
+type coldStore struct {
+	mu       sync.Mutex
+	dir      string
+	segments []string
+	index    map[string]coldLocation
+	refs     map[string]string
+}
+
+func externalRefKey(source, externalID string) string {
+	return source + "\x00" + externalID
+}
+
+func openColdStore(dir string) (*coldStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &coldStore{dir: dir, index: map[string]coldLocation{}, refs: map[string]string{}}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+indexExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var idx segmentIndex
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f, err)
+		}
+		if idx.Refs == nil {
+			if err := s.addSegmentRefs(&idx); err != nil {
+				return nil, fmt.Errorf("indexing references of %s: %w", idx.Segment, err)
+			}
+		}
+		s.segments = append(s.segments, idx.Segment)
+		for id, loc := range idx.Tasks {
+			loc.CreatedAt = idx.CreatedAt
+			s.index[id] = loc
+		}
+		for ref, id := range idx.Refs {
+			s.refs[ref] = id
+		}
+	}
+
+	tombstones, err := s.readTombstones()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tombstones {
+		if loc, ok := s.index[t.ID]; ok && !loc.CreatedAt.After(t.RemovedAt) {
+			delete(s.index, t.ID)
+		}
+	}
+	return s, nil
+}
+
+// addSegmentRefs reads a segment indexed before references were recorded
+// and saves its index again with them.
+func (s *coldStore) addSegmentRefs(idx *segmentIndex) error {
+	f, err := os.Open(filepath.Join(s.dir, idx.Segment))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	idx.Refs = map[string]string{}
+	dec := json.NewDecoder(zr)
+	for {
+		var task Task
+		if err := dec.Decode(&task); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if task.ExternalID != "" {
+			idx.Refs[externalRefKey(task.ExternalSource, task.ExternalID)] = string(task.ID)
+		}
+	}
+	return s.writeIndex(idx)
+}
+
+// writeIndex saves a segment index, replacing the previous one atomically.
+func (s *coldStore) writeIndex(idx *segmentIndex) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, strings.TrimSuffix(idx.Segment, segmentExt)+indexExt+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, strings.TrimSuffix(tmp, ".tmp"))
+}
+
+func (s *coldStore) readTombstones() ([]tombstone, error) {
+	f, err := os.Open(filepath.Join(s.dir, tombstoneLog))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []tombstone
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var t tombstone
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out, scanner.Err()
+}
+
+// reset removes every segment and tombstone, leaving the store empty.
+func (s *coldStore) reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(s.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	s.segments = nil
+	s.index = map[string]coldLocation{}
+	s.refs = map[string]string{}
+	return nil
+}
+
+// forget drops a task from the cold index and records a tombstone so it is
+// not resurrected from its segment after a restart.
+func (s *coldStore) forget(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(s.dir, tombstoneLog), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, _ := json.Marshal(tombstone{ID: id, RemovedAt: time.Now()})
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	delete(s.index, id)
+	return nil
+}
+
+func (s *coldStore) lookup(id string) (coldLocation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	loc, ok := s.index[id]
+	return loc, ok
+}
+
+// lookupRef returns the ID of the archived task with the given external
+// reference.
+func (s *coldStore) lookupRef(source, externalID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.refs[externalRefKey(source, externalID)]
+	if !ok {
+		return "", false
+	}
+	_, ok = s.index[id]
+	return id, ok
+}
+
+func (s *coldStore) read(loc coldLocation) (*Task, error) {
+	f, err := os.Open(filepath.Join(s.dir, loc.Segment))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(loc.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+	defer zr.Close()
+
+	var task Task
+	if err := json.NewDecoder(zr).Decode(&task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// writeSegment stores tasks in a new segment and publishes its index. The
+// segment is fsynced before the index is written, so an index on disk always
+// refers to complete data.
+func (s *coldStore) writeSegment(tasks []Task, closedBefore time.Time) (*segmentIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	name := fmt.Sprintf("seg-%d%s", now.UnixNano(), segmentExt)
+	idx := &segmentIndex{
+		Segment:      name,
+		CreatedAt:    now,
+		ClosedBefore: closedBefore,
+		Count:        len(tasks),
+		Tasks:        make(map[string]coldLocation, len(tasks)),
+		Refs:         map[string]string{},
+	}
+
+	f, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var offset int64
+	for _, task := range tasks {
+		cw := &countingWriter{w: f}
+		zw := gzip.NewWriter(cw)
+		if err := json.NewEncoder(zw).Encode(task); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		idx.Tasks[string(task.ID)] = coldLocation{Segment: name, Offset: offset}
+		if task.ExternalID != "" {
+			idx.Refs[externalRefKey(task.ExternalSource, task.ExternalID)] = string(task.ID)
+		}
+		offset += cw.n
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := s.writeIndex(idx); err != nil {
+		return nil, err
+	}
+
+	s.segments = append(s.segments, name)
+	for id, loc := range idx.Tasks {
+		loc.CreatedAt = now
+		s.index[id] = loc
+	}
+	for ref, id := range idx.Refs {
+		s.refs[ref] = id
+	}
+	return idx, nil
+}
+
+// each calls fn with every task in cold storage, in ID order.
+func (s *coldStore) each(fn func(*Task) error) error {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.index))
+	locs := make(map[string]coldLocation, len(s.index))
+	for id, loc := range s.index {
+		ids = append(ids, id)
+		locs[id] = loc
+	}
+	s.mu.Unlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		task, err := s.read(locs[id])
+		if err != nil {
+			return fmt.Errorf("reading archived task %s: %w", id, err)
+		}
+		if err := fn(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// search scans every cold segment for tasks whose title or description
+// contains q, skipping tasks that have since been rehydrated or deleted.
+func (s *coldStore) search(q string, limit int) ([]Task, error) {
+	s.mu.Lock()
+	segments := append([]string(nil), s.segments...)
+	s.mu.Unlock()
+
+	q = strings.ToLower(q)
+	results := []Task{}
+	for i := len(segments) - 1; i >= 0; i-- {
+		f, err := os.Open(filepath.Join(s.dir, segments[i]))
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		dec := json.NewDecoder(zr)
+		for {
+			var task Task
+			if err := dec.Decode(&task); err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return nil, err
+			}
+			loc, ok := s.lookup(string(task.ID))
+			if !ok || loc.Segment != segments[i] {
+				continue
+			}
+			if strings.Contains(strings.ToLower(task.Title), q) || strings.Contains(strings.ToLower(task.Description), q) {
+				results = append(results, task)
+				if len(results) >= limit {
+					f.Close()
+					return results, nil
+				}
+			}
+		}
+		f.Close()
+	}
+	return results, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// tierableFilter matches tasks that have been closed since before cutoff.
+// Edits to a closed task do not delay its tiering.
+func tierableFilter(ws workflowSet, cutoff time.Time) bson.M {
+	return bson.M{"$and": bson.A{ws.closedFilter(), inStatusLongerThan(cutoff)}}
+}
+
+// tierClosedTasks moves tasks closed before cutoff out of Mongo into a new
+// cold segment, in batches of batchSize.
+func (s *Server) tierClosedTasks(ctx context.Context, cutoff time.Time, batchSize int) (int, error) {
+	ws, err := s.loadWorkflows(ctx)
+	if err != nil {
+		return 0, err
+	}
+	filter := tierableFilter(ws, cutoff)
+
+	moved := 0
+	for {
+		cursor, err := s.taskCollection.Find(ctx, filter, options.Find().SetLimit(int64(batchSize)).SetSort(bson.M{"_id": 1}))
+		if err != nil {
+			return moved, err
+		}
+		tasks := []Task{}
+		if err := cursor.All(ctx, &tasks); err != nil {
+			return moved, err
+		}
+		if len(tasks) == 0 {
+			return moved, nil
+		}
+
+		if _, err := s.cold.writeSegment(tasks, cutoff); err != nil {
+			return moved, err
+		}
+		// A task edited or reopened since it was read no longer matches
+		// its own updated_at, so it stays in Mongo and its archived copy is
+		// dropped instead.
+		ids := make([]TaskID, len(tasks))
+		unchanged := make(bson.A, len(tasks))
+		for i, t := range tasks {
+			ids[i] = t.ID
+			unchanged[i] = bson.M{"_id": t.ID, "updated_at": t.UpdatedAt}
+		}
+		deleteFilter := bson.M{"$and": bson.A{tierableFilter(ws, cutoff), bson.M{"$or": unchanged}}}
+		res, err := s.taskCollection.DeleteMany(ctx, deleteFilter)
+		if err != nil {
+			return moved, err
+		}
+		if int(res.DeletedCount) < len(tasks) {
+			if err := s.forgetChanged(ctx, ids); err != nil {
+				return moved, err
+			}
+		}
+		moved += int(res.DeletedCount)
+	}
+}
+
+// forgetChanged drops the archived copies of the given tasks that are still
+// in Mongo.
+func (s *Server) forgetChanged(ctx context.Context, ids []TaskID) error {
+	cursor, err := s.taskCollection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var kept []struct {
+		ID TaskID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &kept); err != nil {
+		return err
+	}
+	for _, k := range kept {
+		if err := s.cold.forget(string(k.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivedTask reads a tiered task without restoring it. It returns nil, nil
+// when the task is not in cold storage.
+func (s *Server) archivedTask(id TaskID) (*Task, error) {
+	loc, ok := s.cold.lookup(string(id))
+	if !ok {
+		return nil, nil
+	}
+	return s.cold.read(loc)
+}
+
+// externalTask returns the task with the given external reference from
+// Mongo or, restoring it when restore is set, from cold storage. It returns
+// nil, nil when there is none.
+func (s *Server) externalTask(ctx context.Context, source, externalID string, restore bool) (*Task, error) {
+	var task Task
+	err := s.taskCollection.FindOne(ctx, bson.M{"external_source": source, "external_id": externalID}).Decode(&task)
+	if err == nil {
+		return &task, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	id, ok := s.cold.lookupRef(source, externalID)
+	if !ok {
+		return nil, nil
+	}
+	if restore {
+		return s.rehydrateTask(ctx, TaskID(id))
+	}
+	return s.archivedTask(TaskID(id))
+}
+
+// rehydrateTask restores a tiered task into Mongo. It returns nil, nil when
+// the task is not in cold storage either.
+func (s *Server) rehydrateTask(ctx context.Context, id TaskID) (*Task, error) {
+	task, err := s.archivedTask(id)
+	if task == nil {
+		return nil, err
+	}
+	if _, err := s.taskCollection.InsertOne(ctx, task); err != nil {
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		// A concurrent request restored it first.
+		var current Task
+		if ferr := s.taskCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&current); ferr != nil {
+			return nil, err
+		}
+		task = &current
+	}
+	if err := s.cold.forget(string(id)); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// startTieringLoop runs tiering once a day for tasks closed more than
+// afterDays days ago.
+func (s *Server) startTieringLoop(ctx context.Context, afterDays int) {
+	s.goWorker(func() {
+		for {
+			cutoff := time.Now().AddDate(0, 0, -afterDays)
+			n, err := s.tierClosedTasks(ctx, cutoff, 1000)
+			if err != nil {
+				s.logger.Errorf("Tiering failed after moving %d tasks: %v", n, err)
+			} else if n > 0 {
+				s.logger.Infof("Tiered %d tasks closed before %s", n, cutoff.Format(time.RFC3339))
+			}
+			if !sleep(ctx, 24*time.Hour) {
+				return
+			}
+		}
+	})
+}
+
+func (s *Server) runTiering(c echo.Context) error {
+	var req struct {
+		ClosedBefore time.Time `json:"closed_before"`
+		BatchSize    int       `json:"batch_size"`
+	}
+	if err := c.Bind(&req); err != nil || req.ClosedBefore.IsZero() {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "closed_before is required"})
+	}
+	if req.BatchSize <= 0 {
+		req.BatchSize = 1000
+	}
+	if isDryRun(c) {
+		ws, err := s.loadWorkflows(context.Background())
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflows"})
+		}
+		moved, err := s.taskCollection.CountDocuments(context.Background(), tierableFilter(ws, req.ClosedBefore))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to count tasks"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"moved": moved})
+	}
+
+	moved, err := s.tierClosedTasks(context.Background(), req.ClosedBefore, req.BatchSize)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{"error": "Tiering failed", "moved": moved})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"moved": moved})
+}
+
+func (s *Server) searchColdTasks(c echo.Context) error {
+	q := c.QueryParam("q")
+	if q == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "q is required"})
+	}
+	limit := 50
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+		}
+		limit = n
+	}
+
+	tasks, err := s.cold.search(q, limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search archived tasks"})
+	}
+	return c.JSON(http.StatusOK, tasks)
+}
@@ -0,0 +1,149 @@
+package taskapi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestColdStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cs, err := openColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := []Task{
+		{ID: "a", Title: "First", Status: "Done"},
+		{ID: "b", Title: "Second", Status: "Done", ExternalSource: "jira", ExternalID: "OPS-1"},
+	}
+	if _, err := cs.writeSegment(tasks, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reopened store sees the same tasks and references.
+	cs, err = openColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, ok := cs.lookup("b")
+	if !ok {
+		t.Fatal("task b not found")
+	}
+	task, err := cs.read(loc)
+	if err != nil || task.Title != "Second" {
+		t.Fatalf("read = %+v, %v", task, err)
+	}
+	if id, ok := cs.lookupRef("jira", "OPS-1"); !ok || id != "b" {
+		t.Errorf("lookupRef = %q, %v; want b", id, ok)
+	}
+	if _, ok := cs.lookupRef("jira", "OPS-2"); ok {
+		t.Error("lookupRef found an unknown reference")
+	}
+
+	// Forgotten tasks stay forgotten after a restart, by ID and reference.
+	if err := cs.forget("b"); err != nil {
+		t.Fatal(err)
+	}
+	cs, err = openColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cs.lookup("b"); ok {
+		t.Error("forgotten task still archived")
+	}
+	if _, ok := cs.lookupRef("jira", "OPS-1"); ok {
+		t.Error("forgotten task still found by reference")
+	}
+
+	var seen []TaskID
+	if err := cs.each(func(t *Task) error { seen = append(seen, t.ID); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || seen[0] != "a" {
+		t.Errorf("each saw %v, want [a]", seen)
+	}
+}
+
+func TestColdStoreIndexesLegacyRefs(t *testing.T) {
+	dir := t.TempDir()
+	cs, err := openColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := cs.writeSegment([]Task{{ID: "c", ExternalSource: "mqtt", ExternalID: "dev/fault"}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the index the way segments were indexed before references.
+	path := filepath.Join(dir, strings.TrimSuffix(idx.Segment, segmentExt)+indexExt)
+	data, _ := json.Marshal(map[string]interface{}{"segment": idx.Segment, "created_at": idx.CreatedAt, "tasks": idx.Tasks})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err = openColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := cs.lookupRef("mqtt", "dev/fault"); !ok || id != "c" {
+		t.Errorf("lookupRef = %q, %v; want c", id, ok)
+	}
+	// The index is saved with its references.
+	data, _ = os.ReadFile(path)
+	var saved segmentIndex
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Refs["mqtt\x00dev/fault"] != "c" {
+		t.Errorf("saved index refs = %v, %v", saved.Refs, err)
+	}
+}
+
+func TestColdStoreReset(t *testing.T) {
+	dir := t.TempDir()
+	cs, err := openColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.writeSegment([]Task{{ID: "a", Status: "Done", ExternalSource: "jira", ExternalID: "OPS-1"}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.forget("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.reset(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left after reset", len(entries))
+	}
+	if _, ok := cs.lookupRef("jira", "OPS-1"); ok {
+		t.Error("reference still found after reset")
+	}
+	cs, err = openColdStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cs.lookup("a"); ok {
+		t.Error("task still archived after reset")
+	}
+}
+
+func TestTierableFilter(t *testing.T) {
+	cutoff := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+	and, ok := tierableFilter(workflowSet{}, cutoff)["$and"].(bson.A)
+	if !ok || len(and) != 2 {
+		t.Fatalf("filter = %v, want an $and of two parts", and)
+	}
+	// Closed tasks are judged by when they closed, not by their last edit.
+	if want := inStatusLongerThan(cutoff); !reflect.DeepEqual(and[1], want) {
+		t.Errorf("age filter = %v, want %v", and[1], want)
+	}
+	if _, ok := and[0].(bson.M)["updated_at"]; ok {
+		t.Error("closed filter keys on updated_at")
+	}
+}
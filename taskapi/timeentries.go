@@ -0,0 +1,157 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TimeEntry is time a user logged against a task. Once an invoice claims an
+// entry it carries the invoice's ID and can no longer be changed or billed
+// again.
+type TimeEntry struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TaskID TaskID             `bson:"task_id" json:"task_id"`
+	// Project is copied from the task when the time is logged, so moving the
+	// task later does not change where past time is billed.
+	Project   string              `bson:"project,omitempty" json:"project,omitempty"`
+	User      string              `bson:"user" json:"user"`
+	Date      string              `bson:"date" json:"date"`
+	Minutes   int                 `bson:"minutes" json:"minutes"`
+	Note      string              `bson:"note,omitempty" json:"note,omitempty"`
+	Billable  *bool               `bson:"billable" json:"billable"`
+	InvoiceID *primitive.ObjectID `bson:"invoice_id,omitempty" json:"invoice_id,omitempty"`
+	BilledAt  *time.Time          `bson:"billed_at,omitempty" json:"billed_at,omitempty"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+}
+
+func (s *Server) ensureTimeEntryIndex(ctx context.Context) error {
+	_, err := s.timeEntryCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "project", Value: 1}, {Key: "invoice_id", Value: 1}, {Key: "date", Value: 1}},
+	})
+	return err
+}
+
+func (s *Server) createTimeEntry(c echo.Context) error {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	entry := new(TimeEntry)
+	if err := c.Bind(entry); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	// Time is logged for the caller; only admins may log it for others.
+	if user := s.currentUser(c); entry.User == "" {
+		entry.User = user
+	} else if entry.User != user && !s.isAdminRequest(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Only admins can log time for other users"})
+	}
+	if entry.User == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "User is required"})
+	}
+	if entry.Minutes <= 0 || entry.Minutes > 24*60 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Minutes must be between 1 and 1440"})
+	}
+	if entry.Date == "" {
+		entry.Date = time.Now().UTC().Format(dateLayout)
+	} else if _, err := time.Parse(dateLayout, entry.Date); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Date must be YYYY-MM-DD"})
+	}
+	if entry.Billable == nil {
+		billable := true
+		entry.Billable = &billable
+	}
+
+	var task Task
+	err = s.taskCollection.FindOne(context.Background(), bson.M{"_id": taskID}).Decode(&task)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+
+	entry.ID = primitive.NewObjectID()
+	entry.TaskID = taskID
+	entry.Project = task.Project
+	entry.InvoiceID = nil
+	entry.BilledAt = nil
+	entry.CreatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, entry)
+	}
+
+	if _, err := s.timeEntryCollection.InsertOne(context.Background(), entry); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create time entry"})
+	}
+	return c.JSON(http.StatusCreated, entry)
+}
+
+func (s *Server) getTaskTimeEntries(c echo.Context) error {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+
+	cursor, err := s.timeEntryCollection.Find(context.Background(), bson.M{"task_id": taskID},
+		options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch time entries"})
+	}
+	entries := []TimeEntry{}
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding time entry data"})
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+// deleteTimeEntry removes an entry that no invoice has claimed. Users may
+// delete their own entries; only admins may delete others'.
+func (s *Server) deleteTimeEntry(c echo.Context) error {
+	taskID, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	entryID, err := primitive.ObjectIDFromHex(c.Param("entryId"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid time entry ID"})
+	}
+
+	var entry TimeEntry
+	err = s.timeEntryCollection.FindOne(context.Background(), bson.M{"_id": entryID, "task_id": taskID}).Decode(&entry)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Time entry not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch time entry"})
+	}
+	if entry.User != s.currentUser(c) && !s.isAdminRequest(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Only admins can delete time of other users"})
+	}
+	if entry.InvoiceID != nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Time entry is on an invoice"})
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Time entry deleted successfully"})
+	}
+
+	// The invoice_id condition loses to an invoice claiming the entry
+	// between the read and the delete.
+	result, err := s.timeEntryCollection.DeleteOne(context.Background(),
+		bson.M{"_id": entryID, "invoice_id": bson.M{"$exists": false}})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete time entry"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Time entry is on an invoice"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Time entry deleted successfully"})
+}
@@ -0,0 +1,456 @@
+package taskapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usage is aggregated into hourly buckets, which are rolled up into daily
+// buckets once they are older than hourlyRetention; daily buckets are kept
+// for dailyRetention.
+const (
+	usageFlushInterval = 30 * time.Second
+	hourlyRetention    = 7 * 24 * time.Hour
+	dailyRetention     = 400 * 24 * time.Hour
+
+	granularityHour = "hour"
+	granularityDay  = "day"
+
+	// maxUsageClients caps the distinct clients recorded per hour, since
+	// client identities come from the request; later ones are counted under
+	// usageOverflowClient.
+	maxUsageClients     = 1000
+	usageOverflowClient = "other"
+	maxClientIDLength   = 64
+)
+
+type usageBucket struct {
+	ID           string    `bson:"_id" json:"-"`
+	Granularity  string    `bson:"granularity" json:"granularity"`
+	Start        time.Time `bson:"start" json:"start"`
+	Client       string    `bson:"client" json:"client"`
+	Method       string    `bson:"method" json:"method"`
+	Route        string    `bson:"route" json:"route"`
+	Deprecated   bool      `bson:"deprecated,omitempty" json:"deprecated,omitempty"`
+	Requests     int64     `bson:"requests" json:"requests"`
+	ClientErrors int64     `bson:"client_errors" json:"client_errors"`
+	ServerErrors int64     `bson:"server_errors" json:"server_errors"`
+	LatencyMsSum float64   `bson:"latency_ms_sum" json:"latency_ms_sum"`
+	LatencyMsMax float64   `bson:"latency_ms_max" json:"latency_ms_max"`
+	BytesIn      int64     `bson:"bytes_in" json:"bytes_in"`
+	BytesOut     int64     `bson:"bytes_out" json:"bytes_out"`
+	LastSeen     time.Time `bson:"last_seen" json:"last_seen"`
+}
+
+func usageBucketID(granularity string, start time.Time, client, method, route string) string {
+	return strings.Join([]string{granularity, start.UTC().Format(time.RFC3339), client, method, route}, "|")
+}
+
+func (b *usageBucket) add(o *usageBucket) {
+	b.Requests += o.Requests
+	b.ClientErrors += o.ClientErrors
+	b.ServerErrors += o.ServerErrors
+	b.LatencyMsSum += o.LatencyMsSum
+	if o.LatencyMsMax > b.LatencyMsMax {
+		b.LatencyMsMax = o.LatencyMsMax
+	}
+	b.BytesIn += o.BytesIn
+	b.BytesOut += o.BytesOut
+	if o.LastSeen.After(b.LastSeen) {
+		b.LastSeen = o.LastSeen
+	}
+}
+
+type usageRecorder struct {
+	mu      sync.Mutex
+	pending map[string]*usageBucket
+	// clients holds the clients seen in the current and previous hour.
+	clients map[time.Time]map[string]bool
+}
+
+func newUsageRecorder() *usageRecorder {
+	return &usageRecorder{
+		pending: map[string]*usageBucket{},
+		clients: map[time.Time]map[string]bool{},
+	}
+}
+
+// parseDeprecatedRoutes reads a comma-separated list of "METHOD /route"
+// entries, using echo route templates such as "GET /tasks/:id".
+func parseDeprecatedRoutes(s string) map[string]bool {
+	routes := map[string]bool{}
+	for _, r := range strings.Split(s, ",") {
+		if f := strings.Fields(r); len(f) == 2 {
+			routes[strings.ToUpper(f[0])+" "+f[1]] = true
+		}
+	}
+	return routes
+}
+
+// clientIdentity names the integration behind a request: an explicit
+// X-Client-ID, else a fingerprint of its bearer key, else its user, else its
+// IP address.
+func (s *Server) clientIdentity(c echo.Context) string {
+	if id := c.Request().Header.Get("X-Client-ID"); id != "" {
+		if len(id) > maxClientIDLength {
+			id = strings.ToValidUTF8(id[:maxClientIDLength], "")
+		}
+		return id
+	}
+	if key, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer "); ok && strings.TrimSpace(key) != "" {
+		sum := sha256.Sum256([]byte(strings.TrimSpace(key)))
+		return "key:" + hex.EncodeToString(sum[:6])
+	}
+	if user := s.currentUser(c); user != "" {
+		return "user:" + user
+	}
+	return "ip:" + c.RealIP()
+}
+
+// usageMiddleware records one sample per request and marks deprecated
+// routes with a Deprecation header.
+func (s *Server) usageMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		route := s.route(c)
+		deprecated := s.deprecatedRoutes[c.Request().Method+" "+route]
+		if deprecated {
+			c.Response().Header().Set("Deprecation", "true")
+		}
+
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+		}
+		bytesIn := c.Request().ContentLength
+		if bytesIn < 0 {
+			bytesIn = 0
+		}
+		sample := &usageBucket{
+			Granularity:  granularityHour,
+			Start:        start.UTC().Truncate(time.Hour),
+			Client:       s.clientIdentity(c),
+			Method:       c.Request().Method,
+			Route:        route,
+			Deprecated:   deprecated,
+			Requests:     1,
+			LatencyMsSum: float64(time.Since(start).Microseconds()) / 1000,
+			BytesIn:      bytesIn,
+			BytesOut:     c.Response().Size,
+			LastSeen:     start,
+		}
+		sample.LatencyMsMax = sample.LatencyMsSum
+		switch {
+		case status >= 500:
+			sample.ServerErrors = 1
+		case status >= 400:
+			sample.ClientErrors = 1
+		}
+		s.usage.record(sample)
+		return err
+	}
+}
+
+func (u *usageRecorder) record(s *usageBucket) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	seen := u.clients[s.Start]
+	if seen == nil {
+		seen = map[string]bool{}
+		u.clients[s.Start] = seen
+		for hour := range u.clients {
+			if hour.Before(s.Start.Add(-time.Hour)) {
+				delete(u.clients, hour)
+			}
+		}
+	}
+	if !seen[s.Client] {
+		if len(seen) >= maxUsageClients {
+			s.Client = usageOverflowClient
+		} else {
+			seen[s.Client] = true
+		}
+	}
+	s.ID = usageBucketID(s.Granularity, s.Start, s.Client, s.Method, s.Route)
+	if b, ok := u.pending[s.ID]; ok {
+		b.add(s)
+	} else {
+		u.pending[s.ID] = s
+	}
+}
+
+// flush writes the samples collected since the last flush as increments on
+// their hourly buckets.
+func (u *usageRecorder) flush(ctx context.Context, coll *mongo.Collection) error {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = map[string]*usageBucket{}
+	u.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(pending))
+	for _, b := range pending {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": b.ID}).
+			SetUpsert(true).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{
+					"granularity": b.Granularity,
+					"start":       b.Start,
+					"client":      b.Client,
+					"method":      b.Method,
+					"route":       b.Route,
+					"deprecated":  b.Deprecated,
+				},
+				"$inc": bson.M{
+					"requests":       b.Requests,
+					"client_errors":  b.ClientErrors,
+					"server_errors":  b.ServerErrors,
+					"latency_ms_sum": b.LatencyMsSum,
+					"bytes_in":       b.BytesIn,
+					"bytes_out":      b.BytesOut,
+				},
+				"$max": bson.M{"latency_ms_max": b.LatencyMsMax, "last_seen": b.LastSeen},
+			}))
+	}
+	_, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// rollupUsage folds hourly buckets older than hourlyRetention into daily
+// buckets and drops daily buckets past dailyRetention. The daily documents
+// are overwritten rather than incremented, so a rollup interrupted before the
+// hourly buckets are deleted is safe to run again.
+func (s *Server) rollupUsage(ctx context.Context, now time.Time) error {
+	cutoff := now.Add(-hourlyRetention).UTC().Truncate(24 * time.Hour)
+	hourly := bson.M{"granularity": granularityHour, "start": bson.M{"$lt": cutoff}}
+
+	cursor, err := s.usageCollection.Find(ctx, hourly)
+	if err != nil {
+		return err
+	}
+	var buckets []usageBucket
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return err
+	}
+
+	daily := map[string]*usageBucket{}
+	for i := range buckets {
+		b := buckets[i]
+		day := b.Start.UTC().Truncate(24 * time.Hour)
+		id := usageBucketID(granularityDay, day, b.Client, b.Method, b.Route)
+		if d, ok := daily[id]; ok {
+			d.add(&b)
+			d.Deprecated = d.Deprecated || b.Deprecated
+			continue
+		}
+		b.ID, b.Granularity, b.Start = id, granularityDay, day
+		daily[id] = &b
+	}
+	for _, d := range daily {
+		if _, err := s.usageCollection.ReplaceOne(ctx, bson.M{"_id": d.ID}, d, options.Replace().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	if _, err := s.usageCollection.DeleteMany(ctx, hourly); err != nil {
+		return err
+	}
+
+	_, err = s.usageCollection.DeleteMany(ctx, bson.M{
+		"granularity": granularityDay,
+		"start":       bson.M{"$lt": now.Add(-dailyRetention)},
+	})
+	return err
+}
+
+// startUsageLoop flushes the recorded usage periodically, and a last time
+// when ctx ends.
+func (s *Server) startUsageLoop(ctx context.Context) {
+	s.goWorker(func() {
+		flushTicker := time.NewTicker(usageFlushInterval)
+		rollupTicker := time.NewTicker(time.Hour)
+		defer flushTicker.Stop()
+		defer rollupTicker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := s.usage.flush(flushCtx, s.usageCollection); err != nil {
+					s.logger.Errorf("Failed to flush usage: %v", err)
+				}
+				cancel()
+				return
+			case <-flushTicker.C:
+				if err := s.usage.flush(context.Background(), s.usageCollection); err != nil {
+					s.logger.Errorf("Failed to flush usage: %v", err)
+				}
+			case now := <-rollupTicker.C:
+				if err := s.rollupUsage(context.Background(), now); err != nil {
+					s.logger.Errorf("Failed to roll up usage: %v", err)
+				}
+			}
+		}
+	})
+}
+
+type clientUsage struct {
+	Client       string    `json:"client"`
+	Requests     int64     `json:"requests"`
+	ClientErrors int64     `json:"client_errors"`
+	ServerErrors int64     `json:"server_errors"`
+	ErrorRate    float64   `json:"error_rate"`
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	MaxLatencyMs float64   `json:"max_latency_ms"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+type deprecatedCaller struct {
+	Client   string    `json:"client"`
+	Method   string    `json:"method"`
+	Route    string    `json:"route"`
+	Requests int64     `json:"requests"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// getUsage reports usage between from and to (default: the last 7 days):
+// the busiest clients with their error rates, per-route traffic, and clients
+// still calling deprecated endpoints.
+func (s *Server) getUsage(c echo.Context) error {
+	to := time.Now()
+	from := to.Add(-7 * 24 * time.Hour)
+	var err error
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid from"})
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid to"})
+		}
+	}
+	limit := 10
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+		}
+		limit = n
+	}
+
+	ctx := context.Background()
+	if err := s.usage.flush(ctx, s.usageCollection); err != nil {
+		c.Logger().Errorf("Failed to flush usage: %v", err)
+	}
+	// Daily buckets start at midnight, so widen the lower bound to include
+	// the day containing from.
+	cursor, err := s.usageCollection.Find(ctx, bson.M{"$or": []bson.M{
+		{"granularity": granularityHour, "start": bson.M{"$gte": from.Truncate(time.Hour), "$lt": to}},
+		{"granularity": granularityDay, "start": bson.M{"$gte": from.UTC().Truncate(24 * time.Hour), "$lt": to}},
+	}})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch usage"})
+	}
+	var buckets []usageBucket
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding usage data"})
+	}
+
+	clients := map[string]*usageBucket{}
+	routes := map[string]*usageBucket{}
+	deprecated := map[string]*usageBucket{}
+	for i := range buckets {
+		b := &buckets[i]
+		for _, agg := range []struct {
+			m   map[string]*usageBucket
+			key string
+			ok  bool
+		}{
+			{clients, b.Client, true},
+			{routes, b.Method + " " + b.Route, true},
+			{deprecated, b.Client + " " + b.Method + " " + b.Route, b.Deprecated || s.deprecatedRoutes[b.Method+" "+b.Route]},
+		} {
+			if !agg.ok {
+				continue
+			}
+			if cur, ok := agg.m[agg.key]; ok {
+				cur.add(b)
+			} else {
+				cp := *b
+				agg.m[agg.key] = &cp
+			}
+		}
+	}
+
+	top := make([]clientUsage, 0, len(clients))
+	for _, b := range clients {
+		u := clientUsage{
+			Client:       b.Client,
+			Requests:     b.Requests,
+			ClientErrors: b.ClientErrors,
+			ServerErrors: b.ServerErrors,
+			MaxLatencyMs: b.LatencyMsMax,
+			BytesIn:      b.BytesIn,
+			BytesOut:     b.BytesOut,
+			LastSeen:     b.LastSeen,
+		}
+		if b.Requests > 0 {
+			u.ErrorRate = float64(b.ClientErrors+b.ServerErrors) / float64(b.Requests)
+			u.AvgLatencyMs = b.LatencyMsSum / float64(b.Requests)
+		}
+		top = append(top, u)
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].Requests > top[j].Requests })
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	routeStats := make([]map[string]interface{}, 0, len(routes))
+	for _, b := range routes {
+		routeStats = append(routeStats, map[string]interface{}{
+			"method":        b.Method,
+			"route":         b.Route,
+			"requests":      b.Requests,
+			"client_errors": b.ClientErrors,
+			"server_errors": b.ServerErrors,
+		})
+	}
+	sort.Slice(routeStats, func(i, j int) bool {
+		return routeStats[i]["requests"].(int64) > routeStats[j]["requests"].(int64)
+	})
+
+	callers := make([]deprecatedCaller, 0, len(deprecated))
+	for _, b := range deprecated {
+		callers = append(callers, deprecatedCaller{Client: b.Client, Method: b.Method, Route: b.Route, Requests: b.Requests, LastSeen: b.LastSeen})
+	}
+	sort.Slice(callers, func(i, j int) bool { return callers[i].Requests > callers[j].Requests })
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"from":               from,
+		"to":                 to,
+		"top_clients":        top,
+		"routes":             routeStats,
+		"deprecated_callers": callers,
+	})
+}
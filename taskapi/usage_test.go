@@ -0,0 +1,54 @@
+package taskapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestClientIdentity(t *testing.T) {
+	s := &Server{auth: HeaderAuth{}}
+	e := echo.New()
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"client ID", map[string]string{"X-Client-ID": "sync-bot", "Authorization": "Bearer tk_a"}, "sync-bot"},
+		{"bearer key", map[string]string{"Authorization": "Bearer tk_a", "X-User-ID": "alice"}, "key:"},
+		{"user", map[string]string{"X-User-ID": "alice"}, "user:alice"},
+		{"empty bearer", map[string]string{"Authorization": "Bearer "}, "ip:192.0.2.1"},
+		{"basic auth", map[string]string{"Authorization": "Basic YTpi"}, "ip:192.0.2.1"},
+		{"anonymous", nil, "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/tasks", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			got := s.clientIdentity(e.NewContext(req, httptest.NewRecorder()))
+			if tt.want == "key:" {
+				if !strings.HasPrefix(got, "key:") || strings.Contains(got, "tk_a") {
+					t.Errorf("clientIdentity = %q, want a key fingerprint", got)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("clientIdentity = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	fingerprint := func(key string) string {
+		req := httptest.NewRequest(http.MethodGet, "/tasks", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		return s.clientIdentity(e.NewContext(req, httptest.NewRecorder()))
+	}
+	if fingerprint("tk_a") != fingerprint("tk_a") || fingerprint("tk_a") == fingerprint("tk_b") {
+		t.Error("keys are not fingerprinted consistently")
+	}
+}
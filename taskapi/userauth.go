@@ -0,0 +1,191 @@
+package taskapi
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const authUserKey = "auth_user"
+
+// StoreAuth authenticates callers by API key ("Authorization: Bearer
+// tk_...") against a UserStore. Users with the admin role may use the /admin
+// routes; disabled users and revoked keys are anonymous.
+type StoreAuth struct {
+	Users *UserStore
+}
+
+// user looks the caller up once per request.
+func (a StoreAuth) user(c echo.Context) *User {
+	if u, ok := c.Get(authUserKey).(*User); ok {
+		return u
+	}
+	var u *User
+	if key, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer "); ok {
+		key = strings.TrimSpace(key)
+		var err error
+		u, err = a.Users.AuthenticateAPIKey(context.Background(), key)
+		if err != nil && err != ErrInvalidCredentials {
+			c.Logger().Errorf("Failed to authenticate API key: %v", err)
+		}
+		if u != nil {
+			if err := a.Users.RecordAPIKeyUse(context.Background(), u, key); err != nil {
+				c.Logger().Errorf("Failed to record API key use: %v", err)
+			}
+		}
+	}
+	c.Set(authUserKey, u)
+	return u
+}
+
+func (a StoreAuth) User(c echo.Context) string {
+	if u := a.user(c); u != nil {
+		return u.Username
+	}
+	return ""
+}
+
+func (a StoreAuth) IsAdmin(c echo.Context) bool {
+	u := a.user(c)
+	return u != nil && u.HasRole(RoleAdmin)
+}
+
+// passwordUser authenticates the request's basic auth credentials. It
+// returns nil after answering 401 when they are missing or wrong.
+func (s *Server) passwordUser(c echo.Context) (*User, error) {
+	username, password, ok := c.Request().BasicAuth()
+	if ok {
+		u, err := s.users.Authenticate(context.Background(), username, password)
+		if err == nil {
+			return u, nil
+		}
+		if err != ErrInvalidCredentials {
+			return nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to authenticate"})
+		}
+	}
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="taskapi"`)
+	return nil, c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid username or password"})
+}
+
+// createAPIKey issues an API key to the user signing in with basic auth. The
+// key is only ever shown in this response.
+func (s *Server) createAPIKey(c echo.Context) error {
+	u, err := s.passwordUser(c)
+	if u == nil {
+		return err
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, map[string]string{"name": req.Name})
+	}
+	key, rec, err := s.users.CreateAPIKey(context.Background(), u.Username, req.Name)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create API key"})
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{"id": rec.ID, "name": rec.Name, "key": key, "created_at": rec.CreatedAt})
+}
+
+func (s *Server) getAPIKeys(c echo.Context) error {
+	u, err := s.passwordUser(c)
+	if u == nil {
+		return err
+	}
+	keys := u.APIKeys
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+func (s *Server) revokeAPIKey(c echo.Context) error {
+	u, err := s.passwordUser(c)
+	if u == nil {
+		return err
+	}
+	keyID := c.Param("keyId")
+	if isDryRun(c) {
+		for _, k := range u.APIKeys {
+			if k.ID == keyID && k.RevokedAt == nil {
+				return c.JSON(http.StatusOK, map[string]string{"message": "API key revoked successfully"})
+			}
+		}
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "API key not found"})
+	}
+	err = s.users.RevokeAPIKey(context.Background(), u.Username, keyID)
+	if err == ErrAPIKeyNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "API key not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke API key"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "API key revoked successfully"})
+}
+
+var resetPasswordForm = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Set password</title></head>
+<body>
+<h1>Set your password</h1>
+<form method="post">
+<input type="hidden" name="token" value="{{.}}">
+<p><label>New password <input type="password" name="password" minlength="10" required></label></p>
+<p><button type="submit">Set password</button></p>
+</form>
+</body>
+</html>
+`))
+
+// getPasswordReset serves the form a reset link opens.
+func (s *Server) getPasswordReset(c echo.Context) error {
+	token := c.QueryParam("token")
+	if err := s.users.CheckResetToken(context.Background(), token); err != nil {
+		if err == ErrInvalidToken {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check token"})
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().Header().Set("Referrer-Policy", "no-referrer")
+	return resetPasswordForm.Execute(c.Response(), token)
+}
+
+// resetPassword sets a password with a reset token, from JSON or the form.
+func (s *Server) resetPassword(c echo.Context) error {
+	var req struct {
+		Token    string `json:"token" form:"token"`
+		Password string `json:"password" form:"password"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if len(req.Password) < minPasswordLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password must be at least 10 characters"})
+	}
+	ctx := context.Background()
+	if isDryRun(c) {
+		err := s.users.CheckResetToken(ctx, req.Token)
+		if err == ErrInvalidToken {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check token"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Password updated successfully"})
+	}
+	err := s.users.ResetPassword(ctx, req.Token, req.Password)
+	if err == ErrInvalidToken {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update password"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Password updated successfully"})
+}
@@ -0,0 +1,368 @@
+package taskapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RoleAdmin grants access to the /admin routes.
+const RoleAdmin = "admin"
+
+const minPasswordLength = 10
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserExists         = errors.New("user already exists")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+	ErrAPIKeyNotFound     = errors.New("API key not found")
+	ErrWeakPassword       = errors.New("password must be at least 10 characters")
+)
+
+// User is an account that can sign in with a password and call the API with
+// API keys. Secrets are only stored as hashes.
+type User struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username     string             `bson:"username" json:"username"`
+	Email        string             `bson:"email,omitempty" json:"email,omitempty"`
+	PasswordHash string             `bson:"password_hash,omitempty" json:"-"`
+	Roles        []string           `bson:"roles,omitempty" json:"roles,omitempty"`
+	Disabled     bool               `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	APIKeys      []APIKey           `bson:"api_keys,omitempty" json:"api_keys,omitempty"`
+	ResetHash    string             `bson:"reset_hash,omitempty" json:"-"`
+	ResetExpires *time.Time         `bson:"reset_expires,omitempty" json:"-"`
+	CreatedAt    time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// APIKey is a bearer credential of a user. The key itself is shown once,
+// when it is created; ID identifies it for revocation.
+type APIKey struct {
+	ID         string     `bson:"id" json:"id"`
+	Name       string     `bson:"name,omitempty" json:"name,omitempty"`
+	Hash       string     `bson:"hash" json:"-"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+func (u *User) HasRole(role string) bool {
+	return containsString(u.Roles, role)
+}
+
+// UserStore keeps user accounts in MongoDB. The server and the admin
+// commands share it.
+type UserStore struct {
+	coll *mongo.Collection
+}
+
+func NewUserStore(db *mongo.Database) *UserStore {
+	return &UserStore{coll: db.Collection("users")}
+}
+
+func (st *UserStore) EnsureIndexes(ctx context.Context) error {
+	_, err := st.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "api_keys.hash", Value: 1}}},
+		{Keys: bson.D{{Key: "reset_hash", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
+	return err
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomSecret(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create adds a user. An empty password leaves the account without one, to
+// be set through a reset link.
+func (st *UserStore) Create(ctx context.Context, username, email, password string, roles []string) (*User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+	u := &User{
+		ID:        primitive.NewObjectID(),
+		Username:  username,
+		Email:     email,
+		Roles:     roles,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		u.PasswordHash = hash
+	}
+	if _, err := st.coll.InsertOne(ctx, u); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrUserExists
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func (st *UserStore) List(ctx context.Context) ([]User, error) {
+	cursor, err := st.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"username": 1}))
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (st *UserStore) Get(ctx context.Context, username string) (*User, error) {
+	var u User
+	err := st.coll.FindOne(ctx, bson.M{"username": username}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (st *UserStore) update(ctx context.Context, username string, update bson.M) error {
+	if set, ok := update["$set"].(bson.M); ok {
+		set["updated_at"] = time.Now()
+	} else {
+		update["$set"] = bson.M{"updated_at": time.Now()}
+	}
+	result, err := st.coll.UpdateOne(ctx, bson.M{"username": username}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// SetDisabled disables or re-enables an account. A disabled user cannot
+// sign in, use API keys or redeem reset links.
+func (st *UserStore) SetDisabled(ctx context.Context, username string, disabled bool) error {
+	return st.update(ctx, username, bson.M{"$set": bson.M{"disabled": disabled}})
+}
+
+func (st *UserStore) GrantRole(ctx context.Context, username, role string) error {
+	if role == "" {
+		return errors.New("role is required")
+	}
+	return st.update(ctx, username, bson.M{"$addToSet": bson.M{"roles": role}})
+}
+
+func (st *UserStore) RevokeRole(ctx context.Context, username, role string) error {
+	return st.update(ctx, username, bson.M{"$pull": bson.M{"roles": role}})
+}
+
+// CreateResetToken issues a single-use token for setting the user's password,
+// valid for ttl. Issuing a new one invalidates the previous one.
+func (st *UserStore) CreateResetToken(ctx context.Context, username string, ttl time.Duration) (string, error) {
+	token, err := randomSecret(32)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(ttl)
+	err = st.update(ctx, username, bson.M{"$set": bson.M{"reset_hash": hashSecret(token), "reset_expires": expires}})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ResetPassword sets a new password with a reset token and consumes the
+// token.
+func (st *UserStore) ResetPassword(ctx context.Context, token, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	result, err := st.coll.UpdateOne(ctx,
+		bson.M{"reset_hash": hashSecret(token), "reset_expires": bson.M{"$gt": time.Now()}, "disabled": bson.M{"$ne": true}},
+		bson.M{
+			"$set":   bson.M{"password_hash": hash, "updated_at": time.Now()},
+			"$unset": bson.M{"reset_hash": "", "reset_expires": ""},
+		})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// CheckResetToken reports whether token can still be redeemed.
+func (st *UserStore) CheckResetToken(ctx context.Context, token string) error {
+	count, err := st.coll.CountDocuments(ctx,
+		bson.M{"reset_hash": hashSecret(token), "reset_expires": bson.M{"$gt": time.Now()}, "disabled": bson.M{"$ne": true}})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Authenticate checks a username and password.
+func (st *UserStore) Authenticate(ctx context.Context, username, password string) (*User, error) {
+	u, err := st.Get(ctx, username)
+	if err == ErrUserNotFound {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled || u.PasswordHash == "" ||
+		bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// CreateAPIKey issues a new API key for the user and returns it with its
+// record. Keys look like "tk_<id>_<secret>".
+func (st *UserStore) CreateAPIKey(ctx context.Context, username, name string) (string, *APIKey, error) {
+	id, err := randomSecret(6)
+	if err != nil {
+		return "", nil, err
+	}
+	id = strings.NewReplacer("-", "x", "_", "y").Replace(id)
+	secret, err := randomSecret(32)
+	if err != nil {
+		return "", nil, err
+	}
+	key := "tk_" + id + "_" + secret
+	rec := &APIKey{ID: id, Name: name, Hash: hashSecret(key), CreatedAt: time.Now()}
+	if err := st.update(ctx, username, bson.M{"$push": bson.M{"api_keys": rec}}); err != nil {
+		return "", nil, err
+	}
+	return key, rec, nil
+}
+
+// RevokeAPIKey revokes one of the user's keys, or all of them when keyID is
+// empty.
+func (st *UserStore) RevokeAPIKey(ctx context.Context, username, keyID string) error {
+	now := time.Now()
+	var result *mongo.UpdateResult
+	var err error
+	if keyID == "" {
+		result, err = st.coll.UpdateOne(ctx,
+			bson.M{"username": username, "api_keys.0": bson.M{"$exists": true}},
+			bson.M{"$set": bson.M{"api_keys.$[k].revoked_at": now, "updated_at": now}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"k.revoked_at": nil}}}))
+	} else {
+		result, err = st.coll.UpdateOne(ctx,
+			bson.M{"username": username, "api_keys": bson.M{"$elemMatch": bson.M{"id": keyID, "revoked_at": nil}}},
+			bson.M{"$set": bson.M{"api_keys.$.revoked_at": now, "updated_at": now}})
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := st.Get(ctx, username); err != nil {
+			return err
+		}
+		if keyID != "" {
+			return ErrAPIKeyNotFound
+		}
+	}
+	return nil
+}
+
+// AuthenticateAPIKey returns the enabled user owning a live key.
+func (st *UserStore) AuthenticateAPIKey(ctx context.Context, key string) (*User, error) {
+	if !strings.HasPrefix(key, "tk_") {
+		return nil, ErrInvalidCredentials
+	}
+	var u User
+	err := st.coll.FindOne(ctx, bson.M{"api_keys.hash": hashSecret(key)}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled || u.liveAPIKey(key) == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &u, nil
+}
+
+// liveAPIKey returns the user's unrevoked record of key, if any.
+func (u *User) liveAPIKey(key string) *APIKey {
+	hash := hashSecret(key)
+	for i, k := range u.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) == 1 {
+			if k.RevokedAt != nil {
+				return nil
+			}
+			return &u.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+// keyUseResolution is how stale a key's recorded last use may get.
+const keyUseResolution = time.Minute
+
+// RecordAPIKeyUse sets the last use of u's key, which AuthenticateAPIKey
+// returned u for, to now. Uses are only recorded to the minute, so most
+// requests skip the write.
+func (st *UserStore) RecordAPIKeyUse(ctx context.Context, u *User, key string) error {
+	k := u.liveAPIKey(key)
+	now := time.Now()
+	if k == nil || !keyUseDue(k, now) {
+		return nil
+	}
+	_, err := st.coll.UpdateOne(ctx,
+		bson.M{"_id": u.ID, "api_keys": bson.M{"$elemMatch": bson.M{"id": k.ID, "$or": bson.A{
+			bson.M{"last_used_at": nil},
+			bson.M{"last_used_at": bson.M{"$lte": now.Add(-keyUseResolution)}},
+		}}}},
+		bson.M{"$set": bson.M{"api_keys.$.last_used_at": now}})
+	if err != nil {
+		return err
+	}
+	k.LastUsedAt = &now
+	return nil
+}
+
+func keyUseDue(k *APIKey, now time.Time) bool {
+	return k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= keyUseResolution
+}
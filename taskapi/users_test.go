@@ -0,0 +1,67 @@
+package taskapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHashSecret(t *testing.T) {
+	a, b := hashSecret("tk_abc_secret"), hashSecret("tk_abc_secret")
+	if a != b {
+		t.Errorf("hashSecret is not deterministic: %s, %s", a, b)
+	}
+	if len(a) != 64 {
+		t.Errorf("hashSecret length %d, want 64 hex digits", len(a))
+	}
+	if a == hashSecret("tk_abc_secreT") {
+		t.Error("different secrets hash alike")
+	}
+}
+
+func TestLiveAPIKey(t *testing.T) {
+	revoked := time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC)
+	u := &User{APIKeys: []APIKey{
+		{ID: "live", Hash: hashSecret("tk_live_s")},
+		{ID: "old", Hash: hashSecret("tk_old_s"), RevokedAt: &revoked},
+	}}
+	tests := []struct {
+		key, want string
+	}{
+		{"tk_live_s", "live"},
+		{"tk_old_s", ""},
+		{"tk_other_s", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if k := u.liveAPIKey(tt.key); k != nil {
+			got = k.ID
+		}
+		if got != tt.want {
+			t.Errorf("liveAPIKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestKeyUseDue(t *testing.T) {
+	now := time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		v := now.Add(-d)
+		return &v
+	}
+	tests := []struct {
+		last *time.Time
+		want bool
+	}{
+		{nil, true},
+		{at(0), false},
+		{at(59 * time.Second), false},
+		{at(time.Minute), true},
+		{at(time.Hour), true},
+	}
+	for _, tt := range tests {
+		if got := keyUseDue(&APIKey{LastUsedAt: tt.last}, now); got != tt.want {
+			t.Errorf("keyUseDue(%v) = %v, want %v", tt.last, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package taskapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Web Push messages are encrypted for the browser as RFC 8291 describes,
+// in a single aes128gcm record (RFC 8188), and the push service is shown a
+// VAPID token (RFC 8292) so it knows who is sending.
+const (
+	pushRecordSize = 4096
+	// pushMaxPayload is what fits in one record after the 86-byte header,
+	// the delimiter and the 16-byte tag.
+	pushMaxPayload = pushRecordSize - 86 - 1 - 16
+	pushTTL        = 24 * time.Hour
+	vapidTokenTTL  = 12 * time.Hour
+)
+
+// PushTransport sends requests to push services. *http.Client implements
+// it; tests can substitute a local stand-in.
+type PushTransport interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// WebPushConfig holds the server's VAPID key pair, as unpadded base64url
+// of the raw P-256 keys (what web-push tools generate), and the contact
+// URI push services can reach the operator at.
+type WebPushConfig struct {
+	PublicKey  string
+	PrivateKey string
+	// Subject is a mailto: or https: URI.
+	Subject string
+	// Transport defaults to a client that only connects to public
+	// addresses and does not follow redirects.
+	Transport PushTransport
+	// AllowInsecureEndpoints accepts plain http endpoints on loopback, so a
+	// local stand-in push service can be used. Only for development and
+	// tests.
+	AllowInsecureEndpoints bool
+}
+
+type webPush struct {
+	publicKey     []byte
+	privateKey    *ecdsa.PrivateKey
+	subject       string
+	transport     PushTransport
+	allowInsecure bool
+}
+
+// errPushGone reports a subscription the push service no longer accepts.
+var errPushGone = errors.New("push subscription expired")
+
+// WithWebPush enables browser notifications for reminders and assignments.
+func WithWebPush(cfg WebPushConfig) Option {
+	return func(s *Server) error {
+		wp, err := newWebPush(cfg)
+		if err != nil {
+			return err
+		}
+		s.push = wp
+		return nil
+	}
+}
+
+func newWebPush(cfg WebPushConfig) (*webPush, error) {
+	if cfg.Subject == "" {
+		return nil, errors.New("web push: a subject is required")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("web push: invalid private key: %w", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("web push: invalid private key: %w", err)
+	}
+	pub := key.PublicKey().Bytes()
+	if cfg.PublicKey != "" && cfg.PublicKey != base64.RawURLEncoding.EncodeToString(pub) {
+		return nil, errors.New("web push: public key does not match the private key")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	wp := &webPush{
+		publicKey: pub,
+		privateKey: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+			D:         new(big.Int).SetBytes(raw),
+		},
+		subject:       cfg.Subject,
+		transport:     cfg.Transport,
+		allowInsecure: cfg.AllowInsecureEndpoints,
+	}
+	if wp.transport == nil {
+		wp.transport = newPushClient(cfg.AllowInsecureEndpoints)
+	}
+	return wp, nil
+}
+
+// errNonPublicAddress is returned for push endpoints that resolve to the
+// server's own network.
+var errNonPublicAddress = errors.New("push endpoint is not a public address")
+
+// cgnatRange is the carrier-grade NAT range of RFC 6598.
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicAddress reports whether ip may be reached on behalf of a push
+// subscription: not private, loopback, link-local, unspecified, multicast
+// or CGNAT.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || cgnatRange.Contains(ip) || ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+// newPushClient returns the client push messages are posted with. Endpoints
+// are registered by users, so it checks every address it connects to,
+// whatever the host name resolved to, and hands redirects back to send
+// rather than follow them. allowLoopback admits a local stand-in service.
+func newPushClient(allowLoopback bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !publicAddress(ip) && !(allowLoopback && ip.IsLoopback()) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the endpoint, defeating the check.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   notifyDeliveryTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// GenerateVAPIDKeys returns a new VAPID key pair in the form WebPushConfig
+// expects.
+func GenerateVAPIDKeys() (publicKey, privateKey string, err error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.Bytes()), nil
+}
+
+// encryptPush encrypts payload for the browser holding the subscription's
+// keys (RFC 8291 section 3.4).
+func encryptPush(payload, uaPublic, authSecret []byte) ([]byte, error) {
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptPushWith(payload, uaPublic, authSecret, asKey, salt)
+}
+
+// encryptPushWith encrypts payload with the given ephemeral key and salt,
+// which must be fresh for every message.
+func encryptPushWith(payload, uaPublic, authSecret []byte, asKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(payload) > pushMaxPayload {
+		return nil, fmt.Errorf("push payload of %d bytes is too large", len(payload))
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	if len(authSecret) != 16 {
+		return nil, errors.New("invalid auth secret")
+	}
+	ecdhSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The only record is also the last, marked by a 0x02 delimiter.
+	plaintext := append(append([]byte(nil), payload...), 0x02)
+
+	out := append([]byte(nil), salt...)
+	out = binary.BigEndian.AppendUint32(out, pushRecordSize)
+	out = append(out, byte(len(asPublic)))
+	out = append(out, asPublic...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// vapidToken signs the JWT that identifies the server to the push service
+// at endpoint.
+func (wp *webPush) vapidToken(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", errors.New("invalid push endpoint")
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenTTL).Unix(),
+		"sub": wp.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, wp.privateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// pushMessage is what the service worker receives.
+type pushMessage struct {
+	Title  string `bson:"title" json:"title"`
+	Body   string `bson:"body" json:"body"`
+	Event  string `bson:"event" json:"event"`
+	TaskID TaskID `bson:"task_id,omitempty" json:"task_id,omitempty"`
+	// Tag lets the browser, and the push service, replace an earlier
+	// notification about the same thing.
+	Tag string `bson:"tag,omitempty" json:"tag,omitempty"`
+	// Urgency is sent to the push service, not the browser.
+	Urgency string `bson:"urgency,omitempty" json:"-"`
+}
+
+// send encrypts msg for sub and posts it to the subscription's push
+// service. It returns errPushGone when the service says the subscription
+// is gone.
+func (wp *webPush) send(ctx context.Context, sub *PushSubscription, msg *pushMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	uaPublic, err := base64.RawURLEncoding.DecodeString(trimPadding(sub.Keys.P256dh))
+	if err != nil {
+		return fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(trimPadding(sub.Keys.Auth))
+	if err != nil {
+		return fmt.Errorf("invalid auth secret: %w", err)
+	}
+	body, err := encryptPush(payload, uaPublic, authSecret)
+	if err != nil {
+		return err
+	}
+	token, err := wp.vapidToken(sub.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(int(pushTTL/time.Second)))
+	req.Header.Set("Authorization", "vapid t="+token+", k="+base64.RawURLEncoding.EncodeToString(wp.publicKey))
+	if msg.Urgency != "" {
+		req.Header.Set("Urgency", msg.Urgency)
+	}
+	if msg.Tag != "" {
+		req.Header.Set("Topic", msg.Tag)
+	}
+	resp, err := wp.transport.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("push service answered %s", resp.Status)
+	}
+	return nil
+}
+
+// trimPadding accepts keys with or without base64 padding, since browsers
+// and libraries differ.
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
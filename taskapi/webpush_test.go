@@ -0,0 +1,365 @@
+package taskapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The example of RFC 8291 appendix A.
+const (
+	rfc8291Plaintext  = "When I grow up, I want to be a watermelon"
+	rfc8291ASPrivate  = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291UAPrivate  = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291AuthSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291Salt       = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291Message    = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func decodeB64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func p256Key(t *testing.T, s string) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.P256().NewPrivateKey(decodeB64(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// decryptPush does what the browser does with a push message body.
+func decryptPush(body []byte, uaKey *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	if len(body) < 21 || len(body) < 21+int(body[20]) {
+		return nil, errors.New("short header")
+	}
+	salt, rs, idLen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	asPublic, ciphertext := body[21:21+idLen], body[21+idLen:]
+	if rs != pushRecordSize || len(ciphertext) > int(rs) {
+		return nil, errors.New("unexpected record size")
+	}
+	asKey, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	ecdhSecret, err := uaKey.ECDH(asKey)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), uaKey.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+	cek, nonce := make([]byte, 16), make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext = bytes.TrimRight(plaintext, "\x00")
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != 0x02 {
+		return nil, errors.New("missing last record delimiter")
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+func TestEncryptPushRFC8291(t *testing.T) {
+	uaKey := p256Key(t, rfc8291UAPrivate)
+	authSecret := decodeB64(t, rfc8291AuthSecret)
+
+	got, err := encryptPushWith([]byte(rfc8291Plaintext), uaKey.PublicKey().Bytes(), authSecret,
+		p256Key(t, rfc8291ASPrivate), decodeB64(t, rfc8291Salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc := base64.RawURLEncoding.EncodeToString(got); enc != rfc8291Message {
+		t.Errorf("encryptPushWith = %s, want %s", enc, rfc8291Message)
+	}
+
+	plaintext, err := decryptPush(decodeB64(t, rfc8291Message), uaKey, authSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != rfc8291Plaintext {
+		t.Errorf("decrypted %q, want %q", plaintext, rfc8291Plaintext)
+	}
+}
+
+func TestEncryptPushRoundTrip(t *testing.T) {
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	for _, payload := range [][]byte{nil, []byte(`{"title":"Due soon"}`), bytes.Repeat([]byte("x"), pushMaxPayload)} {
+		body, err := encryptPush(payload, uaKey.PublicKey().Bytes(), authSecret)
+		if err != nil {
+			t.Fatalf("encryptPush(%d bytes) = %v", len(payload), err)
+		}
+		if len(body) > pushRecordSize {
+			t.Errorf("%d byte payload encrypted to %d bytes, more than a record", len(payload), len(body))
+		}
+		got, err := decryptPush(body, uaKey, authSecret)
+		if err != nil {
+			t.Fatalf("decrypting %d byte payload: %v", len(payload), err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("round trip of %d bytes returned %d bytes", len(payload), len(got))
+		}
+	}
+
+	again, _ := encryptPush([]byte("x"), uaKey.PublicKey().Bytes(), authSecret)
+	once, _ := encryptPush([]byte("x"), uaKey.PublicKey().Bytes(), authSecret)
+	if bytes.Equal(again, once) {
+		t.Error("two messages encrypted alike; salt and key must be fresh")
+	}
+	if _, err := encryptPush(make([]byte, pushMaxPayload+1), uaKey.PublicKey().Bytes(), authSecret); err == nil {
+		t.Error("encryptPush accepted an oversized payload")
+	}
+	if _, err := encryptPush([]byte("x"), uaKey.PublicKey().Bytes(), authSecret[:8]); err == nil {
+		t.Error("encryptPush accepted a short auth secret")
+	}
+}
+
+// verifyVAPID checks the Authorization header of a push request against
+// the server's public key and the push service's origin.
+func verifyVAPID(header string, publicKey []byte, origin string) error {
+	t, k, ok := strings.Cut(strings.TrimPrefix(header, "vapid t="), ", k=")
+	if !ok || !strings.HasPrefix(header, "vapid ") {
+		return errors.New("not a vapid authorization")
+	}
+	if k != base64.RawURLEncoding.EncodeToString(publicKey) {
+		return errors.New("wrong key")
+	}
+	parts := strings.Split(t, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return errors.New("malformed signature")
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), publicKey)
+	if x == nil {
+		return errors.New("invalid public key")
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return errors.New("bad signature")
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var c struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub"`
+	}
+	if err := json.Unmarshal(claims, &c); err != nil {
+		return err
+	}
+	if c.Aud != origin || c.Sub != "mailto:ops@example.com" || c.Exp <= time.Now().Unix() {
+		return errors.New("unexpected claims " + string(claims))
+	}
+	return nil
+}
+
+func TestWebPushSend(t *testing.T) {
+	uaKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	var status int
+	var received *pushMessage
+	var problem error
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, problem = nil, nil
+		defer func() { w.WriteHeader(status) }()
+		for name, want := range map[string]string{
+			"Content-Encoding": "aes128gcm",
+			"Content-Type":     "application/octet-stream",
+			"TTL":              "86400",
+			"Urgency":          "high",
+			"Topic":            "reminder-t1",
+		} {
+			if got := r.Header.Get(name); got != want {
+				problem = errors.New(name + ": " + got)
+				return
+			}
+		}
+		body, _ := io.ReadAll(r.Body)
+		plaintext, err := decryptPush(body, uaKey, authSecret)
+		if err != nil {
+			problem = err
+			return
+		}
+		received = &pushMessage{}
+		problem = json.Unmarshal(plaintext, received)
+	}))
+	defer service.Close()
+
+	public, private, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp, err := newWebPush(WebPushConfig{
+		PublicKey:  public,
+		PrivateKey: private,
+		Subject:    "mailto:ops@example.com",
+		Transport:  authChecker{service.Client(), decodeB64(t, public), service.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &PushSubscription{
+		Endpoint: service.URL + "/push/abc",
+		Keys: PushKeys{
+			// Browsers send padded keys too.
+			P256dh: base64.URLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(authSecret),
+		},
+	}
+	msg := &pushMessage{Title: "Due soon", Body: "Renew TLS", Event: eventReminder, TaskID: "t1", Tag: "reminder-t1", Urgency: "high"}
+
+	tests := []struct {
+		status        int
+		wantErr, gone bool
+	}{
+		{http.StatusCreated, false, false},
+		{http.StatusGone, true, true},
+		{http.StatusNotFound, true, true},
+		{http.StatusTooManyRequests, true, false},
+	}
+	for _, tt := range tests {
+		status, received = tt.status, nil
+		err := wp.send(context.Background(), sub, msg)
+		if problem != nil {
+			t.Fatalf("status %d: push service saw %v", tt.status, problem)
+		}
+		if (err != nil) != tt.wantErr || errors.Is(err, errPushGone) != tt.gone {
+			t.Errorf("status %d: send = %v, wantErr %v, gone %v", tt.status, err, tt.wantErr, tt.gone)
+		}
+		if received == nil || received.Title != msg.Title || received.TaskID != msg.TaskID || received.Urgency != "" {
+			t.Errorf("status %d: browser got %+v", tt.status, received)
+		}
+	}
+}
+
+// authChecker is a PushTransport that checks the VAPID authorization of
+// each request before passing it on.
+type authChecker struct {
+	client    *http.Client
+	publicKey []byte
+	origin    string
+}
+
+func (a authChecker) Do(req *http.Request) (*http.Response, error) {
+	if err := verifyVAPID(req.Header.Get("Authorization"), a.publicKey, a.origin); err != nil {
+		return nil, err
+	}
+	return a.client.Do(req)
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.7", true},
+		{"142.250.74.10", true},
+		{"2606:4700::1111", true},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestPushClient(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer service.Close()
+
+	// The test service listens on loopback, like an internal host would.
+	if _, err := newPushClient(false).Get(service.URL); !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("posting to loopback = %v, want %v", err, errNonPublicAddress)
+	}
+	resp, err := newPushClient(true).Get(service.URL + "/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("redirect answered %d, want it returned unfollowed", resp.StatusCode)
+	}
+}
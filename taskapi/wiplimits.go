@@ -0,0 +1,248 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// wipEach in a limit's Project or Assignee applies the limit to every
+// project or assignee separately; an empty value means "across all".
+const wipEach = "*"
+
+// WIPLimit caps how many tasks may be in Status at once, globally, per
+// project and/or per assignee. Limits are checked before each write, so
+// concurrent writes can still overshoot a limit by a few tasks.
+type WIPLimit struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Status    string             `bson:"status" json:"status"`
+	Project   string             `bson:"project,omitempty" json:"project,omitempty"`
+	Assignee  string             `bson:"assignee,omitempty" json:"assignee,omitempty"`
+	Limit     int64              `bson:"limit" json:"limit"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type wipViolation struct {
+	LimitID  primitive.ObjectID `json:"limit_id"`
+	Status   string             `json:"status"`
+	Project  string             `json:"project,omitempty"`
+	Assignee string             `json:"assignee,omitempty"`
+	Limit    int64              `json:"limit"`
+	Current  int64              `json:"current"`
+}
+
+// scopeFilter returns the task filter counted against the limit for task,
+// or nil if the limit does not apply to it.
+func (l *WIPLimit) scopeFilter(task *Task) bson.M {
+	if l.Status != task.Status {
+		return nil
+	}
+	filter := bson.M{"status": l.Status}
+	switch l.Project {
+	case "":
+	case wipEach:
+		if task.Project == "" {
+			return nil
+		}
+		filter["project"] = task.Project
+	default:
+		if l.Project != task.Project {
+			return nil
+		}
+		filter["project"] = l.Project
+	}
+	switch l.Assignee {
+	case "":
+	case wipEach:
+		if task.Assignee == "" {
+			return nil
+		}
+		filter["assignee"] = task.Assignee
+	default:
+		if l.Assignee != task.Assignee {
+			return nil
+		}
+		filter["assignee"] = l.Assignee
+	}
+	return filter
+}
+
+// checkWIPLimits reports the limits task would exceed if saved with its
+// current status, project and assignee. The task itself is not counted, so
+// this works for both new and updated tasks.
+func (s *Server) checkWIPLimits(ctx context.Context, task *Task) ([]wipViolation, error) {
+	cursor, err := s.wipLimitCollection.Find(ctx, bson.M{"status": task.Status})
+	if err != nil {
+		return nil, err
+	}
+	var limits []WIPLimit
+	if err := cursor.All(ctx, &limits); err != nil {
+		return nil, err
+	}
+
+	var violations []wipViolation
+	for _, l := range limits {
+		filter := l.scopeFilter(task)
+		if filter == nil {
+			continue
+		}
+		if task.ID != "" {
+			filter["_id"] = bson.M{"$ne": task.ID}
+		}
+		count, err := s.taskCollection.CountDocuments(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		if count+1 > l.Limit {
+			v := wipViolation{LimitID: l.ID, Status: l.Status, Limit: l.Limit, Current: count}
+			if l.Project != "" {
+				v.Project = task.Project
+			}
+			if l.Assignee != "" {
+				v.Assignee = task.Assignee
+			}
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
+
+// hasWIPLimits reports whether any WIP limit is set, so bulk writes can skip
+// checking each task when there is none.
+func (s *Server) hasWIPLimits(ctx context.Context) (bool, error) {
+	n, err := s.wipLimitCollection.CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// enforceWIPLimits writes a 409 response and returns false if task would
+// break a WIP limit. Admins can bypass the check with ?wip_override=true.
+func (s *Server) enforceWIPLimits(c echo.Context, task *Task) (bool, error) {
+	if s.allowOverride(c, "wip_override") {
+		return true, nil
+	}
+	violations, err := s.checkWIPLimits(context.Background(), task)
+	if err != nil {
+		return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check WIP limits"})
+	}
+	if len(violations) > 0 {
+		return false, c.JSON(http.StatusConflict, map[string]interface{}{
+			"error":      "WIP limit exceeded",
+			"violations": violations,
+		})
+	}
+	return true, nil
+}
+
+func (l *WIPLimit) validate() string {
+	if l.Status == "" {
+		return "Status is required"
+	}
+	if l.Limit < 0 {
+		return "Limit must not be negative"
+	}
+	return ""
+}
+
+func (s *Server) createWIPLimit(c echo.Context) error {
+	limit := new(WIPLimit)
+	if err := c.Bind(limit); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if msg := limit.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	limit.ID = primitive.NewObjectID()
+	limit.CreatedAt = time.Now()
+	limit.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		return c.JSON(http.StatusCreated, limit)
+	}
+	if _, err := s.wipLimitCollection.InsertOne(context.Background(), limit); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create WIP limit"})
+	}
+	return c.JSON(http.StatusCreated, limit)
+}
+
+func (s *Server) getAllWIPLimits(c echo.Context) error {
+	cursor, err := s.wipLimitCollection.Find(context.Background(), bson.M{})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch WIP limits"})
+	}
+	limits := []WIPLimit{}
+	if err := cursor.All(context.Background(), &limits); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding WIP limit data"})
+	}
+	return c.JSON(http.StatusOK, limits)
+}
+
+func (s *Server) updateWIPLimit(c echo.Context) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	update := new(WIPLimit)
+	if err := c.Bind(update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if msg := update.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if isDryRun(c) {
+		return s.dryRunWIPLimit(c, objectID, "WIP limit updated successfully")
+	}
+
+	result, err := s.wipLimitCollection.UpdateOne(context.Background(), bson.M{"_id": objectID}, bson.M{
+		"$set": bson.M{
+			"status":     update.Status,
+			"project":    update.Project,
+			"assignee":   update.Assignee,
+			"limit":      update.Limit,
+			"updated_at": time.Now(),
+		},
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update WIP limit"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "WIP limit not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "WIP limit updated successfully"})
+}
+
+func (s *Server) deleteWIPLimit(c echo.Context) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	if isDryRun(c) {
+		return s.dryRunWIPLimit(c, objectID, "WIP limit deleted successfully")
+	}
+	result, err := s.wipLimitCollection.DeleteOne(context.Background(), bson.M{"_id": objectID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete WIP limit"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "WIP limit not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "WIP limit deleted successfully"})
+}
+
+// dryRunWIPLimit answers a dry-run update or delete of a WIP limit with the
+// message the real request would return.
+func (s *Server) dryRunWIPLimit(c echo.Context, id primitive.ObjectID, message string) error {
+	count, err := s.wipLimitCollection.CountDocuments(context.Background(), bson.M{"_id": id})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch WIP limit"})
+	}
+	if count == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "WIP limit not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": message})
+}
@@ -0,0 +1,666 @@
+package taskapi
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Status categories let reports compare projects whose statuses differ.
+const (
+	categoryTodo       = "todo"
+	categoryInProgress = "in_progress"
+	categoryDone       = "done"
+)
+
+var statusCategories = []string{categoryTodo, categoryInProgress, categoryDone}
+
+// todoStatuses are the statuses of projects without a workflow that count
+// as not started; closedStatuses count as done and anything else as in
+// progress.
+var todoStatuses = []string{"Pending", "Open", "New", "Backlog", "To Do"}
+
+// Workflow is the set of statuses a project's tasks may be in and the moves
+// allowed between them. Projects without one accept any status.
+type Workflow struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Project  string             `bson:"project" json:"project"`
+	Statuses []WorkflowStatus   `bson:"statuses" json:"statuses"`
+	// InitialStatus is given to new tasks created without a status; it
+	// defaults to the first status.
+	InitialStatus string `bson:"initial_status" json:"initial_status"`
+	// Transitions lists where a task may go from each status. With none,
+	// any status may follow any other; otherwise moves not listed are
+	// rejected.
+	Transitions []WorkflowTransition `bson:"transitions,omitempty" json:"transitions,omitempty"`
+	CreatedAt   time.Time            `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time            `bson:"updated_at" json:"updated_at"`
+}
+
+type WorkflowStatus struct {
+	Name     string `bson:"name" json:"name"`
+	Category string `bson:"category" json:"category"`
+}
+
+type WorkflowTransition struct {
+	From string   `bson:"from" json:"from"`
+	To   []string `bson:"to" json:"to"`
+}
+
+func (s *Server) ensureWorkflowIndex(ctx context.Context) error {
+	_, err := s.workflowCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "project", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (wf *Workflow) status(name string) *WorkflowStatus {
+	for i := range wf.Statuses {
+		if wf.Statuses[i].Name == name {
+			return &wf.Statuses[i]
+		}
+	}
+	return nil
+}
+
+func (wf *Workflow) statusNames() []string {
+	names := make([]string, len(wf.Statuses))
+	for i, st := range wf.Statuses {
+		names[i] = st.Name
+	}
+	return names
+}
+
+// statusesIn returns the workflow's statuses of category.
+func (wf *Workflow) statusesIn(category string) []string {
+	names := []string{}
+	for _, st := range wf.Statuses {
+		if st.Category == category {
+			names = append(names, st.Name)
+		}
+	}
+	return names
+}
+
+// next returns the statuses a task may move to from status, or nil if the
+// workflow does not restrict transitions.
+func (wf *Workflow) next(status string) []string {
+	if len(wf.Transitions) == 0 {
+		return nil
+	}
+	for _, t := range wf.Transitions {
+		if t.From == status {
+			return t.To
+		}
+	}
+	return []string{}
+}
+
+func (wf *Workflow) allows(from, to string) bool {
+	next := wf.next(from)
+	return next == nil || containsString(next, to)
+}
+
+func (wf *Workflow) validate() string {
+	if wf.Project == "" {
+		return "Project is required"
+	}
+	if len(wf.Statuses) == 0 {
+		return "At least one status is required"
+	}
+	seen := map[string]bool{}
+	for _, st := range wf.Statuses {
+		if st.Name == "" {
+			return "Status name is required"
+		}
+		if seen[st.Name] {
+			return "Duplicate status " + st.Name
+		}
+		seen[st.Name] = true
+		if !containsString(statusCategories, st.Category) {
+			return "Category of " + st.Name + " must be todo, in_progress or done"
+		}
+	}
+	if wf.InitialStatus == "" {
+		wf.InitialStatus = wf.Statuses[0].Name
+	} else if !seen[wf.InitialStatus] {
+		return "Initial status " + wf.InitialStatus + " is not in the workflow"
+	}
+	from := map[string]bool{}
+	for _, t := range wf.Transitions {
+		if !seen[t.From] {
+			return "Transition from unknown status " + t.From
+		}
+		if from[t.From] {
+			return "Duplicate transitions from " + t.From
+		}
+		from[t.From] = true
+		for _, to := range t.To {
+			if !seen[to] {
+				return "Transition to unknown status " + to
+			}
+		}
+	}
+	return ""
+}
+
+// workflowFor returns the project's workflow, or nil if it has none.
+func (s *Server) workflowFor(ctx context.Context, project string) (*Workflow, error) {
+	if project == "" {
+		return nil, nil
+	}
+	var wf Workflow
+	err := s.workflowCollection.FindOne(ctx, bson.M{"project": project}).Decode(&wf)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wf, nil
+}
+
+// initialStatus returns the status new tasks start in under wf, which may
+// be nil.
+func initialStatus(wf *Workflow) string {
+	if wf == nil {
+		return "Pending"
+	}
+	return wf.InitialStatus
+}
+
+// workflowSet holds every workflow by project, for classifying tasks of
+// many projects at once.
+type workflowSet map[string]*Workflow
+
+func (s *Server) loadWorkflows(ctx context.Context) (workflowSet, error) {
+	cursor, err := s.workflowCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var workflows []Workflow
+	if err := cursor.All(ctx, &workflows); err != nil {
+		return nil, err
+	}
+	ws := make(workflowSet, len(workflows))
+	for i := range workflows {
+		ws[workflows[i].Project] = &workflows[i]
+	}
+	return ws, nil
+}
+
+// category returns the category of a task in project with status. Statuses
+// a workflow does not know count as in progress.
+func (ws workflowSet) category(project, status string) string {
+	if wf := ws[project]; wf != nil {
+		if st := wf.status(status); st != nil {
+			return st.Category
+		}
+		return categoryInProgress
+	}
+	switch {
+	case isClosedStatus(status):
+		return categoryDone
+	case containsString(todoStatuses, status):
+		return categoryTodo
+	}
+	return categoryInProgress
+}
+
+func (ws workflowSet) isClosed(task *Task) bool {
+	return ws.category(task.Project, task.Status) == categoryDone
+}
+
+// closedFilter matches the tasks in a done status of their project's
+// workflow, or in one of closedStatuses when the project has none.
+func (ws workflowSet) closedFilter() bson.M {
+	projects := make([]string, 0, len(ws))
+	or := bson.A{}
+	for project, wf := range ws {
+		projects = append(projects, project)
+		or = append(or, bson.M{"project": project, "status": bson.M{"$in": wf.statusesIn(categoryDone)}})
+	}
+	or = append(or, bson.M{"project": bson.M{"$nin": projects}, "status": bson.M{"$in": closedStatuses}})
+	return bson.M{"$or": or}
+}
+
+// enforceWorkflow checks task against its project's workflow, writing the
+// error response and returning false if it breaks it. existing is the task
+// before the change, or nil for a new task, which gets the initial status
+// if it has none. Moving a task into another project needs a status of that
+// project's workflow; within a project, admins can bypass transition rules
+// with ?workflow_override=true. Taking a task out of a project with a
+// workflow into one without, where no rules would hold it any more, needs
+// the same override.
+func (s *Server) enforceWorkflow(c echo.Context, existing, task *Task) (bool, error) {
+	wf, err := s.workflowFor(context.Background(), task.Project)
+	if err != nil {
+		return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflow"})
+	}
+	if wf == nil {
+		if existing == nil || existing.Project == task.Project {
+			return true, nil
+		}
+		left, err := s.workflowFor(context.Background(), existing.Project)
+		if err != nil {
+			return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflow"})
+		}
+		if left == nil || s.allowOverride(c, "workflow_override") {
+			return true, nil
+		}
+		return false, c.JSON(http.StatusConflict, map[string]interface{}{
+			"error":   "Leaving the project's workflow requires an admin override",
+			"project": existing.Project,
+		})
+	}
+	if existing == nil && task.Status == "" {
+		task.Status = wf.InitialStatus
+	}
+	if wf.status(task.Status) == nil {
+		msg := "Status is not part of the project's workflow"
+		if existing != nil && existing.Project != task.Project {
+			msg = "Status mapping required to move the task into the project"
+		}
+		return false, c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":    msg,
+			"status":   task.Status,
+			"statuses": wf.statusNames(),
+		})
+	}
+	if existing == nil || existing.Project != task.Project || existing.Status == task.Status {
+		return true, nil
+	}
+	if wf.allows(existing.Status, task.Status) {
+		return true, nil
+	}
+	if s.allowOverride(c, "workflow_override") {
+		return true, nil
+	}
+	return false, c.JSON(http.StatusConflict, map[string]interface{}{
+		"error":   "Transition not allowed",
+		"from":    existing.Status,
+		"to":      task.Status,
+		"allowed": wf.next(existing.Status),
+	})
+}
+
+// moveTask moves a task into another project. status_mapping translates
+// the task's status into one of the target project's workflow; the mapping
+// may cover other statuses too, so clients can reuse one mapping for every
+// task they move. Moving a task out of a workflow into a project without one
+// takes an admin override, as with any other update.
+func (s *Server) moveTask(c echo.Context) error {
+	id, err := s.parseTaskID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var req struct {
+		Project       string            `json:"project"`
+		StatusMapping map[string]string `json:"status_mapping"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if req.Project == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Project is required"})
+	}
+
+	var existing Task
+	err = s.taskCollection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Task not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch task"})
+	}
+	if existing.Project == req.Project {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Task is already in the project"})
+	}
+
+	update := existing
+	update.Project = req.Project
+	if status, ok := req.StatusMapping[existing.Status]; ok {
+		update.Status = status
+	}
+	return s.replaceTask(c, &existing, &update)
+}
+
+// checkBulkWorkflow validates the status a bulk update of the tasks
+// matching filter sets against the workflow of the project it moves them
+// to, or else of every project the tasks are in. Bulk updates are not held
+// to transition rules, but taking tasks out of a workflow into a project
+// without one needs an admin override.
+func (s *Server) checkBulkWorkflow(ctx context.Context, filter bson.M, setProject, setStatus string, override bool) (string, error) {
+	if setProject != "" {
+		wf, err := s.workflowFor(ctx, setProject)
+		if err != nil {
+			return "", err
+		}
+		if wf == nil {
+			if override {
+				return "", nil
+			}
+			return s.leftWorkflow(ctx, filter, setProject)
+		}
+		if setStatus == "" {
+			return "A status is required to move tasks into a project with a workflow", nil
+		}
+		if wf.status(setStatus) == nil {
+			return "Status " + setStatus + " is not part of the project's workflow", nil
+		}
+		return "", nil
+	}
+	if setStatus == "" {
+		return "", nil
+	}
+	projects, err := s.taskCollection.Distinct(ctx, "project", filter)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(projects))
+	for _, v := range projects {
+		if project, ok := v.(string); ok && project != "" {
+			names = append(names, project)
+		}
+	}
+	sort.Strings(names)
+	for _, project := range names {
+		wf, err := s.workflowFor(ctx, project)
+		if err != nil {
+			return "", err
+		}
+		if wf != nil && wf.status(setStatus) == nil {
+			return "Status " + setStatus + " is not part of the workflow of project " + project, nil
+		}
+	}
+	return "", nil
+}
+
+// leftWorkflow names a project with a workflow that moving the tasks
+// matching filter into project would take some of them out of.
+func (s *Server) leftWorkflow(ctx context.Context, filter bson.M, project string) (string, error) {
+	projects, err := s.taskCollection.Distinct(ctx, "project", filter)
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(projects))
+	for _, v := range projects {
+		if name, ok := v.(string); ok && name != "" && name != project {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		wf, err := s.workflowFor(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if wf != nil {
+			return "Moving tasks out of the workflow of project " + name + " requires an admin override", nil
+		}
+	}
+	return "", nil
+}
+
+// strandedStatuses returns the statuses used by tasks of the workflow's
+// project that the workflow lacks.
+func (s *Server) strandedStatuses(ctx context.Context, wf *Workflow) ([]string, error) {
+	values, err := s.taskCollection.Distinct(ctx, "status",
+		bson.M{"project": wf.Project, "status": bson.M{"$nin": wf.statusNames()}})
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]string, 0, len(values))
+	for _, v := range values {
+		if status, ok := v.(string); ok {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Strings(statuses)
+	return statuses, nil
+}
+
+// saveWorkflowCheck writes a 409 and returns false if saving wf would leave
+// tasks of its project in statuses it does not have.
+func (s *Server) saveWorkflowCheck(c echo.Context, wf *Workflow) (bool, error) {
+	stranded, err := s.strandedStatuses(context.Background(), wf)
+	if err != nil {
+		return false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch tasks"})
+	}
+	if len(stranded) > 0 {
+		return false, c.JSON(http.StatusConflict, map[string]interface{}{
+			"error":    "Tasks of the project use statuses missing from the workflow",
+			"statuses": stranded,
+		})
+	}
+	return true, nil
+}
+
+func (s *Server) createWorkflow(c echo.Context) error {
+	wf := new(Workflow)
+	if err := c.Bind(wf); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	if msg := wf.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if ok, err := s.saveWorkflowCheck(c, wf); !ok {
+		return err
+	}
+
+	wf.ID = primitive.NewObjectID()
+	wf.CreatedAt = time.Now()
+	wf.UpdatedAt = time.Now()
+	if isDryRun(c) {
+		existing, err := s.workflowFor(context.Background(), wf.Project)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch workflow"})
+		}
+		if existing != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Project already has a workflow"})
+		}
+		return c.JSON(http.StatusCreated, wf)
+	}
+	if _, err := s.workflowCollection.InsertOne(context.Background(), wf); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Project already has a workflow"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create workflow"})
+	}
+	return c.JSON(http.StatusCreated, wf)
+}
+
+func (s *Server) getAllWorkflows(c echo.Context) error {
+	cursor, err := s.workflowCollection.Find(context.Background(), bson.M{}, options.Find().SetSort(bson.M{"project": 1}))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch workflows"})
+	}
+	workflows := []Workflow{}
+	if err := cursor.All(context.Background(), &workflows); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding workflow data"})
+	}
+	return c.JSON(http.StatusOK, workflows)
+}
+
+// getProjectWorkflow serves a project's workflow to anyone, so clients can
+// offer the right statuses.
+func (s *Server) getProjectWorkflow(c echo.Context) error {
+	wf, err := s.workflowFor(context.Background(), c.Param("project"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch workflow"})
+	}
+	if wf == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Workflow not found"})
+	}
+	return c.JSON(http.StatusOK, wf)
+}
+
+// updateWorkflow replaces a workflow. The project cannot change.
+func (s *Server) updateWorkflow(c echo.Context) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	var existing Workflow
+	err = s.workflowCollection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Workflow not found"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch workflow"})
+	}
+
+	update := new(Workflow)
+	if err := c.Bind(update); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid input data"})
+	}
+	update.Project = existing.Project
+	if msg := update.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if ok, err := s.saveWorkflowCheck(c, update); !ok {
+		return err
+	}
+	if isDryRun(c) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Workflow updated successfully"})
+	}
+
+	result, err := s.workflowCollection.UpdateOne(context.Background(), bson.M{"_id": objectID}, bson.M{
+		"$set": bson.M{
+			"statuses":       update.Statuses,
+			"initial_status": update.InitialStatus,
+			"transitions":    update.Transitions,
+			"updated_at":     time.Now(),
+		},
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update workflow"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Workflow not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Workflow updated successfully"})
+}
+
+// deleteWorkflow removes a workflow; the project's tasks keep their
+// statuses, which are then free text again.
+func (s *Server) deleteWorkflow(c echo.Context) error {
+	objectID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid ID"})
+	}
+	if isDryRun(c) {
+		count, err := s.workflowCollection.CountDocuments(context.Background(), bson.M{"_id": objectID})
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to fetch workflow"})
+		}
+		if count == 0 {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Workflow not found"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Workflow deleted successfully"})
+	}
+	result, err := s.workflowCollection.DeleteOne(context.Background(), bson.M{"_id": objectID})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete workflow"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Workflow not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Workflow deleted successfully"})
+}
+
+type categoryCounts struct {
+	Key        string           `json:"key"`
+	Todo       int64            `json:"todo"`
+	InProgress int64            `json:"in_progress"`
+	Done       int64            `json:"done"`
+	Statuses   map[string]int64 `json:"statuses,omitempty"`
+}
+
+func (cc *categoryCounts) add(category string, n int64) {
+	switch category {
+	case categoryTodo:
+		cc.Todo += n
+	case categoryInProgress:
+		cc.InProgress += n
+	case categoryDone:
+		cc.Done += n
+	}
+}
+
+// getCategoryReport counts tasks by status category across projects,
+// grouped by ?group_by= project (the default), team or assignee. Grouping by
+// project also breaks the counts down by status.
+func (s *Server) getCategoryReport(c echo.Context) error {
+	groupBy := c.QueryParam("group_by")
+	if groupBy == "" {
+		groupBy = "project"
+	}
+	if groupBy != "project" && groupBy != "team" && groupBy != "assignee" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "group_by must be project, team or assignee"})
+	}
+
+	ctx := context.Background()
+	ws, err := s.loadWorkflows(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to load workflows"})
+	}
+	cursor, err := s.taskCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"project": "$project", "status": "$status", "key": "$" + groupBy},
+			"count": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to aggregate tasks"})
+	}
+	var rows []struct {
+		ID struct {
+			Project string `bson:"project"`
+			Status  string `bson:"status"`
+			Key     string `bson:"key"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error decoding report data"})
+	}
+
+	var total categoryCounts
+	groups := map[string]*categoryCounts{}
+	for _, row := range rows {
+		category := ws.category(row.ID.Project, row.ID.Status)
+		total.add(category, row.Count)
+		g := groups[row.ID.Key]
+		if g == nil {
+			g = &categoryCounts{Key: row.ID.Key}
+			if groupBy == "project" {
+				g.Statuses = map[string]int64{}
+			}
+			groups[row.ID.Key] = g
+		}
+		g.add(category, row.Count)
+		if g.Statuses != nil {
+			g.Statuses[row.ID.Status] += row.Count
+		}
+	}
+	list := make([]*categoryCounts, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"group_by": groupBy,
+		"total":    map[string]int64{categoryTodo: total.Todo, categoryInProgress: total.InProgress, categoryDone: total.Done},
+		"groups":   list,
+	})
+}
@@ -0,0 +1,117 @@
+package taskapi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testWorkflow() *Workflow {
+	return &Workflow{
+		Project: "ops",
+		Statuses: []WorkflowStatus{
+			{Name: "Triage", Category: categoryTodo},
+			{Name: "Fixing", Category: categoryInProgress},
+			{Name: "Fixed", Category: categoryDone},
+			{Name: "Wontfix", Category: categoryDone},
+		},
+		InitialStatus: "Triage",
+		Transitions: []WorkflowTransition{
+			{From: "Triage", To: []string{"Fixing", "Wontfix"}},
+			{From: "Fixing", To: []string{"Fixed", "Triage"}},
+		},
+	}
+}
+
+func TestWorkflowTransitions(t *testing.T) {
+	wf := testWorkflow()
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{"Triage", "Fixing", true},
+		{"Triage", "Wontfix", true},
+		{"Triage", "Fixed", false},
+		{"Fixing", "Triage", true},
+		// A status without transitions is final.
+		{"Fixed", "Triage", false},
+		{"Unknown", "Triage", false},
+	}
+	for _, tt := range tests {
+		if got := wf.allows(tt.from, tt.to); got != tt.allowed {
+			t.Errorf("allows(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.allowed)
+		}
+	}
+	if got, want := wf.next("Triage"), []string{"Fixing", "Wontfix"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("next(Triage) = %v, want %v", got, want)
+	}
+	if got := wf.next("Fixed"); got == nil || len(got) != 0 {
+		t.Errorf("next(Fixed) = %#v, want an empty list", got)
+	}
+
+	// Without transitions, any move is allowed.
+	wf.Transitions = nil
+	if got := wf.next("Fixed"); got != nil {
+		t.Errorf("next without transitions = %v, want nil", got)
+	}
+	if !wf.allows("Fixed", "Triage") {
+		t.Error("unrestricted workflow refused a move")
+	}
+}
+
+func TestWorkflowSetCategory(t *testing.T) {
+	ws := workflowSet{"ops": testWorkflow()}
+	tests := []struct {
+		project, status, want string
+	}{
+		{"ops", "Triage", categoryTodo},
+		{"ops", "Fixing", categoryInProgress},
+		{"ops", "Wontfix", categoryDone},
+		// Statuses the workflow does not know count as in progress, even
+		// ones that would be closed elsewhere.
+		{"ops", "Done", categoryInProgress},
+		{"web", "Done", categoryDone},
+		{"web", "Cancelled", categoryDone},
+		{"web", "Backlog", categoryTodo},
+		{"", "Pending", categoryTodo},
+		{"web", "Review", categoryInProgress},
+	}
+	for _, tt := range tests {
+		if got := ws.category(tt.project, tt.status); got != tt.want {
+			t.Errorf("category(%q, %q) = %q, want %q", tt.project, tt.status, got, tt.want)
+		}
+	}
+	if !ws.isClosed(&Task{Project: "ops", Status: "Fixed"}) || ws.isClosed(&Task{Project: "ops", Status: "Fixing"}) {
+		t.Error("isClosed disagrees with the workflow's categories")
+	}
+}
+
+func TestWorkflowValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Workflow)
+		want   string
+	}{
+		{"valid", func(*Workflow) {}, ""},
+		{"no project", func(wf *Workflow) { wf.Project = "" }, "Project is required"},
+		{"duplicate status", func(wf *Workflow) { wf.Statuses[1].Name = "Triage" }, "Duplicate status Triage"},
+		{"bad category", func(wf *Workflow) { wf.Statuses[0].Category = "later" }, "Category of Triage must be todo, in_progress or done"},
+		{"unknown initial status", func(wf *Workflow) { wf.InitialStatus = "New" }, "Initial status New is not in the workflow"},
+		{"unknown target", func(wf *Workflow) { wf.Transitions[0].To = []string{"Gone"} }, "Transition to unknown status Gone"},
+		{"duplicate source", func(wf *Workflow) { wf.Transitions[1].From = "Triage" }, "Duplicate transitions from Triage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wf := testWorkflow()
+			tt.change(wf)
+			if got := wf.validate(); got != tt.want {
+				t.Errorf("validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	wf := testWorkflow()
+	wf.InitialStatus = ""
+	if wf.validate() != "" || wf.InitialStatus != "Triage" {
+		t.Errorf("initial status defaulted to %q, want Triage", wf.InitialStatus)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"mylearning/taskapi"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const usersUsage = `usage: mylearning users <command> [flags] [args]
+
+commands:
+  create [-email e] [-role r]... [-password-stdin] <username>
+  list
+  disable <username>
+  enable <username>
+  grant <username> <role>
+  revoke <username> <role>
+  reset-link [-base-url u] [-ttl d] <username>
+  revoke-key <username> <key-id|-all>
+
+common flags: -uri (MongoDB URI), -db (database)`
+
+type roleFlags []string
+
+func (r *roleFlags) String() string     { return strings.Join(*r, ",") }
+func (r *roleFlags) Set(v string) error { *r = append(*r, v); return nil }
+
+// runUsers implements the users command, which manages accounts in the same
+// store the server authenticates against.
+func runUsers(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usersUsage)
+	}
+	cmd, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("users "+cmd, flag.ContinueOnError)
+	uri := fs.String("uri", "mongodb://localhost:27017", "MongoDB URI")
+	dbName := fs.String("db", "taskdb", "database")
+	email := fs.String("email", "", "email address (create)")
+	var roles roleFlags
+	fs.Var(&roles, "role", "role to grant, repeatable (create)")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of printing a reset link (create)")
+	baseURL := fs.String("base-url", "http://localhost:8080", "public URL of the API, including any prefix (reset-link)")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long a reset link is valid (create, reset-link)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+
+	want := map[string]int{"create": 1, "list": 0, "disable": 1, "enable": 1, "grant": 2, "revoke": 2, "reset-link": 1, "revoke-key": 2}
+	n, ok := want[cmd]
+	if !ok {
+		return errors.New(usersUsage)
+	}
+	if len(args) != n {
+		return fmt.Errorf("users %s takes %d argument(s)\n\n%s", cmd, n, usersUsage)
+	}
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(*uri))
+	if err != nil {
+		return fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	defer client.Disconnect(ctx)
+	store := taskapi.NewUserStore(client.Database(*dbName))
+	if err := store.EnsureIndexes(ctx); err != nil {
+		return err
+	}
+
+	resetLink := func(username string) error {
+		token, err := store.CreateResetToken(ctx, username, *ttl)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Password reset link for %s (valid for %s):\n%s/auth/password-reset?token=%s\n",
+			username, *ttl, strings.TrimSuffix(*baseURL, "/"), url.QueryEscape(token))
+		return nil
+	}
+
+	switch cmd {
+	case "create":
+		var password string
+		if *passwordStdin {
+			if password, err = readPassword(os.Stdin); err != nil {
+				return err
+			}
+		}
+		u, err := store.Create(ctx, args[0], *email, password, roles)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created user %s (%s)\n", u.Username, u.ID.Hex())
+		if password == "" {
+			return resetLink(u.Username)
+		}
+	case "list":
+		users, err := store.List(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tEMAIL\tROLES\tSTATUS\tACTIVE KEYS\tCREATED")
+		for _, u := range users {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			}
+			keys := 0
+			for _, k := range u.APIKeys {
+				if k.RevokedAt == nil {
+					keys++
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", u.Username, u.Email, strings.Join(u.Roles, ","),
+				status, keys, u.CreatedAt.Format(time.DateOnly))
+		}
+		return w.Flush()
+	case "disable", "enable":
+		if err := store.SetDisabled(ctx, args[0], cmd == "disable"); err != nil {
+			return err
+		}
+		fmt.Printf("User %s %sd\n", args[0], cmd)
+	case "grant":
+		if err := store.GrantRole(ctx, args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Granted %s to %s\n", args[1], args[0])
+	case "revoke":
+		if err := store.RevokeRole(ctx, args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %s from %s\n", args[1], args[0])
+	case "reset-link":
+		return resetLink(args[0])
+	case "revoke-key":
+		keyID := args[1]
+		if keyID == "-all" {
+			keyID = ""
+		}
+		if err := store.RevokeAPIKey(ctx, args[0], keyID); err != nil {
+			return err
+		}
+		if keyID == "" {
+			fmt.Printf("Revoked all API keys of %s\n", args[0])
+		} else {
+			fmt.Printf("Revoked API key %s of %s\n", keyID, args[0])
+		}
+	}
+	return nil
+}
+
+// readPassword reads the first line of r, so passwords can be piped in
+// without ending up in the shell history or process list.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("no password on stdin")
+	}
+	return password, nil
+}